@@ -1,40 +1,122 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/containers/image/v5/docker/reference"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/wantedly/container-platform-tools/cmd/internal/cachecmd"
+	"github.com/wantedly/container-platform-tools/cmd/internal/retrievercmd"
 	"github.com/wantedly/container-platform-tools/dockerplatforms"
 )
 
 func main() {
+	var retrieverOptions retrievercmd.Options
+	var showAttestations, verify, verifyBinaries bool
+	var cacheOptions cachecmd.Options
 	var rootCmd = &cobra.Command{
-		Use: "docker-platforms image...",
+		Use:  "docker-platforms [docker://|oci:|oci-archive:|docker-archive:]image...",
+		Args: cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
-			resolver := dockerplatforms.NewImageTools()
-			cache, err := dockerplatforms.NewYAMLCache(ctx, "image-platforms.yaml")
+			inspectOptions := dockerplatforms.InspectOptions{VerifyPlatforms: verify}
+			resolver, err := retrieverOptions.New()
 			if err != nil {
-				return errors.Wrap(err, "initializing cache")
+				return err
 			}
-			defer cache.WriteBack(ctx)
+			cache, writeBack, err := cacheOptions.Open(ctx)
+			if err != nil {
+				return err
+			}
+			defer writeBack(ctx)
+			defer cacheOptions.PrintStats(os.Stderr, cache)
 			inspector := dockerplatforms.New(resolver, cache)
 			for _, image := range args {
-				platforms, err := inspector.GetPlatforms(ctx, image)
+				imageRef, retriever, err := dockerplatforms.ParseImageArgument(ctx, image)
+				if err != nil {
+					return err
+				}
+				var result dockerplatforms.InspectResult
+				if retriever != nil {
+					// Local images are cheap to read and must not be cached under a registry name.
+					result, err = dockerplatforms.InspectManifest(ctx, imageRef, retriever, inspectOptions)
+				} else {
+					result, err = inspector.Inspect(ctx, strings.TrimPrefix(image, "docker://"), inspectOptions)
+				}
 				if err != nil {
 					return errors.Wrap(err, "Inspecting image platform")
 				}
-				fmt.Printf("Platforms for %s: %v\n", image, platforms)
+				if result.Digest != "" {
+					fmt.Printf("Platforms for %s (%s): %v\n", image, result.Digest, result.Platforms)
+				} else {
+					fmt.Printf("Platforms for %s: %v\n", image, result.Platforms)
+				}
+				for _, mismatch := range result.Mismatches {
+					fmt.Printf("  Platform mismatch: %s\n", mismatch)
+				}
+				if retriever == nil {
+					retriever = resolver
+				}
+				if showAttestations {
+					err = printAttestations(ctx, imageRef, retriever)
+					if err != nil {
+						return err
+					}
+				}
+				if verifyBinaries {
+					mismatches, err := dockerplatforms.VerifyBinaries(ctx, imageRef, retriever)
+					if err != nil {
+						return errors.Wrap(err, "Verifying binaries")
+					}
+					for _, mismatch := range mismatches {
+						fmt.Printf("  Binary mismatch: %s\n", mismatch)
+					}
+				}
 			}
 			return nil
 		},
 	}
 
+	retrieverOptions.AddFlags(rootCmd)
+	rootCmd.PersistentFlags().BoolVar(&showAttestations, "attestations", false, "Show which platforms have provenance, SBOM or other attestations")
+	rootCmd.PersistentFlags().BoolVar(&verify, "verify-platforms", false, "Check the platforms of image indexes against the configs of their images")
+	rootCmd.PersistentFlags().BoolVar(&verifyBinaries, "verify-binaries", false, "Pull the layers of each platform and check the entrypoint and command executables against the platform (registry backend or local images only)")
+	cacheOptions.AddFlags(rootCmd)
+
+	rootCmd.AddCommand(cachecmd.New(&cacheOptions))
+
 	err := rootCmd.Execute()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
+
+func printAttestations(ctx context.Context, imageRef reference.Named, retriever dockerplatforms.ManifestRetriever) error {
+	manifests, err := dockerplatforms.InspectAttestations(ctx, imageRef, retriever)
+	if err != nil {
+		return errors.Wrap(err, "Inspecting attestations")
+	}
+	for _, m := range manifests {
+		var kinds []string
+		for _, kind := range []dockerplatforms.AttestationKind{
+			dockerplatforms.AttestationProvenance,
+			dockerplatforms.AttestationSBOM,
+			dockerplatforms.AttestationSignature,
+			dockerplatforms.AttestationOther,
+		} {
+			if m.HasAttestation(kind) {
+				kinds = append(kinds, string(kind))
+			}
+		}
+		if len(kinds) == 0 {
+			kinds = append(kinds, "none")
+		}
+		fmt.Printf("  %s (%s): %s\n", m.Platform, m.Digest, strings.Join(kinds, ", "))
+	}
+	return nil
+}
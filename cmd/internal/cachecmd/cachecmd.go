@@ -0,0 +1,501 @@
+// Package cachecmd implements the cache subcommands shared by kubectl-platforms and docker-platforms.
+package cachecmd
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+)
+
+// Options are the cache flags shared by the commands.
+type Options struct {
+	// Backend is yaml, bolt, memory or a registered backend,
+	// or several of them separated by commas for a LayeredCache, from the fastest to the slowest.
+	Backend string
+	// Path is the cache file, or what a registered backend takes instead,
+	// or empty for the default path of the backend. Layers take a path each, separated by commas.
+	Path        string
+	Disabled    bool
+	TagTTL      time.Duration
+	RetryErrors bool
+	// WriteBack makes the layers after the first one written at the end of the run only.
+	WriteBack bool
+	// Stats makes PrintStats print the hits and misses of each layer.
+	Stats bool
+
+	backends     map[string]Backend
+	backendNames []string
+}
+
+// Backend is a cache backend that a command provides on top of those of dockerplatforms,
+// such as the backends storing the cache in a cluster.
+type Backend struct {
+	// Usage tells what the backend is for in the help of --cache-backend, starting with its name.
+	Usage string
+	// PathUsage tells what the backend takes as path in the help of --cache.
+	PathUsage string
+	// DefaultPath is shown in the help of --cache as the path used when none is given.
+	DefaultPath string
+	// Open opens the cache at the path, or at the default path when it is empty,
+	// and returns it with the function writing it back.
+	Open func(ctx context.Context, path string, policy dockerplatforms.ExpiryPolicy) (dockerplatforms.Cache, func(context.Context) error, error)
+}
+
+// RegisterBackend makes a backend available under the name. Register backends before calling AddFlags,
+// which lists them in the flag help.
+func (o *Options) RegisterBackend(name string, backend Backend) {
+	if o.backends == nil {
+		o.backends = make(map[string]Backend)
+	}
+	if _, ok := o.backends[name]; !ok {
+		o.backendNames = append(o.backendNames, name)
+	}
+	o.backends[name] = backend
+}
+
+// DefaultTagTTL is how long the commands use cached platforms of image tags by default.
+const DefaultTagTTL = 24 * time.Hour
+
+// AddFlags registers the cache flags as persistent flags of the command.
+func (o *Options) AddFlags(cmd *cobra.Command) {
+	backendUsages := []string{"yaml", "bolt for large inventories"}
+	pathUsages := []string{"Path to the cache of image platforms"}
+	defaultPaths := []string{dockerplatforms.DefaultCachePath(), dockerplatforms.DefaultBoltCachePath() + " with the bolt backend"}
+	for _, name := range o.backendNames {
+		backend := o.backends[name]
+		backendUsages = append(backendUsages, backend.Usage)
+		pathUsages = append(pathUsages, backend.PathUsage)
+		defaultPaths = append(defaultPaths, fmt.Sprintf("%s with the %s backend", backend.DefaultPath, name))
+	}
+	backendUsages = append(backendUsages, "or memory")
+	cmd.PersistentFlags().StringVar(&o.Backend, "cache-backend", "yaml", "How to store the cache of image platforms: "+strings.Join(backendUsages, ", ")+"; several separated by commas look each other up, fastest first")
+	cmd.PersistentFlags().StringVar(&o.Path, "cache", "", fmt.Sprintf("%s, separated by commas for several backends (default %s)", strings.Join(pathUsages, ", or "), strings.Join(defaultPaths, ", ")))
+	cmd.PersistentFlags().BoolVar(&o.Disabled, "no-cache", false, "Neither read nor write the cache of image platforms")
+	cmd.PersistentFlags().DurationVar(&o.TagTTL, "tag-ttl", DefaultTagTTL, "How long cached platforms of image tags are used (0 to keep them forever)")
+	cmd.PersistentFlags().BoolVar(&o.RetryErrors, "retry-errors", false, "Look up again the images whose last lookup failed, ignoring cached errors")
+	cmd.PersistentFlags().BoolVar(&o.WriteBack, "cache-write-back", false, "Write to the cache backends after the first one at the end of the run, instead of on every change")
+	cmd.PersistentFlags().BoolVar(&o.Stats, "cache-stats", false, "Print the hits and misses of each cache backend at the end of the run")
+}
+
+// Open opens the cache the options tell, and returns it with the function writing it back.
+func (o *Options) Open(ctx context.Context) (dockerplatforms.Cache, func(context.Context) error, error) {
+	if o.Disabled {
+		return dockerplatforms.NewNopCache(), func(context.Context) error { return nil }, nil
+	}
+	backends := strings.Split(o.Backend, ",")
+	paths := strings.Split(o.Path, ",")
+	if len(paths) > len(backends) {
+		return nil, nil, errors.Errorf("%d cache paths for %d cache backends", len(paths), len(backends))
+	}
+	paths = append(paths, make([]string, len(backends)-len(paths))...)
+	if len(backends) == 1 && !o.Stats {
+		return o.open(ctx, backends[0], paths[0])
+	}
+
+	var layers []dockerplatforms.CacheLayer
+	var writeBacks []func(context.Context) error
+	// writeBack flushes the layered cache, then writes back every layer even if one fails.
+	writeBack := func(ctx context.Context) error {
+		var err error
+		for _, fn := range writeBacks {
+			if layerErr := fn(ctx); err == nil {
+				err = layerErr
+			}
+		}
+		return err
+	}
+	for i, backend := range backends {
+		cache, layerWriteBack, err := o.open(ctx, backend, paths[i])
+		if err != nil {
+			writeBack(ctx)
+			return nil, nil, err
+		}
+		layers = append(layers, dockerplatforms.CacheLayer{
+			Name:      backend,
+			Cache:     cache,
+			WriteBack: o.WriteBack && i > 0,
+		})
+		writeBacks = append(writeBacks, layerWriteBack)
+	}
+	cache := dockerplatforms.NewLayeredCache(layers...)
+	writeBacks = append([]func(context.Context) error{cache.Flush}, writeBacks...)
+	return cache, writeBack, nil
+}
+
+// PrintStats prints the hits and misses of each layer of the cache, if the options ask for them.
+func (o *Options) PrintStats(w io.Writer, cache dockerplatforms.Cache) {
+	layered, ok := cache.(*dockerplatforms.LayeredCache)
+	if !o.Stats || !ok {
+		return
+	}
+	fmt.Fprintln(w, "Cache:")
+	for _, stats := range layered.Stats() {
+		fmt.Fprintf(w, "  %s: %d hits, %d misses\n", stats.Name, stats.Hits, stats.Misses)
+	}
+}
+
+// open opens the cache of one backend.
+func (o *Options) open(ctx context.Context, backend, path string) (dockerplatforms.Cache, func(context.Context) error, error) {
+	switch backend {
+	case "memory":
+		cache := dockerplatforms.NewMemoryCache()
+		cache.TagTTL = o.TagTTL
+		cache.RetryErrors = o.RetryErrors
+		return cache, func(context.Context) error { return nil }, nil
+	case "yaml":
+		cache, err := dockerplatforms.NewYAMLCache(ctx, cmp.Or(path, dockerplatforms.DefaultCachePath()))
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "initializing cache")
+		}
+		cache.TagTTL = o.TagTTL
+		cache.RetryErrors = o.RetryErrors
+		return cache, cache.WriteBack, nil
+	case "bolt":
+		path := cmp.Or(path, dockerplatforms.DefaultBoltCachePath())
+		_, statErr := os.Stat(path)
+		cache, err := dockerplatforms.NewBoltCache(ctx, path)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "initializing cache")
+		}
+		cache.TagTTL = o.TagTTL
+		cache.RetryErrors = o.RetryErrors
+		closeCache := func(context.Context) error { return cache.Close() }
+		// A new database starts from the YAML cache used before, if there is one at the default path.
+		if errors.Is(statErr, os.ErrNotExist) {
+			_, err = os.Stat(dockerplatforms.DefaultCachePath())
+			if err == nil {
+				_, err = cache.MigrateFromYAML(ctx, dockerplatforms.DefaultCachePath())
+			}
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				cache.Close()
+				return nil, nil, errors.Wrap(err, "migrating the YAML cache")
+			}
+		}
+		return cache, closeCache, nil
+	default:
+		registered, ok := o.backends[backend]
+		if !ok {
+			return nil, nil, errors.Errorf("unknown cache backend: %s", backend)
+		}
+		policy := dockerplatforms.DefaultExpiryPolicy()
+		policy.TagTTL = o.TagTTL
+		policy.RetryErrors = o.RetryErrors
+		cache, writeBack, err := registered.Open(ctx, path, policy)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "initializing cache")
+		}
+		return cache, writeBack, nil
+	}
+}
+
+// New creates the cache command, managing the cache the options tell.
+func New(o *Options) *cobra.Command {
+	cacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the cache of image platforms",
+	}
+
+	// withCache opens the cache, runs fn and writes the changes back.
+	withCache := func(cmd *cobra.Command, fn func(ctx context.Context, cache dockerplatforms.ManagedCache) error) error {
+		ctx := cmd.Context()
+		if o.Disabled {
+			return errors.New("the cache is disabled by --no-cache")
+		}
+		if strings.Contains(o.Backend, ",") {
+			return errors.New("the cache commands manage one cache backend at a time; choose it with --cache-backend")
+		}
+		cache, writeBack, err := o.open(ctx, o.Backend, o.Path)
+		if err != nil {
+			return err
+		}
+		managed, ok := cache.(dockerplatforms.ManagedCache)
+		if !ok {
+			writeBack(ctx)
+			return errors.Errorf("the %s cache cannot be managed", o.Backend)
+		}
+		err = fn(ctx, managed)
+		if err != nil {
+			writeBack(ctx)
+			return err
+		}
+		return errors.Wrap(writeBack(ctx), "writing cache")
+	}
+
+	cacheCmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the cached images",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withCache(cmd, func(ctx context.Context, cache dockerplatforms.ManagedCache) error {
+				w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+				entries, err := cache.Entries(ctx)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(w, "IMAGE\tVALUE\tFETCHED\tSTATUS")
+				for _, entry := range entries {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", entry.Image, value(entry), entry.FetchedAt.Local().Format(time.DateTime), status(entry))
+				}
+				return w.Flush()
+			})
+		},
+	})
+
+	cacheCmd.AddCommand(&cobra.Command{
+		Use:   "show image",
+		Short: "Show the cache entry of an image, and the entry of the digest a tag resolved to",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withCache(cmd, func(ctx context.Context, cache dockerplatforms.ManagedCache) error {
+				image := normalize(args[0])
+				entry, ok, err := cache.Entry(ctx, image)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return errors.Errorf("%s is not cached", image)
+				}
+				printEntry(cmd.OutOrStdout(), entry)
+				if entry.Digest == "" {
+					return nil
+				}
+				name, scope, hasScope := strings.Cut(image, "#")
+				named, err := reference.ParseNormalizedNamed(name)
+				if err != nil {
+					return nil
+				}
+				canonical, err := reference.WithDigest(reference.TrimNamed(named), entry.Digest)
+				if err != nil {
+					return nil
+				}
+				digestKey := canonical.String()
+				if hasScope {
+					digestKey += "#" + scope
+				}
+				digestEntry, ok, err := cache.Entry(ctx, digestKey)
+				if err != nil {
+					return err
+				}
+				if ok {
+					fmt.Fprintln(cmd.OutOrStdout())
+					printEntry(cmd.OutOrStdout(), digestEntry)
+				}
+				return nil
+			})
+		},
+	})
+
+	cacheCmd.AddCommand(&cobra.Command{
+		Use:   "invalidate pattern...",
+		Short: "Remove the entries of images matching patterns, where * matches any text",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withCache(cmd, func(ctx context.Context, cache dockerplatforms.ManagedCache) error {
+				removed := 0
+				for _, pattern := range args {
+					n, err := cache.Invalidate(ctx, pattern)
+					if err != nil {
+						return err
+					}
+					removed += n
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "Removed %d entries\n", removed)
+				return nil
+			})
+		},
+	})
+
+	var olderThan time.Duration
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove the entries fetched long ago",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withCache(cmd, func(ctx context.Context, cache dockerplatforms.ManagedCache) error {
+				removed, err := cache.Prune(ctx, time.Now().Add(-olderThan))
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "Removed %d entries\n", removed)
+				return nil
+			})
+		},
+	}
+	pruneCmd.Flags().DurationVar(&olderThan, "older-than", 30*24*time.Hour, "Remove the entries fetched longer ago than this")
+	cacheCmd.AddCommand(pruneCmd)
+
+	cacheCmd.AddCommand(&cobra.Command{
+		Use:   "stats",
+		Short: "Show statistics about the cache",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withCache(cmd, func(ctx context.Context, cache dockerplatforms.ManagedCache) error {
+				entries, err := cache.Entries(ctx)
+				if err != nil {
+					return err
+				}
+				printStats(cmd.OutOrStdout(), entries)
+				return nil
+			})
+		},
+	})
+
+	cacheCmd.AddCommand(&cobra.Command{
+		Use:   "export [file]",
+		Short: "Write the cache entries to a file, or to the standard output",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withCache(cmd, func(ctx context.Context, cache dockerplatforms.ManagedCache) error {
+				if len(args) == 0 || args[0] == "-" {
+					return cache.Export(ctx, cmd.OutOrStdout())
+				}
+				f, err := os.Create(args[0])
+				if err != nil {
+					return errors.Wrap(err, "creating export file")
+				}
+				err = cache.Export(ctx, f)
+				if err != nil {
+					f.Close()
+					return err
+				}
+				return f.Close()
+			})
+		},
+	})
+
+	cacheCmd.AddCommand(&cobra.Command{
+		Use:   "import file...",
+		Short: "Merge exported cache entries, keeping the newer entry on conflicts",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withCache(cmd, func(ctx context.Context, cache dockerplatforms.ManagedCache) error {
+				taken := 0
+				for _, name := range args {
+					n, err := importFile(ctx, cache, name, cmd.InOrStdin())
+					if err != nil {
+						return errors.Wrapf(err, "importing %s", name)
+					}
+					taken += n
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "Imported %d entries\n", taken)
+				return nil
+			})
+		},
+	})
+
+	return cacheCmd
+}
+
+func importFile(ctx context.Context, cache dockerplatforms.ManagedCache, name string, stdin io.Reader) (int, error) {
+	if name == "-" {
+		return cache.Import(ctx, stdin)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return cache.Import(ctx, f)
+}
+
+// normalize turns an image name as typed into the key of its cache entry.
+func normalize(image string) string {
+	key, scope, hasScope := strings.Cut(image, "#")
+	named, err := reference.ParseNormalizedNamed(key)
+	if err != nil {
+		return image
+	}
+	key = reference.TagNameOnly(named).String()
+	if hasScope {
+		key += "#" + scope
+	}
+	return key
+}
+
+func value(entry dockerplatforms.CacheEntry) string {
+	switch {
+	case entry.Error != "":
+		return fmt.Sprintf("error (%s)", cmp.Or(entry.ErrorClass, dockerplatforms.ErrorOther))
+	case entry.Digest != "":
+		return entry.Digest.String()
+	default:
+		return entry.Platforms.String()
+	}
+}
+
+func status(entry dockerplatforms.CacheEntry) string {
+	if entry.Expired {
+		return "expired"
+	}
+	return "fresh"
+}
+
+func printEntry(w io.Writer, entry dockerplatforms.CacheEntry) {
+	fmt.Fprintf(w, "Image:      %s\n", entry.Image)
+	switch {
+	case entry.Error != "":
+		fmt.Fprintf(w, "Error:      %s\n", entry.Error)
+		fmt.Fprintf(w, "Class:      %s\n", cmp.Or(entry.ErrorClass, dockerplatforms.ErrorOther))
+	case entry.Digest != "":
+		fmt.Fprintf(w, "Digest:     %s\n", entry.Digest)
+	default:
+		fmt.Fprintf(w, "Platforms:  %s\n", entry.Platforms)
+	}
+	fmt.Fprintf(w, "Fetched at: %s\n", entry.FetchedAt.Local().Format(time.RFC3339))
+	fmt.Fprintf(w, "Status:     %s\n", status(entry))
+}
+
+func printStats(w io.Writer, entries []dockerplatforms.CacheEntry) {
+	var platforms, digests, errorCount, expired int
+	errorClasses := make(map[dockerplatforms.ErrorClass]int)
+	var oldest, newest time.Time
+	for _, entry := range entries {
+		switch {
+		case entry.Error != "":
+			errorCount++
+			errorClasses[cmp.Or(entry.ErrorClass, dockerplatforms.ErrorOther)]++
+		case entry.Digest != "":
+			digests++
+		default:
+			platforms++
+		}
+		if entry.Expired {
+			expired++
+		}
+		if oldest.IsZero() || entry.FetchedAt.Before(oldest) {
+			oldest = entry.FetchedAt
+		}
+		if entry.FetchedAt.After(newest) {
+			newest = entry.FetchedAt
+		}
+	}
+
+	fmt.Fprintf(w, "Entries:          %d\n", len(entries))
+	fmt.Fprintf(w, "  Platforms:      %d\n", platforms)
+	fmt.Fprintf(w, "  Tag digests:    %d\n", digests)
+	fmt.Fprintf(w, "  Errors:         %d\n", errorCount)
+	classes := make([]dockerplatforms.ErrorClass, 0, len(errorClasses))
+	for class := range errorClasses {
+		classes = append(classes, class)
+	}
+	slices.Sort(classes)
+	for _, class := range classes {
+		fmt.Fprintf(w, "    %-14s%d\n", string(class)+":", errorClasses[class])
+	}
+	fmt.Fprintf(w, "Expired:          %d\n", expired)
+	if len(entries) > 0 {
+		fmt.Fprintf(w, "Oldest fetch:     %s\n", oldest.Local().Format(time.RFC3339))
+		fmt.Fprintf(w, "Newest fetch:     %s\n", newest.Local().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,50 @@
+// Package retrievercmd implements the manifest retriever flags shared by kubectl-platforms and docker-platforms.
+package retrievercmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+)
+
+// Options are the manifest retriever flags shared by the commands.
+type Options struct {
+	// Backend is registry or imagetools.
+	Backend string
+	// RegistriesConf is the registries.conf file of the registry backend, or empty for none.
+	RegistriesConf string
+	RateLimit      dockerplatforms.RateLimit
+}
+
+// AddFlags registers the manifest retriever flags as persistent flags of the command.
+func (o *Options) AddFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&o.Backend, "backend", "registry", "How to retrieve manifests: registry or imagetools")
+	cmd.PersistentFlags().IntVar(&o.RateLimit.MaxConcurrent, "registry-max-concurrent", 8, "Maximum number of concurrent requests to each registry (0 for no limit)")
+	cmd.PersistentFlags().Float64Var(&o.RateLimit.RequestsPerSecond, "registry-qps", 0, "Maximum number of requests per second to each registry (0 for no limit)")
+	cmd.PersistentFlags().StringVar(&o.RegistriesConf, "registries-conf", "", "Path to a registries.conf file configuring mirrors, rewrites and insecure registries")
+}
+
+// New creates the manifest retriever the options tell.
+func (o *Options) New() (dockerplatforms.ManifestRetriever, error) {
+	switch o.Backend {
+	case "registry":
+		dockerConfig, err := dockerplatforms.LoadDockerConfig("")
+		if err != nil {
+			return nil, errors.Wrap(err, "loading docker config")
+		}
+		client := dockerplatforms.NewRegistryClient()
+		client.Credentials = dockerConfig
+		client.RateLimit = o.RateLimit
+		if o.RegistriesConf != "" {
+			client.Registries, err = dockerplatforms.LoadRegistriesConfig(o.RegistriesConf)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return client, nil
+	case "imagetools":
+		return dockerplatforms.NewImageTools(), nil
+	default:
+		return nil, errors.Errorf("unknown backend: %s", o.Backend)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/wantedly/container-platform-tools/cmd/internal/cachecmd"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+	"github.com/wantedly/container-platform-tools/k8splatforms"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// defaultClusterCacheName is the ConfigMap or Secret of the cache by default,
+// in the namespace of the kubeconfig context.
+const defaultClusterCacheName = "image-platforms"
+
+// registerClusterCaches adds the cache backends storing the cache in the cluster of the kubeconfig,
+// which is read when the cache is opened, after the flags are parsed.
+func registerClusterCaches(o *cachecmd.Options, kubeconfig *string) {
+	o.RegisterBackend("configmap", cachecmd.Backend{
+		Usage:       "configmap to share it in a cluster",
+		PathUsage:   "[namespace/]name of its ConfigMap",
+		DefaultPath: defaultClusterCacheName,
+		Open:        openClusterCache(kubeconfig, k8splatforms.NewConfigMapCache),
+	})
+	o.RegisterBackend("secret", cachecmd.Backend{
+		Usage:       "secret to share it in a cluster without exposing the image names",
+		PathUsage:   "[namespace/]name of its Secret",
+		DefaultPath: defaultClusterCacheName,
+		Open:        openClusterCache(kubeconfig, k8splatforms.NewSecretCache),
+	})
+}
+
+type newClusterCacheFunc func(ctx context.Context, clientset kubernetes.Interface, namespace, name string) (*k8splatforms.ClusterCache, error)
+
+func openClusterCache(kubeconfig *string, newCache newClusterCacheFunc) func(ctx context.Context, path string, policy dockerplatforms.ExpiryPolicy) (dockerplatforms.Cache, func(context.Context) error, error) {
+	return func(ctx context.Context, path string, policy dockerplatforms.ExpiryPolicy) (dockerplatforms.Cache, func(context.Context) error, error) {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = *kubeconfig
+		clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+		namespace, name, ok := strings.Cut(path, "/")
+		if !ok {
+			var err error
+			namespace, _, err = clientConfig.Namespace()
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "loading kubeconfig")
+			}
+			name = path
+		}
+		name = cmp.Or(name, defaultClusterCacheName)
+		config, err := clientConfig.ClientConfig()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "loading kubeconfig")
+		}
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "creating clientset")
+		}
+		cache, err := newCache(ctx, clientset, namespace, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		cache.ExpiryPolicy = policy
+		return cache, cache.WriteBack, nil
+	}
+}
@@ -9,10 +9,13 @@ import (
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/wantedly/container-platform-tools/cmd/internal/cachecmd"
+	"github.com/wantedly/container-platform-tools/cmd/internal/retrievercmd"
 	"github.com/wantedly/container-platform-tools/dockerplatforms"
 	"github.com/wantedly/container-platform-tools/k8splatforms"
 	"k8s.io/client-go/tools/clientcmd"
@@ -22,7 +25,8 @@ import (
 func main() {
 	var c = cmdargs{}
 	var rootCmd = &cobra.Command{
-		Use: "kubectl-platforms image...",
+		Use:  "kubectl-platforms image...",
+		Args: cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			c.stdout = cmd.OutOrStdout()
 			c.stderr = cmd.ErrOrStderr()
@@ -37,8 +41,21 @@ func main() {
 	rootCmd.PersistentFlags().StringVar(&c.kubeconfig, "kubeconfig", kubeconfigDefault, "Path to the kubeconfig file")
 	rootCmd.PersistentFlags().StringVar(&c.after, "after", "", "Take into account resources after this time (RFC3339)")
 	c.nodePlatforms = dockerPlatformList(dockerplatforms.MustParseDockerPlatformList("linux/amd64"))
-	rootCmd.PersistentFlags().Var(&c.nodePlatforms, "node-platforms", "List of node platforms")
+	rootCmd.PersistentFlags().Var(&c.nodePlatforms, "node-platforms", "List of node platforms; patterns such as linux/* and */arm64 stand for the matching platforms of the nodes of the cluster")
+	rootCmd.PersistentFlags().BoolVar(&c.nodePlatformsFromNodes, "node-platforms-from-nodes", false, "Take the node platforms from the nodes of the cluster instead of --node-platforms, with the x86-64 levels of amd64 nodes from Node Feature Discovery labels or the "+k8splatforms.AMD64LevelLabel+" label")
+	rootCmd.PersistentFlags().Var(&c.emulation, "emulation", "Platforms nodes emulate, e.g. with the QEMU handlers of binfmt_misc, as node-platform=platform,...; may be repeated (e.g. linux/arm64=linux/amd64,linux/386)")
 	rootCmd.PersistentFlags().BoolVar(&c.csv, "csv", false, "Output in CSV format")
+	rootCmd.PersistentFlags().BoolVar(&c.json, "json", false, "Output the rows in JSON format")
+	rootCmd.MarkFlagsMutuallyExclusive("csv", "json")
+	rootCmd.PersistentFlags().BoolVar(&c.pullSecrets, "pull-secrets", true, "Use the imagePullSecrets of workloads to inspect their images")
+	rootCmd.PersistentFlags().BoolVar(&c.verify, "verify-platforms", false, "Check the platforms of image indexes against the configs of their images (slower)")
+	rootCmd.PersistentFlags().BoolVar(&c.compatible, "compatible-platforms", false, "Count 32-bit images as runnable on 64-bit nodes, such as linux/arm/v7 on linux/arm64 (only if the CPUs of the nodes run 32-bit code)")
+	rootCmd.PersistentFlags().IntVar(&c.concurrency, "concurrency", 16, "Number of image lookups run concurrently")
+	c.retriever.AddFlags(rootCmd)
+	registerClusterCaches(&c.cache, &c.kubeconfig)
+	c.cache.AddFlags(rootCmd)
+
+	rootCmd.AddCommand(cachecmd.New(&c.cache))
 
 	err := rootCmd.Execute()
 	if err != nil {
@@ -48,12 +65,21 @@ func main() {
 }
 
 type cmdargs struct {
-	stdout        io.Writer
-	stderr        io.Writer
-	kubeconfig    string
-	after         string
-	nodePlatforms dockerPlatformList
-	csv           bool
+	stdout                 io.Writer
+	stderr                 io.Writer
+	kubeconfig             string
+	after                  string
+	nodePlatforms          dockerPlatformList
+	csv                    bool
+	json                   bool
+	retriever              retrievercmd.Options
+	pullSecrets            bool
+	concurrency            int
+	verify                 bool
+	compatible             bool
+	nodePlatformsFromNodes bool
+	emulation              emulationFlag
+	cache                  cachecmd.Options
 }
 
 type dockerPlatformList dockerplatforms.DockerPlatformList
@@ -62,7 +88,7 @@ func (l *dockerPlatformList) String() string {
 	return dockerplatforms.DockerPlatformList(*l).String()
 }
 func (l *dockerPlatformList) Set(text string) error {
-	list, err := dockerplatforms.ParseDockerPlatformList(text)
+	list, err := dockerplatforms.ParseDockerPlatformPatterns(text)
 	if err != nil {
 		return errors.Wrap(err, "parsing docker platform list")
 	}
@@ -73,13 +99,54 @@ func (l *dockerPlatformList) Type() string {
 	return "dockerPlatformList"
 }
 
+// emulationFlag collects node-platform=platform,... entries, one per occurrence of the flag.
+type emulationFlag k8splatforms.Emulation
+
+func (e *emulationFlag) String() string {
+	entries := make([]string, 0, len(*e))
+	for host, platforms := range *e {
+		entries = append(entries, host.String()+"="+platforms.String())
+	}
+	slices.Sort(entries)
+	return strings.Join(entries, "; ")
+}
+func (e *emulationFlag) Set(text string) error {
+	hostText, platformsText, ok := strings.Cut(text, "=")
+	if !ok {
+		return errors.Errorf("missing = in emulation: %s", text)
+	}
+	hosts, err := dockerplatforms.ParseDockerPlatformPatterns(hostText)
+	if err != nil {
+		return errors.Wrap(err, "parsing emulating node platform")
+	}
+	if len(hosts) != 1 {
+		return errors.Errorf("expected one node platform before = in emulation: %s", text)
+	}
+	platforms, err := dockerplatforms.ParseDockerPlatformPatterns(platformsText)
+	if err != nil {
+		return errors.Wrap(err, "parsing emulated platforms")
+	}
+	if *e == nil {
+		*e = make(emulationFlag)
+	}
+	(*e)[hosts[0]] = append((*e)[hosts[0]], platforms...).Normalized()
+	return nil
+}
+func (e *emulationFlag) Type() string {
+	return "emulation"
+}
+
 func (c *cmdargs) Run(ctx context.Context) error {
-	resolver := dockerplatforms.NewImageTools()
-	cache, err := dockerplatforms.NewYAMLCache(ctx, "image-platforms.yaml")
+	resolver, err := c.retriever.New()
 	if err != nil {
-		return errors.Wrap(err, "initializing cache")
+		return err
 	}
-	defer cache.WriteBack(ctx)
+	cache, writeBack, err := c.cache.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer writeBack(ctx)
+	defer c.cache.PrintStats(c.stderr, cache)
 	inspector := dockerplatforms.New(resolver, cache)
 
 	config, err := clientcmd.BuildConfigFromFlags("", c.kubeconfig)
@@ -92,11 +159,18 @@ func (c *cmdargs) Run(ctx context.Context) error {
 		return errors.Wrap(err, "parsing time")
 	}
 
-	rows, collectErr := k8splatforms.Collector{
-		RESTConfig:        config,
-		After:             after,
-		NodePlatforms:     dockerplatforms.DockerPlatformList(c.nodePlatforms),
-		PlatformInspector: inspector,
+	rows, nodePlatforms, collectErr := k8splatforms.Collector{
+		RESTConfig:             config,
+		After:                  after,
+		NodePlatforms:          dockerplatforms.DockerPlatformList(c.nodePlatforms),
+		NodePlatformsFromNodes: c.nodePlatformsFromNodes,
+		Emulation:              k8splatforms.Emulation(c.emulation),
+		PlatformInspector:      inspector,
+		UsePullSecrets:         c.pullSecrets,
+		Warnings:               c.stderr,
+		Concurrency:            c.concurrency,
+		VerifyPlatforms:        c.verify,
+		CompatiblePlatforms:    c.compatible,
 		Processors: []k8splatforms.KindProcessor{
 			k8splatforms.PodProcessor{},
 			k8splatforms.ReplicaSetProcessor{},
@@ -116,52 +190,23 @@ func (c *cmdargs) Run(ctx context.Context) error {
 
 	if c.csv {
 		writer := csv.NewWriter(c.stdout)
-		err := writer.Write([]string{
-			"Namespace",
-			"APIVersion",
-			"Kind",
-			"Name",
-			"SubName",
-			"ScheduledPlatform",
-			"DeclaredPlatforms",
-			"ImagePlatforms",
-			"ImagePlatformDetails",
-			"HasViolation",
-			"CPUUsage",
-			"MemoryUsage",
-			"Error",
-		})
+		header := make([]string, len(csvColumns))
+		for i, column := range csvColumns {
+			header[i] = column.name
+		}
+		err := writer.Write(header)
 		if err != nil {
 			return errors.Wrap(err, "writing CSV header")
 		}
 		for _, row := range rows {
-			var scheduledPlatform string
-			if row.ScheduledPlatform != nil {
-				scheduledPlatform = row.ScheduledPlatform.String()
-			}
-			imagePlatformDetailsMap := make(map[string]string)
-			for k, v := range row.ImagePlatformDetails {
-				imagePlatformDetailsMap[k] = v.String()
-			}
-			imagePlatformDetails, err := json.Marshal(imagePlatformDetailsMap)
-			if err != nil {
-				return errors.Wrap(err, "marshaling image platform details")
+			record := make([]string, len(csvColumns))
+			for i, column := range csvColumns {
+				record[i], err = column.value(row)
+				if err != nil {
+					return errors.Wrapf(err, "writing CSV column %s", column.name)
+				}
 			}
-			err = writer.Write([]string{
-				row.Namespace,
-				row.APIVersion,
-				row.Kind,
-				row.Name,
-				row.SubName,
-				scheduledPlatform,
-				row.DeclaredPlatforms.String(),
-				row.ImagePlatforms.String(),
-				string(imagePlatformDetails),
-				fmt.Sprintf("%v", row.HasViolation),
-				fmt.Sprintf("%v", row.CPUUsage),
-				fmt.Sprintf("%v", row.MemoryUsage),
-				row.Error,
-			})
+			err = writer.Write(record)
 			if err != nil {
 				return errors.Wrap(err, "writing CSV row")
 			}
@@ -172,17 +217,26 @@ func (c *cmdargs) Run(ctx context.Context) error {
 		if err != nil {
 			return errors.Wrap(err, "flushing CSV")
 		}
+	} else if c.json {
+		encoder := json.NewEncoder(c.stdout)
+		encoder.SetIndent("", "  ")
+		err := encoder.Encode(rows)
+		if err != nil {
+			return errors.Wrap(err, "writing JSON")
+		}
 	} else {
 		stats := make(map[string]counts)
 		allKey := "All"
 		stats[allKey] = counts{}
-		for _, platform := range c.nodePlatforms {
-			stats[allKey] = counts{}
+		stats["HasViolation"] = counts{}
+		if len(c.emulation) > 0 {
+			stats["RunsUnderEmulation"] = counts{}
+		}
+		for _, platform := range nodePlatforms {
 			stats[fmt.Sprintf("DeclaredPlatform including %s", platform)] = counts{}
 			stats[fmt.Sprintf("ImagePlatform including %s", platform)] = counts{}
 			stats[fmt.Sprintf("ScheduledPlatform = %s", platform)] = counts{}
 			stats["ScheduledPlatform = (pending)"] = counts{}
-			stats["HasViolation"] = counts{}
 		}
 		for _, row := range rows {
 			isPod := row.APIVersion == "v1" && row.Kind == "Pod"
@@ -217,7 +271,7 @@ func (c *cmdargs) Run(ctx context.Context) error {
 			}
 
 			if row.ScheduledPlatform != nil {
-				key := fmt.Sprintf("ScheduledPlatform = %s", row.ScheduledPlatform)
+				key := fmt.Sprintf("ScheduledPlatform = %s", statsPlatform(*row.ScheduledPlatform, nodePlatforms))
 				stats[key] = stats[key].Add(rowCount)
 			} else if isPod {
 				key := "ScheduledPlatform = (pending)"
@@ -228,6 +282,14 @@ func (c *cmdargs) Run(ctx context.Context) error {
 				key := "HasViolation"
 				stats[key] = stats[key].Add(rowCount)
 			}
+			if row.RunMode == k8splatforms.RunsUnderEmulation {
+				key := "RunsUnderEmulation"
+				stats[key] = stats[key].Add(rowCount)
+				for _, platform := range row.EmulatedPlatforms {
+					key := fmt.Sprintf("EmulatedPlatform including %s", platform)
+					stats[key] = stats[key].Add(rowCount)
+				}
+			}
 		}
 
 		keys := make([]string, 0, len(stats))
@@ -290,7 +352,79 @@ func (c *cmdargs) Run(ctx context.Context) error {
 				for _, containerKey := range containerKeys {
 					platforms := row.ImagePlatformDetails[containerKey]
 					if !platforms.Includes(row.DeclaredPlatforms) {
-						_, err := fmt.Fprintf(c.stdout, "  %s: %s\n", containerKey, platforms)
+						var imageDigest string
+						if d, ok := row.ImageDigests[containerKey]; ok {
+							imageDigest = " (" + d.String() + ")"
+						}
+						_, err := fmt.Fprintf(c.stdout, "  %s%s: %s\n", containerKey, imageDigest, platforms)
+						if err != nil {
+							return errors.Wrap(err, "writing stats")
+						}
+					}
+				}
+			}
+		}
+
+		if len(c.emulation) > 0 {
+			fmt.Fprintf(c.stdout, "Emulated placements:\n")
+			for _, row := range rows {
+				if row.RunMode != k8splatforms.RunsUnderEmulation {
+					continue
+				}
+				if row.SubName != "" {
+					_, err := fmt.Fprintf(c.stdout, "%s:%s.%s/%s(%s):\n", row.Namespace, row.APIVersion, row.Kind, row.Name, row.SubName)
+					if err != nil {
+						return errors.Wrap(err, "writing stats")
+					}
+				} else {
+					_, err := fmt.Fprintf(c.stdout, "%s:%s.%s/%s:\n", row.Namespace, row.APIVersion, row.Kind, row.Name)
+					if err != nil {
+						return errors.Wrap(err, "writing stats")
+					}
+				}
+				containerKeys := make([]string, 0, len(row.EmulatedPlatformDetails))
+				for key := range row.EmulatedPlatformDetails {
+					containerKeys = append(containerKeys, key)
+				}
+				slices.Sort(containerKeys)
+				for _, containerKey := range containerKeys {
+					var imageDigest string
+					if d, ok := row.ImageDigests[containerKey]; ok {
+						imageDigest = " (" + d.String() + ")"
+					}
+					_, err := fmt.Fprintf(c.stdout, "  %s%s: emulated on %s\n", containerKey, imageDigest, row.EmulatedPlatformDetails[containerKey])
+					if err != nil {
+						return errors.Wrap(err, "writing stats")
+					}
+				}
+			}
+		}
+
+		if c.verify {
+			fmt.Fprintf(c.stdout, "Platform mismatches:\n")
+			for _, row := range rows {
+				if len(row.PlatformMismatches) == 0 {
+					continue
+				}
+				if row.SubName != "" {
+					_, err := fmt.Fprintf(c.stdout, "%s:%s.%s/%s(%s):\n", row.Namespace, row.APIVersion, row.Kind, row.Name, row.SubName)
+					if err != nil {
+						return errors.Wrap(err, "writing stats")
+					}
+				} else {
+					_, err := fmt.Fprintf(c.stdout, "%s:%s.%s/%s:\n", row.Namespace, row.APIVersion, row.Kind, row.Name)
+					if err != nil {
+						return errors.Wrap(err, "writing stats")
+					}
+				}
+				containerKeys := make([]string, 0, len(row.PlatformMismatches))
+				for key := range row.PlatformMismatches {
+					containerKeys = append(containerKeys, key)
+				}
+				slices.Sort(containerKeys)
+				for _, containerKey := range containerKeys {
+					for _, mismatch := range row.PlatformMismatches[containerKey] {
+						_, err := fmt.Fprintf(c.stdout, "  %s: %s\n", containerKey, mismatch)
 						if err != nil {
 							return errors.Wrap(err, "writing stats")
 						}
@@ -303,6 +437,68 @@ func (c *cmdargs) Run(ctx context.Context) error {
 	return errors.Wrap(collectErr, "collecting platforms")
 }
 
+// csvColumns are the columns of the CSV output, in the order they were added, each with its value for a row.
+var csvColumns = []struct {
+	name  string
+	value func(row k8splatforms.Row) (string, error)
+}{
+	{"Namespace", func(row k8splatforms.Row) (string, error) { return row.Namespace, nil }},
+	{"APIVersion", func(row k8splatforms.Row) (string, error) { return row.APIVersion, nil }},
+	{"Kind", func(row k8splatforms.Row) (string, error) { return row.Kind, nil }},
+	{"Name", func(row k8splatforms.Row) (string, error) { return row.Name, nil }},
+	{"SubName", func(row k8splatforms.Row) (string, error) { return row.SubName, nil }},
+	{"ScheduledPlatform", func(row k8splatforms.Row) (string, error) {
+		if row.ScheduledPlatform == nil {
+			return "", nil
+		}
+		return row.ScheduledPlatform.String(), nil
+	}},
+	{"DeclaredPlatforms", func(row k8splatforms.Row) (string, error) { return row.DeclaredPlatforms.String(), nil }},
+	{"ImagePlatforms", func(row k8splatforms.Row) (string, error) { return row.ImagePlatforms.String(), nil }},
+	{"ImagePlatformDetails", func(row k8splatforms.Row) (string, error) {
+		imagePlatformDetails := make(map[string]string)
+		for k, v := range row.ImagePlatformDetails {
+			imagePlatformDetails[k] = v.String()
+		}
+		return marshalColumn(imagePlatformDetails)
+	}},
+	{"HasViolation", func(row k8splatforms.Row) (string, error) { return fmt.Sprintf("%v", row.HasViolation), nil }},
+	{"CPUUsage", func(row k8splatforms.Row) (string, error) { return fmt.Sprintf("%v", row.CPUUsage), nil }},
+	{"MemoryUsage", func(row k8splatforms.Row) (string, error) { return fmt.Sprintf("%v", row.MemoryUsage), nil }},
+	{"Error", func(row k8splatforms.Row) (string, error) { return row.Error, nil }},
+	{"ImageDigests", func(row k8splatforms.Row) (string, error) { return marshalColumn(row.ImageDigests) }},
+	{"PlatformMismatches", func(row k8splatforms.Row) (string, error) {
+		platformMismatches := make(map[string][]string)
+		for k, v := range row.PlatformMismatches {
+			for _, mismatch := range v {
+				platformMismatches[k] = append(platformMismatches[k], mismatch.String())
+			}
+		}
+		return marshalColumn(platformMismatches)
+	}},
+	{"RunMode", func(row k8splatforms.Row) (string, error) { return row.RunMode.String(), nil }},
+	{"EmulatedPlatforms", func(row k8splatforms.Row) (string, error) { return row.EmulatedPlatforms.String(), nil }},
+}
+
+// marshalColumn writes the value of a CSV column as JSON.
+func marshalColumn(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", errors.Wrap(err, "marshaling column")
+	}
+	return string(data), nil
+}
+
+// statsPlatform returns the node platform the pods scheduled on a platform are counted under:
+// the platform without its variant when only that is among the node platforms,
+// such as linux/amd64 for nodes telling their x86-64 level with the default --node-platforms.
+func statsPlatform(platform dockerplatforms.DockerPlatform, nodePlatforms dockerplatforms.DockerPlatformList) dockerplatforms.DockerPlatform {
+	if !slices.Contains(nodePlatforms, platform) && slices.Contains(nodePlatforms, platform.Variantless()) {
+		return platform.Variantless()
+	}
+	return platform
+}
+
 type counts struct {
 	numPods    int
 	numNonPods int
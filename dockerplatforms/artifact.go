@@ -0,0 +1,106 @@
+package dockerplatforms
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/pkg/errors"
+)
+
+// ArtifactKind classifies manifests that are not container images.
+type ArtifactKind string
+
+const (
+	ArtifactHelmChart   ArtifactKind = "Helm chart"
+	ArtifactWASM        ArtifactKind = "WebAssembly module"
+	ArtifactSignature   ArtifactKind = "signature"
+	ArtifactAttestation ArtifactKind = "attestation"
+	ArtifactOther       ArtifactKind = "OCI artifact"
+)
+
+// ArtifactError tells that a manifest describes an artifact rather than a container image,
+// so that it has no platforms to run on.
+type ArtifactError struct {
+	Kind ArtifactKind
+	// MediaType is the artifact type, or the media type of the config when there is none.
+	MediaType string
+}
+
+func (e *ArtifactError) Error() string {
+	return fmt.Sprintf("not a container image but a %s (%s)", e.Kind, e.MediaType)
+}
+
+// IsArtifact tells if the error is due to the manifest not describing a container image.
+func IsArtifact(err error) bool {
+	var artifactErr *ArtifactError
+	return errors.As(err, &artifactErr)
+}
+
+// imageConfigMediaTypes are the config media types of container images.
+// Some early Docker registries stored configs as application/octet-stream.
+var imageConfigMediaTypes = []string{
+	"application/vnd.oci.image.config.v1+json",
+	manifest.DockerV2Schema2ConfigMediaType,
+	"application/octet-stream",
+	"",
+}
+
+// classifyArtifact returns an ArtifactError if the image manifest describes an artifact.
+// Manifests that cannot be parsed are left for manifest.FromBlob to report.
+func classifyArtifact(manifestText []byte, mediaType string) error {
+	if mediaType != "application/vnd.oci.image.manifest.v1+json" && mediaType != manifest.DockerV2Schema2MediaType {
+		return nil
+	}
+
+	var m struct {
+		ArtifactType string `json:"artifactType"`
+		Config       struct {
+			MediaType string `json:"mediaType"`
+		} `json:"config"`
+		Layers []struct {
+			MediaType string `json:"mediaType"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(manifestText, &m); err != nil {
+		return nil
+	}
+
+	artifactType := m.ArtifactType
+	if artifactType == "" {
+		isImageConfig := false
+		for _, t := range imageConfigMediaTypes {
+			isImageConfig = isImageConfig || m.Config.MediaType == t
+		}
+		if !isImageConfig {
+			artifactType = m.Config.MediaType
+		}
+	}
+	if artifactType == "" {
+		// cosign stores signatures as images whose layers are the signed payloads.
+		for _, layer := range m.Layers {
+			if strings.HasPrefix(layer.MediaType, "application/vnd.dev.cosign.") {
+				return &ArtifactError{Kind: ArtifactSignature, MediaType: layer.MediaType}
+			}
+		}
+		return nil
+	}
+	return newArtifactError(artifactType)
+}
+
+// newArtifactError classifies an artifact by its type.
+func newArtifactError(artifactType string) *ArtifactError {
+	kind := ArtifactOther
+	switch {
+	case strings.Contains(artifactType, "helm"):
+		kind = ArtifactHelmChart
+	case strings.Contains(artifactType, "wasm"):
+		kind = ArtifactWASM
+	case strings.Contains(artifactType, "cosign") || strings.Contains(artifactType, "notary") || strings.Contains(artifactType, "sigstore.bundle"):
+		kind = ArtifactSignature
+	case strings.Contains(artifactType, "in-toto") || strings.Contains(artifactType, "dsse"):
+		kind = ArtifactAttestation
+	}
+	return &ArtifactError{Kind: kind, MediaType: artifactType}
+}
@@ -0,0 +1,150 @@
+package dockerplatforms
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Annotations BuildKit puts on the attestation manifests of an index.
+// https://github.com/moby/buildkit/blob/master/docs/attestations/attestation-storage.md
+const (
+	annotationReferenceType   = "vnd.docker.reference.type"
+	annotationReferenceDigest = "vnd.docker.reference.digest"
+	referenceTypeAttestation  = "attestation-manifest"
+	annotationPredicateType   = "in-toto.io/predicate-type"
+)
+
+// AttestationKind classifies attestations by what they tell about an image.
+type AttestationKind string
+
+const (
+	AttestationProvenance AttestationKind = "provenance"
+	AttestationSBOM       AttestationKind = "sbom"
+	AttestationSignature  AttestationKind = "signature"
+	AttestationOther      AttestationKind = "other"
+)
+
+// Attestation is a supply chain document describing an image manifest.
+type Attestation struct {
+	// Digest is the digest of the manifest holding the attestation.
+	Digest digest.Digest
+	Kind   AttestationKind
+	// Type is the in-toto predicate type, or the artifact type of a referrer.
+	Type string
+}
+
+// PlatformManifest is the image manifest for a platform.
+type PlatformManifest struct {
+	Platform DockerPlatform
+	Digest   digest.Digest
+	// Attestations are only filled by InspectAttestations.
+	Attestations []Attestation
+}
+
+// HasAttestation tells if the manifest has an attestation of the kind.
+func (m PlatformManifest) HasAttestation(kind AttestationKind) bool {
+	return slices.ContainsFunc(m.Attestations, func(a Attestation) bool {
+		return a.Kind == kind
+	})
+}
+
+// InspectAttestations lists the image manifests of each platform along with the attestations describing them.
+// Attestations come from the BuildKit attestation manifests of the index and,
+// if the retriever implements ReferrersRetriever, from the OCI referrers API.
+// Unlike InspectManifest, it retrieves every attestation manifest, so that it costs more requests.
+func InspectAttestations(ctx context.Context, imageRef reference.Named, retriever ManifestRetriever) ([]PlatformManifest, error) {
+	analysis, err := analyzeManifest(ctx, imageRef, retriever, InspectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	referrersRetriever, _ := retriever.(ReferrersRetriever)
+
+	manifests := slices.Clone(analysis.manifests)
+	for i := range manifests {
+		m := &manifests[i]
+		for _, attestationDigest := range analysis.attestations[m.Digest] {
+			attestations, err := inspectAttestationManifest(ctx, imageRef, retriever, attestationDigest)
+			if err != nil {
+				return nil, errors.Wrapf(err, "inspecting attestation %s", attestationDigest)
+			}
+			m.Attestations = append(m.Attestations, attestations...)
+		}
+
+		if referrersRetriever == nil {
+			continue
+		}
+		manifestRef, err := withDigest(imageRef, m.Digest)
+		if err != nil {
+			return nil, err
+		}
+		referrers, err := referrersRetriever.GetReferrers(ctx, manifestRef.String())
+		if err != nil {
+			return nil, errors.Wrapf(err, "retrieving referrers of %s", m.Digest)
+		}
+		for _, referrer := range referrers {
+			attestationType := referrer.ArtifactType
+			if predicateType := referrer.Annotations[annotationPredicateType]; predicateType != "" {
+				attestationType = predicateType
+			}
+			m.Attestations = append(m.Attestations, Attestation{
+				Digest: referrer.Digest,
+				Kind:   classifyAttestation(attestationType),
+				Type:   attestationType,
+			})
+		}
+	}
+	return manifests, nil
+}
+
+// inspectAttestationManifest reads the in-toto statements a BuildKit attestation manifest holds.
+func inspectAttestationManifest(ctx context.Context, imageRef reference.Named, retriever ManifestRetriever, attestationDigest digest.Digest) ([]Attestation, error) {
+	attestationRef, err := withDigest(imageRef, attestationDigest)
+	if err != nil {
+		return nil, err
+	}
+	manifestText, _, err := retriever.GetManifest(ctx, attestationRef.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "retrieving manifest")
+	}
+	var m imgspecv1.Manifest
+	err = json.Unmarshal(manifestText, &m)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing manifest")
+	}
+
+	var attestations []Attestation
+	for _, layer := range m.Layers {
+		predicateType := layer.Annotations[annotationPredicateType]
+		if predicateType == "" {
+			continue
+		}
+		attestations = append(attestations, Attestation{
+			Digest: attestationDigest,
+			Kind:   classifyAttestation(predicateType),
+			Type:   predicateType,
+		})
+	}
+	return attestations, nil
+}
+
+// classifyAttestation tells the kind of an attestation from its predicate type or artifact type.
+func classifyAttestation(attestationType string) AttestationKind {
+	t := strings.ToLower(attestationType)
+	switch {
+	case strings.Contains(t, "provenance"):
+		return AttestationProvenance
+	case strings.Contains(t, "spdx") || strings.Contains(t, "cyclonedx") || strings.Contains(t, "syft"):
+		return AttestationSBOM
+	case strings.Contains(t, "cosign") || strings.Contains(t, "notary") || strings.Contains(t, "sigstore") || strings.Contains(t, "signature"):
+		return AttestationSignature
+	default:
+		return AttestationOther
+	}
+}
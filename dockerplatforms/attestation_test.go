@@ -0,0 +1,71 @@
+package dockerplatforms_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+)
+
+func TestInspectAttestations(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.addManifest("library/app", "latest", "application/vnd.oci.image.index.v1+json", mustReadFixture(t, "attested-index.json"))
+	registry.addManifest("library/app", "attestation", "application/vnd.oci.image.manifest.v1+json", mustReadFixture(t, "attested-index-attestation-6f50d1decb410d704a4b15b87f22e43cc70d338e1bb49ce9043409b43e08e00a.json"))
+	registry.referrers["library/app/sha256:3333333333333333333333333333333333333333333333333333333333333333"] = []byte(`{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.index.v1+json",
+  "manifests": [
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:4444444444444444444444444444444444444444444444444444444444444444",
+      "size": 712,
+      "artifactType": "application/vnd.cyclonedx+json"
+    }
+  ]
+}`)
+	imageRef, err := reference.ParseNormalizedNamed(registry.host + "/library/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifests, err := dockerplatforms.InspectAttestations(ctx, imageRef, registry.client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(manifests, []dockerplatforms.PlatformManifest{
+		{
+			Platform: dockerplatforms.LinuxAMD64,
+			Digest:   "sha256:3be07b667a868a246b9cee4ddc5ecce2ad1e211958bd6043a25fc1d19d55e6ba",
+			Attestations: []dockerplatforms.Attestation{
+				{
+					Digest: "sha256:6f50d1decb410d704a4b15b87f22e43cc70d338e1bb49ce9043409b43e08e00a",
+					Kind:   dockerplatforms.AttestationSBOM,
+					Type:   "https://spdx.dev/Document",
+				},
+				{
+					Digest: "sha256:6f50d1decb410d704a4b15b87f22e43cc70d338e1bb49ce9043409b43e08e00a",
+					Kind:   dockerplatforms.AttestationProvenance,
+					Type:   "https://slsa.dev/provenance/v0.2",
+				},
+			},
+		},
+		{
+			Platform: dockerplatforms.LinuxARM64V8,
+			Digest:   digest.Digest("sha256:3333333333333333333333333333333333333333333333333333333333333333"),
+			Attestations: []dockerplatforms.Attestation{
+				{
+					Digest: "sha256:4444444444444444444444444444444444444444444444444444444444444444",
+					Kind:   dockerplatforms.AttestationSBOM,
+					Type:   "application/vnd.cyclonedx+json",
+				},
+			},
+		},
+	}); diff != "" {
+		t.Errorf("InspectAttestations() (-want +got):\n%s", diff)
+	}
+}
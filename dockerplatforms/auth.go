@@ -0,0 +1,331 @@
+package dockerplatforms
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
+)
+
+// Credentials authenticate requests to a registry.
+type Credentials struct {
+	Username string
+	Password string
+	// IdentityToken is an OAuth2 refresh token exchanged for bearer tokens.
+	// When set, Username and Password are not sent to the token endpoint.
+	IdentityToken string
+}
+
+func (c Credentials) isZero() bool {
+	return c == (Credentials{})
+}
+
+// fingerprint identifies the credentials without revealing them,
+// so that tokens obtained with different credentials are never mixed up.
+func (c Credentials) fingerprint() string {
+	if c.isZero() {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(c.Username + "\x00" + c.Password + "\x00" + c.IdentityToken))
+	return hex.EncodeToString(sum[:8])
+}
+
+// CredentialStore looks up credentials for a registry.
+type CredentialStore interface {
+	// GetCredentials returns the credentials for the registry domain (e.g. docker.io, ghcr.io),
+	// or false if there are none.
+	GetCredentials(ctx context.Context, registry string) (Credentials, bool, error)
+}
+
+// CredentialStores is a CredentialStore that consults each store in order.
+type CredentialStores []CredentialStore
+
+var _ CredentialStore = CredentialStores{}
+
+// GetCredentials implements CredentialStore.
+func (s CredentialStores) GetCredentials(ctx context.Context, registry string) (Credentials, bool, error) {
+	for _, store := range s {
+		credentials, ok, err := store.GetCredentials(ctx, registry)
+		if err != nil || ok {
+			return credentials, ok, err
+		}
+	}
+	return Credentials{}, false, nil
+}
+
+type pullCredentialsKey struct{}
+
+type pullCredentials struct {
+	scope string
+	store CredentialStore
+}
+
+// WithPullCredentials returns a context whose lookups may additionally use the given credentials,
+// such as those from the imagePullSecrets of a Kubernetes workload.
+// The scope identifies who owns the credentials (e.g. the namespace and the secret names);
+// results that could only be obtained with them are cached per scope.
+func WithPullCredentials(ctx context.Context, scope string, store CredentialStore) context.Context {
+	return context.WithValue(ctx, pullCredentialsKey{}, pullCredentials{scope: scope, store: store})
+}
+
+func pullCredentialsFromContext(ctx context.Context) (pullCredentials, bool) {
+	creds, ok := ctx.Value(pullCredentialsKey{}).(pullCredentials)
+	return creds, ok && creds.store != nil
+}
+
+func withoutPullCredentials(ctx context.Context) context.Context {
+	return context.WithValue(ctx, pullCredentialsKey{}, pullCredentials{})
+}
+
+// UnauthorizedError is returned when a registry rejects a request for lack of valid credentials.
+type UnauthorizedError struct {
+	Registry   string
+	Repository string
+	// StatusCode is the HTTP status code returned by the registry or its token endpoint.
+	StatusCode int
+}
+
+func (e *UnauthorizedError) Error() string {
+	return fmt.Sprintf("unauthorized: access to %s/%s denied (%d)", e.Registry, e.Repository, e.StatusCode)
+}
+
+// IsUnauthorized reports whether err is caused by a registry denying access.
+// Errors read back from a cache tell it by their class.
+func IsUnauthorized(err error) bool {
+	var unauthorizedErr *UnauthorizedError
+	var cachedErr *cachedError
+	return errors.As(err, &unauthorizedErr) || errors.As(err, &cachedErr) && cachedErr.class == ErrorUnauthorized
+}
+
+// DockerConfig is a CredentialStore backed by the docker CLI configuration file.
+// It honours the `auths`, `credsStore` and `credHelpers` sections.
+type DockerConfig struct {
+	Auths       map[string]DockerAuthEntry `json:"auths,omitempty"`
+	CredsStore  string                     `json:"credsStore,omitempty"`
+	CredHelpers map[string]string          `json:"credHelpers,omitempty"`
+
+	mu      sync.Mutex
+	helpers map[string]helperResult
+	lookups singleflight.Group
+}
+
+var _ CredentialStore = &DockerConfig{}
+
+// DockerAuthEntry is an entry of the `auths` section of the docker configuration.
+type DockerAuthEntry struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+type helperResult struct {
+	credentials Credentials
+	ok          bool
+}
+
+// LoadDockerConfig reads the docker configuration file.
+// When path is empty, $DOCKER_CONFIG/config.json or ~/.docker/config.json is used.
+// A missing file results in an empty configuration.
+func LoadDockerConfig(path string) (*DockerConfig, error) {
+	if path == "" {
+		path = defaultDockerConfigPath()
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &DockerConfig{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading docker config")
+	}
+	return ParseDockerConfig(data)
+}
+
+// ParseDockerConfig parses the content of a docker configuration file.
+func ParseDockerConfig(data []byte) (*DockerConfig, error) {
+	config := &DockerConfig{}
+	err := json.Unmarshal(data, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing docker config")
+	}
+	return config, nil
+}
+
+func defaultDockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".docker", "config.json")
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// GetCredentials implements CredentialStore.
+func (c *DockerConfig) GetCredentials(ctx context.Context, registry string) (Credentials, bool, error) {
+	registry = normalizeRegistry(registry)
+
+	helper := c.CredsStore
+	if h, ok := c.CredHelpers[registry]; ok {
+		helper = h
+	} else {
+		for key, h := range c.CredHelpers {
+			if normalizeRegistry(key) == registry {
+				helper = h
+				break
+			}
+		}
+	}
+	if helper != "" {
+		credentials, ok, err := c.getHelperCredentials(ctx, helper, registry)
+		if err != nil || ok {
+			return credentials, ok, err
+		}
+	}
+
+	for key, entry := range c.Auths {
+		if normalizeRegistry(key) != registry {
+			continue
+		}
+		credentials, err := entry.credentials()
+		if err != nil {
+			return Credentials{}, false, errors.Wrapf(err, "decoding auth for %s", key)
+		}
+		if credentials.isZero() {
+			continue
+		}
+		return credentials, true, nil
+	}
+	return Credentials{}, false, nil
+}
+
+func (e DockerAuthEntry) credentials() (Credentials, error) {
+	credentials := Credentials{
+		Username:      e.Username,
+		Password:      e.Password,
+		IdentityToken: e.IdentityToken,
+	}
+	if e.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(e.Auth)
+		if err != nil {
+			return Credentials{}, err
+		}
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return Credentials{}, errors.New("auth is not in the form of username:password")
+		}
+		credentials.Username = username
+		credentials.Password = password
+	}
+	return credentials, nil
+}
+
+func (c *DockerConfig) getHelperCredentials(ctx context.Context, helper, registry string) (Credentials, bool, error) {
+	cacheKey := helper + "\x00" + registry
+	c.mu.Lock()
+	result, ok := c.helpers[cacheKey]
+	c.mu.Unlock()
+	if ok {
+		return result.credentials, result.ok, nil
+	}
+
+	// The helper runs without holding c.mu, so that a slow helper only holds up the lookups of its own registry.
+	// It runs without the cancellation of the caller starting it, as the others share its result;
+	// each caller stops waiting when its own ctx is done.
+	shared := context.WithoutCancel(ctx)
+	ch := c.lookups.DoChan(cacheKey, func() (interface{}, error) {
+		credentials, ok, err := runCredentialHelper(shared, helper, helperServerURL(registry))
+		if err != nil {
+			return nil, err
+		}
+		result := helperResult{credentials: credentials, ok: ok}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.helpers == nil {
+			c.helpers = make(map[string]helperResult)
+		}
+		c.helpers[cacheKey] = result
+		return result, nil
+	})
+	select {
+	case <-ctx.Done():
+		return Credentials{}, false, ctx.Err()
+	case value := <-ch:
+		if value.Err != nil {
+			return Credentials{}, false, value.Err
+		}
+		result = value.Val.(helperResult)
+		return result.credentials, result.ok, nil
+	}
+}
+
+// runCredentialHelper invokes `docker-credential-<helper> get` as specified in
+// https://github.com/docker/docker-credential-helpers
+func runCredentialHelper(ctx context.Context, helper, serverURL string) (Credentials, bool, error) {
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	if cmd.Err != nil {
+		return Credentials{}, false, errors.Wrapf(cmd.Err, "finding credential helper %s", helper)
+	}
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		message := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(message, "credentials not found") {
+			return Credentials{}, false, nil
+		}
+		return Credentials{}, false, errors.Wrapf(err, "running credential helper %s: %s", helper, message)
+	}
+
+	var response struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	err = json.Unmarshal(stdout.Bytes(), &response)
+	if err != nil {
+		return Credentials{}, false, errors.Wrapf(err, "parsing output of credential helper %s", helper)
+	}
+	if response.Username == "<token>" {
+		return Credentials{IdentityToken: response.Secret}, true, nil
+	}
+	return Credentials{Username: response.Username, Password: response.Secret}, true, nil
+}
+
+// normalizeRegistry converts the various spellings of a registry found in docker configs
+// (e.g. https://index.docker.io/v1/) into the domain of a normalized reference.
+func normalizeRegistry(registry string) string {
+	if strings.Contains(registry, "://") {
+		if u, err := url.Parse(registry); err == nil {
+			registry = u.Host
+		}
+	}
+	registry, _, _ = strings.Cut(registry, "/")
+	switch registry {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+	return registry
+}
+
+// helperServerURL returns the server URL under which the docker CLI stores credentials for the registry.
+func helperServerURL(registry string) string {
+	if registry == "docker.io" {
+		return "https://index.docker.io/v1/"
+	}
+	return registry
+}
@@ -0,0 +1,273 @@
+package dockerplatforms_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+)
+
+func TestDockerConfigAuths(t *testing.T) {
+	ctx := context.Background()
+	config, err := dockerplatforms.ParseDockerConfig([]byte(`{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "YWxpY2U6czNjcmV0"},
+			"ghcr.io": {"username": "bob", "password": "hunter2"},
+			"quay.io": {}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		registry    string
+		credentials dockerplatforms.Credentials
+		ok          bool
+	}{
+		{
+			registry:    "docker.io",
+			credentials: dockerplatforms.Credentials{Username: "alice", Password: "s3cret"},
+			ok:          true,
+		},
+		{
+			registry:    "ghcr.io",
+			credentials: dockerplatforms.Credentials{Username: "bob", Password: "hunter2"},
+			ok:          true,
+		},
+		{
+			registry: "quay.io",
+		},
+		{
+			registry: "registry.example.com",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.registry, func(t *testing.T) {
+			credentials, ok, err := config.GetCredentials(ctx, tc.registry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(ok, tc.ok); diff != "" {
+				t.Errorf("GetCredentials() ok (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(credentials, tc.credentials); diff != "" {
+				t.Errorf("GetCredentials() credentials (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDockerConfigCredHelpers(t *testing.T) {
+	ctx := context.Background()
+	installFakeCredentialHelper(t, "fake", "registry.example.com", `{"ServerURL":"registry.example.com","Username":"alice","Secret":"s3cret"}`)
+	config, err := dockerplatforms.ParseDockerConfig([]byte(`{
+		"auths": {"ghcr.io": {"username": "bob", "password": "hunter2"}},
+		"credHelpers": {"registry.example.com": "fake", "ghcr.io": "fake"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentials, ok, err := config.GetCredentials(ctx, "registry.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(ok, true); diff != "" {
+		t.Errorf("GetCredentials() ok (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(credentials, dockerplatforms.Credentials{Username: "alice", Password: "s3cret"}); diff != "" {
+		t.Errorf("GetCredentials() credentials (-want +got):\n%s", diff)
+	}
+
+	// The helper does not know ghcr.io, so the auths entry is used instead.
+	credentials, ok, err = config.GetCredentials(ctx, "ghcr.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(ok, true); diff != "" {
+		t.Errorf("GetCredentials() ok (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(credentials, dockerplatforms.Credentials{Username: "bob", Password: "hunter2"}); diff != "" {
+		t.Errorf("GetCredentials() credentials (-want +got):\n%s", diff)
+	}
+}
+
+func TestDockerConfigSlowCredentialHelper(t *testing.T) {
+	ctx := context.Background()
+	installFakeCredentialHelper(t, "fake", "registry.example.com", `{"ServerURL":"registry.example.com","Username":"alice","Secret":"s3cret"}`)
+	// The slow helper answers once released, or fails after about 5 seconds.
+	dir := t.TempDir()
+	started := filepath.Join(dir, "started")
+	release := filepath.Join(dir, "release")
+	script := `#!/bin/sh
+touch '` + started + `'
+i=0
+while [ ! -e '` + release + `' ]; do
+	i=$((i+1))
+	[ $i -le 100 ] || exit 1
+	sleep 0.05
+done
+echo '{"ServerURL":"slow.example.com","Username":"carol","Secret":"hunter2"}'
+`
+	err := os.WriteFile(filepath.Join(dir, "docker-credential-slow"), []byte(script), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	config, err := dockerplatforms.ParseDockerConfig([]byte(`{
+		"credHelpers": {"registry.example.com": "fake", "slow.example.com": "slow"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lookup starting the helper is cancelled while another one waits for it.
+	startCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	startErr := make(chan error)
+	go func() {
+		_, _, err := config.GetCredentials(startCtx, "slow.example.com")
+		startErr <- err
+	}()
+	for {
+		if _, err := os.Stat(started); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	slowErr := make(chan error)
+	go func() {
+		credentials, _, err := config.GetCredentials(ctx, "slow.example.com")
+		if err == nil && credentials.Username != "carol" {
+			err = errors.Errorf("unexpected credentials: %+v", credentials)
+		}
+		slowErr <- err
+	}()
+	cancel()
+	if err := <-startErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("GetCredentials() with a cancelled context: got %v, want %v", err, context.Canceled)
+	}
+
+	// While the slow helper runs, the other registries are looked up.
+	credentials, _, err := config.GetCredentials(ctx, "registry.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(credentials, dockerplatforms.Credentials{Username: "alice", Password: "s3cret"}); diff != "" {
+		t.Errorf("GetCredentials() credentials (-want +got):\n%s", diff)
+	}
+	err = os.WriteFile(release, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-slowErr; err != nil {
+		t.Errorf("slow helper blocked the other lookups until it gave up, or failed with the cancelled lookup: %v", err)
+	}
+}
+
+func TestDockerConfigCredsStoreIdentityToken(t *testing.T) {
+	ctx := context.Background()
+	installFakeCredentialHelper(t, "store", "https://index.docker.io/v1/", `{"ServerURL":"https://index.docker.io/v1/","Username":"<token>","Secret":"refresh-token"}`)
+	config, err := dockerplatforms.ParseDockerConfig([]byte(`{"credsStore": "store"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentials, ok, err := config.GetCredentials(ctx, "docker.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(ok, true); diff != "" {
+		t.Errorf("GetCredentials() ok (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(credentials, dockerplatforms.Credentials{IdentityToken: "refresh-token"}); diff != "" {
+		t.Errorf("GetCredentials() credentials (-want +got):\n%s", diff)
+	}
+}
+
+func TestLoadDockerConfigMissing(t *testing.T) {
+	config, err := dockerplatforms.LoadDockerConfig(filepath.Join(t.TempDir(), "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err := config.GetCredentials(context.Background(), "docker.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("unexpected credentials from an empty config")
+	}
+}
+
+func TestRegistryClientCredentialHelper(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.token = "secret-token"
+	registry.username = "alice"
+	registry.password = "s3cret"
+	registry.addManifest("private/app", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	installFakeCredentialHelper(t, "fake", registry.host, `{"ServerURL":"`+registry.host+`","Username":"alice","Secret":"s3cret"}`)
+	config, err := dockerplatforms.ParseDockerConfig([]byte(`{"credHelpers": {"` + registry.host + `": "fake"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := registry.client()
+	client.Credentials = config
+	_, _, err = client.GetManifest(ctx, registry.host+"/private/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistryClientUnauthorized(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.token = "secret-token"
+	registry.username = "alice"
+	registry.password = "s3cret"
+	registry.addManifest("private/app", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	config, err := dockerplatforms.ParseDockerConfig([]byte(`{"auths": {"` + registry.host + `": {"username": "alice", "password": "wrong"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := registry.client()
+	client.Credentials = config
+	_, _, err = client.GetManifest(ctx, registry.host+"/private/app:latest")
+	if !dockerplatforms.IsUnauthorized(err) {
+		t.Fatalf("expected an unauthorized error, got: %v", err)
+	}
+	if diff := cmp.Diff(err.Error(), "unauthorized: access to "+registry.host+"/private/app denied (401)"); diff != "" {
+		t.Errorf("error message (-want +got):\n%s", diff)
+	}
+}
+
+// installFakeCredentialHelper puts docker-credential-<name> on PATH.
+// It answers the given response for serverURL and reports missing credentials otherwise.
+func installFakeCredentialHelper(t *testing.T, name, serverURL, response string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	script := `#!/bin/sh
+[ "$1" = get ] || exit 1
+read -r url
+if [ "$url" = '` + serverURL + `' ]; then
+	echo '` + response + `'
+else
+	echo "credentials not found in native keychain"
+	exit 1
+fi
+`
+	err := os.WriteFile(filepath.Join(dir, "docker-credential-"+name), []byte(script), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
@@ -0,0 +1,508 @@
+package dockerplatforms
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// BinaryMismatch is an executable of an image whose machine type disagrees with the platform of the image.
+type BinaryMismatch struct {
+	// Digest is the digest of the image manifest.
+	Digest digest.Digest
+	// Declared is the platform of the image.
+	Declared DockerPlatform
+	// Path is where the executable lives in the image filesystem.
+	Path string
+	// Format is "ELF" or "PE".
+	Format string
+	// Actual is the platform the executable is built for, with only OS and Architecture set.
+	Actual DockerPlatform
+}
+
+func (m BinaryMismatch) String() string {
+	return fmt.Sprintf("%s: %s is a %s %s executable, but the image is for %s", m.Digest, m.Path, m.Actual, m.Format, m.Declared)
+}
+
+// defaultPath is the PATH docker uses when the image does not set one.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// maxSymlinks is how many symbolic links are followed when resolving a path, as in Linux.
+const maxSymlinks = 40
+
+// executableHeaderSize is how much of an executable is read to identify its machine type.
+const executableHeaderSize = 4096
+
+// VerifyBinaries pulls the layers of each platform of the image, looks for the executable
+// the container runs, named by the entrypoint of its config or else by its command,
+// and reports those built for another platform.
+// Executables that are not found, scripts and unknown machine types are left alone.
+//
+// The retriever must implement BlobRetriever. As every layer is read,
+// this costs far more than InspectManifest.
+func VerifyBinaries(ctx context.Context, imageRef reference.Named, retriever ManifestRetriever) ([]BinaryMismatch, error) {
+	blobs, ok := retriever.(BlobRetriever)
+	if !ok {
+		return nil, errors.New("the manifest retriever cannot read layers")
+	}
+	analysis, err := analyzeManifest(ctx, imageRef, retriever, InspectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatches []BinaryMismatch
+	for _, m := range analysis.manifests {
+		found, err := verifyManifestBinaries(ctx, imageRef, retriever, blobs, m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "verifying binaries of %s", m.Digest)
+		}
+		mismatches = append(mismatches, found...)
+	}
+	return mismatches, nil
+}
+
+func verifyManifestBinaries(ctx context.Context, imageRef reference.Named, retriever ManifestRetriever, blobs BlobRetriever, m PlatformManifest) ([]BinaryMismatch, error) {
+	manifestRef, err := withDigest(imageRef, m.Digest)
+	if err != nil {
+		return nil, err
+	}
+	manifestText, mediaType, err := retriever.GetManifest(ctx, manifestRef.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "retrieving manifest")
+	}
+	if mediaType == "" {
+		mediaType = manifest.GuessMIMEType(manifestText)
+	}
+	parsed, err := manifest.FromBlob(manifestText, manifest.NormalizedMIMEType(mediaType))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing manifest")
+	}
+
+	configRef, err := withDigest(imageRef, parsed.ConfigInfo().Digest)
+	if err != nil {
+		return nil, err
+	}
+	configText, _, err := retriever.GetManifest(ctx, configRef.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "retrieving config")
+	}
+	var config struct {
+		Config struct {
+			Entrypoint []string `json:"Entrypoint"`
+			Cmd        []string `json:"Cmd"`
+			Env        []string `json:"Env"`
+			WorkingDir string   `json:"WorkingDir"`
+		} `json:"config"`
+	}
+	err = json.Unmarshal(configText, &config)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing config")
+	}
+
+	// The command only names the executable when there is no entrypoint; otherwise it holds arguments.
+	var name string
+	if len(config.Config.Entrypoint) > 0 {
+		name = config.Config.Entrypoint[0]
+	} else if len(config.Config.Cmd) > 0 {
+		name = config.Config.Cmd[0]
+	} else {
+		return nil, nil
+	}
+
+	searchPath := defaultPath
+	for _, env := range config.Config.Env {
+		if value, ok := strings.CutPrefix(env, "PATH="); ok {
+			searchPath = value
+		}
+	}
+
+	fs := &layerFS{windows: m.Platform.OS == "windows"}
+	fs.want(fs.candidates(name, searchPath, config.Config.WorkingDir)...)
+	for _, layer := range parsed.LayerInfos() {
+		layerRef, err := withDigest(imageRef, layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		err = fs.add(ctx, blobs, layerRef.String())
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading layer %s", layer.Digest)
+		}
+	}
+
+	p, file, ok := fs.lookPath(name, searchPath, config.Config.WorkingDir)
+	if !ok {
+		return nil, nil
+	}
+	head, ok := fs.heads[file]
+	if !ok {
+		// The file was reached through a link added after its layer was read.
+		head, err = fs.readHead(ctx, blobs, file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %s", p)
+		}
+	}
+	format, actual, ok := identifyExecutable(head)
+	if !ok || (actual.OS == m.Platform.OS && actual.Architecture == m.Platform.Architecture) {
+		return nil, nil
+	}
+	return []BinaryMismatch{{
+		Digest:   m.Digest,
+		Declared: m.Platform,
+		Path:     p,
+		Format:   format,
+		Actual:   actual,
+	}}, nil
+}
+
+// layerFile is an entry of the filesystem assembled from the layers of an image.
+type layerFile struct {
+	typeflag byte
+	// layer is the reference to the layer holding the content of a regular file.
+	layer string
+	// name is the name of the content in the tar stream of the layer, which differs from the path for hard links.
+	name string
+	// linkname is the target of a symbolic link.
+	linkname string
+}
+
+// layerFS is the filesystem of an image, as far as the tar headers of its layers tell.
+// The beginning of the files at the wanted paths is kept while the layers are read.
+type layerFS struct {
+	windows bool
+	files   map[string]layerFile
+	// wanted are the paths whose content may be needed, including through the symbolic links found so far.
+	wanted map[string]bool
+	heads  map[layerFile][]byte
+}
+
+// want marks paths whose content may be needed.
+func (fs *layerFS) want(paths ...string) {
+	if fs.wanted == nil {
+		fs.wanted = make(map[string]bool)
+	}
+	for _, p := range paths {
+		fs.wanted[p] = true
+	}
+}
+
+// wantThrough marks the paths the wanted paths lead to through a symbolic link at name.
+func (fs *layerFS) wantThrough(name, linkname string) {
+	target := linkname
+	if !path.IsAbs(target) {
+		target = path.Join(path.Dir(name), target)
+	}
+	target = fs.clean(target)
+	var paths []string
+	for p := range fs.wanted {
+		if p == name {
+			paths = append(paths, target)
+		} else if rest, ok := strings.CutPrefix(p, name+"/"); ok {
+			paths = append(paths, path.Join(target, rest))
+		}
+	}
+	fs.want(paths...)
+}
+
+// add applies a layer on top of the filesystem, including whiteouts.
+func (fs *layerFS) add(ctx context.Context, blobs BlobRetriever, layerRef string) error {
+	if fs.files == nil {
+		fs.files = make(map[string]layerFile)
+	}
+	if fs.heads == nil {
+		fs.heads = make(map[layerFile][]byte)
+	}
+	// Whiteouts only hide entries of lower layers.
+	added := make(map[string]bool)
+	return fs.walk(ctx, blobs, layerRef, func(name string, header *tar.Header, r io.Reader) (bool, error) {
+		dir, base := path.Split(name)
+		dir = path.Clean(dir)
+		if base == ".wh..wh..opq" {
+			fs.remove(dir, added, false)
+			return false, nil
+		}
+		if hidden, ok := strings.CutPrefix(base, ".wh."); ok {
+			fs.remove(path.Join(dir, hidden), added, true)
+			return false, nil
+		}
+
+		file := layerFile{typeflag: header.Typeflag, layer: layerRef, name: name}
+		switch header.Typeflag {
+		case tar.TypeReg:
+			if fs.wanted[name] {
+				head, err := io.ReadAll(io.LimitReader(r, executableHeaderSize))
+				if err != nil {
+					return false, errors.Wrapf(err, "reading %s", name)
+				}
+				fs.heads[file] = head
+			}
+		case tar.TypeSymlink:
+			file.linkname = header.Linkname
+			fs.wantThrough(name, header.Linkname)
+		case tar.TypeLink:
+			targetName, ok := fs.entryPath(header.Linkname)
+			if !ok {
+				return false, nil
+			}
+			target, ok := fs.files[targetName]
+			if !ok {
+				return false, nil
+			}
+			file = target
+		}
+		fs.files[name] = file
+		added[name] = true
+		return false, nil
+	})
+}
+
+// remove deletes the entries of lower layers under dir, and dir itself if self is set.
+func (fs *layerFS) remove(dir string, added map[string]bool, self bool) {
+	for name := range fs.files {
+		if added[name] {
+			continue
+		}
+		if (self && name == dir) || strings.HasPrefix(name, strings.TrimSuffix(dir, "/")+"/") {
+			delete(fs.files, name)
+		}
+	}
+}
+
+// lookPath finds an executable as the container runtime would, returning its path and its file.
+func (fs *layerFS) lookPath(name, searchPath, workingDir string) (string, layerFile, bool) {
+	for _, p := range fs.candidates(name, searchPath, workingDir) {
+		if file, ok := fs.resolve(p); ok {
+			return p, file, true
+		}
+	}
+	return "", layerFile{}, false
+}
+
+// candidates are the paths lookPath tries, in order.
+func (fs *layerFS) candidates(name, searchPath, workingDir string) []string {
+	if fs.windows {
+		return []string{fs.clean(name)}
+	}
+	if strings.Contains(name, "/") {
+		if !path.IsAbs(name) {
+			name = path.Join("/", workingDir, name)
+		}
+		return []string{path.Clean(name)}
+	}
+	var paths []string
+	for _, dir := range strings.Split(searchPath, ":") {
+		if dir == "" {
+			dir = workingDir
+		}
+		paths = append(paths, path.Join("/", dir, name))
+	}
+	return paths
+}
+
+// resolve follows the symbolic links of each component of p to a regular file.
+func (fs *layerFS) resolve(p string) (layerFile, bool) {
+	components := strings.Split(strings.TrimPrefix(path.Clean(p), "/"), "/")
+	resolved := "/"
+	hops := 0
+	for i := 0; i < len(components); i++ {
+		next := path.Join(resolved, components[i])
+		file, ok := fs.files[next]
+		if ok && file.typeflag == tar.TypeSymlink {
+			hops++
+			if hops > maxSymlinks {
+				return layerFile{}, false
+			}
+			target := file.linkname
+			if !path.IsAbs(target) {
+				target = path.Join(resolved, target)
+			}
+			rest := components[i+1:]
+			components = append(strings.Split(strings.TrimPrefix(path.Clean(target), "/"), "/"), rest...)
+			resolved = "/"
+			i = -1
+			continue
+		}
+		// Parent directories may be implied rather than present in the layers.
+		resolved = next
+	}
+	file, ok := fs.files[resolved]
+	return file, ok && file.typeflag == tar.TypeReg
+}
+
+// readHead reads the beginning of a regular file from its layer.
+func (fs *layerFS) readHead(ctx context.Context, blobs BlobRetriever, file layerFile) ([]byte, error) {
+	var head []byte
+	err := fs.walk(ctx, blobs, file.layer, func(name string, header *tar.Header, r io.Reader) (bool, error) {
+		if name != file.name || header.Typeflag == tar.TypeLink {
+			return false, nil
+		}
+		var err error
+		head, err = io.ReadAll(io.LimitReader(r, executableHeaderSize))
+		return true, err
+	})
+	return head, err
+}
+
+// walk calls fn with the path of each entry of the layer until it returns true.
+// Layers read to their end are checked against their digest.
+func (fs *layerFS) walk(ctx context.Context, blobs BlobRetriever, layerRef string, fn func(name string, header *tar.Header, r io.Reader) (bool, error)) error {
+	blob, err := blobs.GetBlob(ctx, layerRef)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	r, err := decompress(blob)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			// The blob is verified against its digest once read to its end, past the end of the archive.
+			_, err := io.Copy(io.Discard, blob)
+			return errors.Wrap(err, "reading layer")
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading layer")
+		}
+		name, ok := fs.entryPath(header.Name)
+		if !ok {
+			continue
+		}
+		done, err := fn(name, header, tr)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// entryPath maps the name of a tar entry to its path in the image filesystem.
+func (fs *layerFS) entryPath(name string) (string, bool) {
+	name = fs.clean(name)
+	if !fs.windows {
+		return name, true
+	}
+	// Windows layers keep the filesystem under Files, next to the registry hives.
+	name, ok := strings.CutPrefix(name, "/files/")
+	return "/" + name, ok
+}
+
+// clean turns the name of a tar entry or a path of the image into an absolute slash-separated path.
+// Windows paths lose their drive letter and their case.
+func (fs *layerFS) clean(name string) string {
+	if fs.windows {
+		name = strings.ToLower(strings.ReplaceAll(name, `\`, "/"))
+		if len(name) >= 2 && name[1] == ':' {
+			name = name[2:]
+		}
+	}
+	return path.Join("/", name)
+}
+
+// ELF machine types, from the System V ABI.
+const (
+	elfMachine386       = 3
+	elfMachineMIPS      = 8
+	elfMachinePPC64     = 21
+	elfMachineS390      = 22
+	elfMachineARM       = 40
+	elfMachineX86_64    = 62
+	elfMachineAArch64   = 183
+	elfMachineRISCV     = 243
+	elfMachineLoongArch = 258
+)
+
+// PE machine types, from the PE format specification.
+const (
+	peMachine386   = 0x14c
+	peMachineARMNT = 0x1c4
+	peMachineAMD64 = 0x8664
+	peMachineARM64 = 0xaa64
+)
+
+// identifyExecutable tells the format of an executable and the platform it is built for from its header.
+func identifyExecutable(head []byte) (string, DockerPlatform, bool) {
+	if len(head) >= 20 && string(head[:4]) == "\x7fELF" {
+		is64 := head[4] == 2
+		var order binary.ByteOrder = binary.LittleEndian
+		if head[5] == 2 {
+			order = binary.BigEndian
+		}
+		littleEndian := order == binary.LittleEndian
+
+		var arch string
+		switch order.Uint16(head[18:]) {
+		case elfMachine386:
+			arch = "386"
+		case elfMachineX86_64:
+			arch = "amd64"
+		case elfMachineARM:
+			arch = "arm"
+		case elfMachineAArch64:
+			arch = "arm64"
+		case elfMachinePPC64:
+			arch = "ppc64"
+			if littleEndian {
+				arch = "ppc64le"
+			}
+		case elfMachineS390:
+			if is64 {
+				arch = "s390x"
+			}
+		case elfMachineRISCV:
+			if is64 {
+				arch = "riscv64"
+			}
+		case elfMachineMIPS:
+			arch = "mips"
+			if is64 {
+				arch = "mips64"
+			}
+			if littleEndian {
+				arch += "le"
+			}
+		case elfMachineLoongArch:
+			if is64 {
+				arch = "loong64"
+			}
+		}
+		if arch == "" {
+			return "", DockerPlatform{}, false
+		}
+		return "ELF", DockerPlatform{OS: "linux", Architecture: arch}, true
+	}
+
+	if len(head) >= 0x40 && string(head[:2]) == "MZ" {
+		offset := int(binary.LittleEndian.Uint32(head[0x3c:]))
+		if offset < 0 || offset+6 > len(head) || string(head[offset:offset+4]) != "PE\x00\x00" {
+			return "", DockerPlatform{}, false
+		}
+		var arch string
+		switch binary.LittleEndian.Uint16(head[offset+4:]) {
+		case peMachine386:
+			arch = "386"
+		case peMachineAMD64:
+			arch = "amd64"
+		case peMachineARMNT:
+			arch = "arm"
+		case peMachineARM64:
+			arch = "arm64"
+		default:
+			return "", DockerPlatform{}, false
+		}
+		return "PE", DockerPlatform{OS: "windows", Architecture: arch}, true
+	}
+	return "", DockerPlatform{}, false
+}
@@ -0,0 +1,261 @@
+package dockerplatforms_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+)
+
+func TestVerifyBinaries(t *testing.T) {
+	ctx := context.Background()
+	testcases := []struct {
+		name       string
+		declared   string
+		entrypoint []string
+		cmd        []string
+		expected   []string
+	}{
+		{
+			name:       "matching",
+			declared:   "amd64",
+			entrypoint: []string{"/bin/app"},
+			expected:   nil,
+		},
+		{
+			name:       "mismatching",
+			declared:   "arm64",
+			entrypoint: []string{"/bin/app"},
+			expected:   []string{"/bin/app is a linux/amd64 ELF executable, but the image is for linux/arm64"},
+		},
+		{
+			name:     "command without entrypoint",
+			declared: "arm64",
+			cmd:      []string{"app"},
+			expected: []string{"/usr/bin/app is a linux/amd64 ELF executable, but the image is for linux/arm64"},
+		},
+		{
+			name:       "command as arguments",
+			declared:   "amd64",
+			entrypoint: []string{"/bin/app"},
+			cmd:        []string{"tool"},
+			expected:   nil,
+		},
+		{
+			name:     "deleted command",
+			declared: "arm64",
+			cmd:      []string{"old"},
+			expected: nil,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			files := map[string][]byte{
+				"oci-layout": []byte(`{"imageLayoutVersion":"1.0.0"}`),
+			}
+			addBlob := func(content []byte, mediaType string) map[string]interface{} {
+				d := digest.FromBytes(content)
+				files["blobs/sha256/"+d.Encoded()] = content
+				return map[string]interface{}{"mediaType": mediaType, "digest": d, "size": len(content)}
+			}
+
+			// The binary is reached through a directory symlink, and the old command was deleted by the upper layer.
+			base := tarLayer(t, []tar.Header{
+				{Name: "usr/", Typeflag: tar.TypeDir},
+				{Name: "usr/bin/", Typeflag: tar.TypeDir},
+				{Name: "bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin"},
+				{Name: "usr/bin/app", Typeflag: tar.TypeReg},
+				{Name: "usr/bin/old", Typeflag: tar.TypeReg},
+				{Name: "usr/bin/tool", Typeflag: tar.TypeReg},
+			}, map[string][]byte{
+				"usr/bin/app":  elfHeader(62),
+				"usr/bin/old":  elfHeader(8),
+				"usr/bin/tool": elfHeader(8),
+			})
+			upper := tarLayer(t, []tar.Header{
+				{Name: "usr/bin/.wh.old", Typeflag: tar.TypeReg},
+			}, nil)
+			config := mustMarshal(t, map[string]interface{}{
+				"architecture": tc.declared,
+				"os":           "linux",
+				"config": map[string]interface{}{
+					"Entrypoint": tc.entrypoint,
+					"Cmd":        tc.cmd,
+					"Env":        []string{"PATH=/usr/bin:/bin"},
+				},
+				"rootfs": map[string]interface{}{"type": "layers", "diff_ids": []string{}},
+			})
+			manifest := mustMarshal(t, map[string]interface{}{
+				"schemaVersion": 2,
+				"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+				"config":        addBlob(config, "application/vnd.oci.image.config.v1+json"),
+				"layers": []interface{}{
+					addBlob(base, "application/vnd.oci.image.layer.v1.tar+gzip"),
+					addBlob(upper, "application/vnd.oci.image.layer.v1.tar+gzip"),
+				},
+			})
+			manifestDescriptor := addBlob(manifest, "application/vnd.oci.image.manifest.v1+json")
+			manifestDescriptor["platform"] = map[string]string{"os": "linux", "architecture": tc.declared}
+			files["index.json"] = mustMarshal(t, map[string]interface{}{
+				"schemaVersion": 2,
+				"mediaType":     "application/vnd.oci.image.index.v1+json",
+				"manifests":     []interface{}{manifestDescriptor},
+			})
+
+			layout := dockerplatforms.NewOCILayout(writeLayoutDir(t, files))
+			imageRef, err := layout.Resolve(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			retriever := &countingBlobRetriever{LayoutRetriever: layout}
+			mismatches, err := dockerplatforms.VerifyBinaries(ctx, imageRef, retriever)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Each layer is read once.
+			if diff := cmp.Diff(2, retriever.blobs); diff != "" {
+				t.Errorf("blob reads (-want +got):\n%s", diff)
+			}
+			var got []string
+			for _, m := range mismatches {
+				got = append(got, strings.TrimPrefix(m.String(), digest.FromBytes(manifest).String()+": "))
+			}
+			if diff := cmp.Diff(tc.expected, got); diff != "" {
+				t.Errorf("unexpected mismatches (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestVerifyBinariesWithoutBlobs(t *testing.T) {
+	ctx := context.Background()
+	imageRef, err := reference.ParseNormalizedNamed("golang:1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dockerplatforms.VerifyBinaries(ctx, imageRef, &dockerplatforms.ImageTools{})
+	if err == nil {
+		t.Error("expected an error for a retriever that cannot read layers")
+	}
+}
+
+func TestVerifyBinariesTamperedLayer(t *testing.T) {
+	ctx := context.Background()
+	files := map[string][]byte{
+		"oci-layout": []byte(`{"imageLayoutVersion":"1.0.0"}`),
+	}
+	addBlob := func(content []byte, mediaType string) map[string]interface{} {
+		d := digest.FromBytes(content)
+		files["blobs/sha256/"+d.Encoded()] = content
+		return map[string]interface{}{"mediaType": mediaType, "digest": d, "size": len(content)}
+	}
+
+	headers := []tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir},
+		{Name: "bin/app", Typeflag: tar.TypeReg},
+	}
+	layer := tarLayer(t, headers, map[string][]byte{"bin/app": elfHeader(62)})
+	config := mustMarshal(t, map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]interface{}{"Entrypoint": []string{"/bin/app"}},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{}},
+	})
+	layerDescriptor := addBlob(layer, "application/vnd.oci.image.layer.v1.tar+gzip")
+	manifest := mustMarshal(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        addBlob(config, "application/vnd.oci.image.config.v1+json"),
+		"layers":        []interface{}{layerDescriptor},
+	})
+	files["index.json"] = mustMarshal(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.index.v1+json",
+		"manifests":     []interface{}{addBlob(manifest, "application/vnd.oci.image.manifest.v1+json")},
+	})
+	// The layer is replaced by a well-formed archive of another content.
+	files["blobs/sha256/"+digest.FromBytes(layer).Encoded()] = tarLayer(t, headers, map[string][]byte{"bin/app": elfHeader(183)})
+
+	layout := dockerplatforms.NewOCILayout(writeLayoutDir(t, files))
+	imageRef, err := layout.Resolve(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dockerplatforms.VerifyBinaries(ctx, imageRef, layout)
+	if err == nil {
+		t.Fatal("Missing error")
+	}
+	if !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// countingBlobRetriever counts the blobs read from a layout.
+type countingBlobRetriever struct {
+	*dockerplatforms.LayoutRetriever
+	blobs int
+}
+
+func (r *countingBlobRetriever) GetBlob(ctx context.Context, image string) (io.ReadCloser, error) {
+	r.blobs++
+	return r.LayoutRetriever.GetBlob(ctx, image)
+}
+
+// elfHeader makes the beginning of a 64-bit little-endian ELF executable for the machine.
+func elfHeader(machine uint16) []byte {
+	header := make([]byte, 64)
+	copy(header, "\x7fELF")
+	header[4] = 2
+	header[5] = 1
+	header[6] = 1
+	binary.LittleEndian.PutUint16(header[16:], 2)
+	binary.LittleEndian.PutUint16(header[18:], machine)
+	return header
+}
+
+func tarLayer(t *testing.T, headers []tar.Header, contents map[string][]byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, header := range headers {
+		header.Mode = 0o755
+		header.Size = int64(len(contents[header.Name]))
+		err := tw.WriteHeader(&header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write(contents[header.Name])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, closer := range []interface{ Close() error }{tw, gz} {
+		err := closer.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,54 @@
+package dockerplatforms
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// verifyingReader checks the content it reads against a digest,
+// failing at the end of the content if they do not match.
+type verifyingReader struct {
+	io.ReadCloser
+	digest   digest.Digest
+	verifier digest.Verifier
+}
+
+func newVerifyingReader(r io.ReadCloser, d digest.Digest) io.ReadCloser {
+	return &verifyingReader{ReadCloser: r, digest: d, verifier: d.Verifier()}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.verifier.Write(p[:n])
+	if err == io.EOF && !r.verifier.Verified() {
+		return n, errors.Errorf("digest mismatch for blob %s", r.digest)
+	}
+	return n, err
+}
+
+// decompress returns the uncompressed content of a layer, recognizing gzip and zstd by their magic numbers.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "decompressing gzip layer")
+		}
+		return gz, nil
+	case len(magic) == 4 && magic[0] == 0x28 && magic[1] == 0xb5 && magic[2] == 0x2f && magic[3] == 0xfd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "decompressing zstd layer")
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
@@ -0,0 +1,419 @@
+package dockerplatforms
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/yaml.v3"
+)
+
+// boltBucket is the bucket holding the entries, keyed by image and valued by JSON imageData.
+var boltBucket = []byte("images")
+
+// BoltOpenTimeout is how long BoltCache waits for another process to finish writing to the database.
+const BoltOpenTimeout = time.Minute
+
+// NewBoltCache opens or creates a Cache stored in a bbolt database file, with DefaultExpiryPolicy.
+func NewBoltCache(ctx context.Context, path string) (*BoltCache, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o777)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating the cache directory")
+	}
+	c := &BoltCache{
+		ExpiryPolicy: DefaultExpiryPolicy(),
+		path:         path,
+	}
+	err = c.update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "initializing the cache database")
+	}
+	return c, nil
+}
+
+var _ ManagedCache = &BoltCache{}
+
+// BoltCache is a Cache backed by a bbolt database file. It is safe for concurrent use.
+//
+// Unlike YAMLCache, it reads only the entries it is asked for and writes changes as they come,
+// so it stays fast with large inventories and needs no write-back.
+// The database is only open during each transaction, so that several processes share the file:
+// lookups open it read-only and run concurrently, while changes take the file for the time of their transaction.
+// Changes made while another one is written are batched into a shared transaction.
+type BoltCache struct {
+	ExpiryPolicy
+
+	path string
+	// mu keeps the transactions of the process from waiting for the file locks of each other.
+	mu sync.RWMutex
+
+	batchMu sync.Mutex
+	// pending is the batch of changes waiting for the current transaction, if any.
+	pending *boltBatch
+}
+
+// boltBatch is a set of changes written in one transaction.
+type boltBatch struct {
+	fns  []func(tx *bolt.Tx) error
+	done chan struct{}
+	err  error
+}
+
+// Close implements io.Closer. The database is not held open between transactions, so there is nothing to release.
+func (c *BoltCache) Close() error {
+	return nil
+}
+
+// view runs fn in a read-only transaction.
+func (c *BoltCache) view(fn func(tx *bolt.Tx) error) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	db, err := bolt.Open(c.path, 0o666, &bolt.Options{Timeout: BoltOpenTimeout, ReadOnly: true})
+	if err != nil {
+		return errors.Wrap(err, "opening the cache database")
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// update runs fn in a read-write transaction.
+func (c *BoltCache) update(fn func(tx *bolt.Tx) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.updateLocked(fn)
+}
+
+// updateLocked runs fn in a read-write transaction. The caller must hold c.mu.
+func (c *BoltCache) updateLocked(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(c.path, 0o666, &bolt.Options{Timeout: BoltOpenTimeout})
+	if err != nil {
+		return errors.Wrap(err, "opening the cache database")
+	}
+	err = db.Update(fn)
+	closeErr := db.Close()
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(closeErr, "closing the cache database")
+}
+
+// batch runs fn in a read-write transaction shared with the changes made meanwhile.
+// The first change of a batch waits for the current transaction and writes the batch;
+// the others wait for it. A failing change fails the whole batch.
+func (c *BoltCache) batch(fn func(tx *bolt.Tx) error) error {
+	c.batchMu.Lock()
+	b := c.pending
+	first := b == nil
+	if first {
+		b = &boltBatch{done: make(chan struct{})}
+		c.pending = b
+	}
+	b.fns = append(b.fns, fn)
+	c.batchMu.Unlock()
+
+	if !first {
+		<-b.done
+		return b.err
+	}
+	// Changes made while waiting for the current transaction join the batch.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batchMu.Lock()
+	c.pending = nil
+	c.batchMu.Unlock()
+	b.err = c.updateLocked(func(tx *bolt.Tx) error {
+		for _, fn := range b.fns {
+			err := fn(tx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	close(b.done)
+	return b.err
+}
+
+// GetCachedPlatforms implements Cache.
+func (c *BoltCache) GetCachedPlatforms(ctx context.Context, image string) ([]DockerPlatform, bool, error) {
+	imageData, ok, err := c.get(image)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	if imageData.Error != "" {
+		return nil, false, imageData.err()
+	}
+	if imageData.Digest != "" {
+		// Tag index entries hold no platforms.
+		return nil, false, nil
+	}
+
+	return imageData.Platforms, true, nil
+}
+
+// SetCachedPlatforms implements Cache.
+func (c *BoltCache) SetCachedPlatforms(ctx context.Context, image string, platforms []DockerPlatform) error {
+	return c.put(image, imageData{
+		Platforms: platforms,
+		FetchedAt: fetchTime(),
+	})
+}
+
+// ClearCachedPlatforms implements Cache.
+func (c *BoltCache) ClearCachedPlatforms(ctx context.Context, image string) error {
+	err := c.batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(image))
+	})
+	return errors.Wrap(err, "deleting from the cache database")
+}
+
+// GetCachedDigest implements Cache.
+func (c *BoltCache) GetCachedDigest(ctx context.Context, image string) (digest.Digest, bool, error) {
+	imageData, ok, err := c.get(image)
+	if err != nil || !ok {
+		return "", false, err
+	}
+
+	if imageData.Error != "" {
+		return "", false, imageData.err()
+	}
+
+	return imageData.Digest, imageData.Digest != "", nil
+}
+
+// SetCachedDigest implements Cache.
+func (c *BoltCache) SetCachedDigest(ctx context.Context, image string, d digest.Digest) error {
+	return c.put(image, imageData{
+		Digest:    d,
+		FetchedAt: fetchTime(),
+	})
+}
+
+// SetErrorCache implements Cache. Failing to store the error only costs a lookup, so it is ignored.
+func (c *BoltCache) SetErrorCache(ctx context.Context, image string, err error) {
+	data, ok := c.errorData(err)
+	if !ok {
+		c.ClearCachedPlatforms(ctx, image)
+		return
+	}
+	c.put(image, data)
+}
+
+// get looks up the entry of the image, unless it has expired.
+func (c *BoltCache) get(image string) (imageData, bool, error) {
+	var data imageData
+	var ok bool
+	err := c.view(func(tx *bolt.Tx) error {
+		var err error
+		data, ok, err = getBoltEntry(tx, image)
+		return err
+	})
+	if err != nil {
+		return imageData{}, false, err
+	}
+	return data, ok && c.fresh(image, data), nil
+}
+
+func (c *BoltCache) put(image string, data imageData) error {
+	value, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "marshalling the cache entry")
+	}
+	err = c.batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(image), value)
+	})
+	return errors.Wrap(err, "writing to the cache database")
+}
+
+func getBoltEntry(tx *bolt.Tx, image string) (imageData, bool, error) {
+	value := tx.Bucket(boltBucket).Get([]byte(image))
+	if value == nil {
+		return imageData{}, false, nil
+	}
+	var data imageData
+	err := json.Unmarshal(value, &data)
+	if err != nil {
+		return imageData{}, false, errors.Wrapf(err, "parsing the cache entry of %s", image)
+	}
+	return data, true, nil
+}
+
+// forEachBoltEntry calls fn with every entry of the database, in the order of images.
+func forEachBoltEntry(tx *bolt.Tx, fn func(image string, data imageData) error) error {
+	return tx.Bucket(boltBucket).ForEach(func(k, v []byte) error {
+		var data imageData
+		err := json.Unmarshal(v, &data)
+		if err != nil {
+			return errors.Wrapf(err, "parsing the cache entry of %s", k)
+		}
+		return fn(string(k), data)
+	})
+}
+
+// Entries implements ManagedCache.
+func (c *BoltCache) Entries(ctx context.Context) ([]CacheEntry, error) {
+	var entries []CacheEntry
+	err := c.view(func(tx *bolt.Tx) error {
+		return forEachBoltEntry(tx, func(image string, data imageData) error {
+			entries = append(entries, c.entry(image, data))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Entry implements ManagedCache.
+func (c *BoltCache) Entry(ctx context.Context, image string) (CacheEntry, bool, error) {
+	var data imageData
+	var ok bool
+	err := c.view(func(tx *bolt.Tx) error {
+		var err error
+		data, ok, err = getBoltEntry(tx, image)
+		return err
+	})
+	if err != nil || !ok {
+		return CacheEntry{}, false, err
+	}
+	return c.entry(image, data), true, nil
+}
+
+// SetEntry implements ManagedCache.
+func (c *BoltCache) SetEntry(ctx context.Context, entry CacheEntry) error {
+	return c.put(entry.Image, entry.data())
+}
+
+// Invalidate implements ManagedCache.
+func (c *BoltCache) Invalidate(ctx context.Context, pattern string) (int, error) {
+	match := ImagePattern(pattern)
+	return c.removeFunc(func(image string, _ imageData) bool {
+		return match(image)
+	})
+}
+
+// Prune implements ManagedCache.
+func (c *BoltCache) Prune(ctx context.Context, before time.Time) (int, error) {
+	return c.removeFunc(func(_ string, data imageData) bool {
+		return data.FetchedAt.Before(before)
+	})
+}
+
+func (c *BoltCache) removeFunc(fn func(image string, data imageData) bool) (int, error) {
+	removed := 0
+	err := c.update(func(tx *bolt.Tx) error {
+		// Keys cannot be deleted while iterating over them.
+		var images []string
+		err := forEachBoltEntry(tx, func(image string, data imageData) error {
+			if fn(image, data) {
+				images = append(images, image)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, image := range images {
+			err = tx.Bucket(boltBucket).Delete([]byte(image))
+			if err != nil {
+				return errors.Wrap(err, "deleting from the cache database")
+			}
+		}
+		removed = len(images)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// Export implements ManagedCache.
+func (c *BoltCache) Export(ctx context.Context, w io.Writer) error {
+	data := make(map[string]imageData)
+	err := c.view(func(tx *bolt.Tx) error {
+		return forEachBoltEntry(tx, func(image string, entry imageData) error {
+			data[image] = entry
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	yamlText, err := yaml.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "marshalling the cache YAML")
+	}
+	_, err = w.Write(yamlText)
+	return err
+}
+
+// Import implements ManagedCache.
+// Entries without a fetch time are only taken when the cache has none for their image.
+func (c *BoltCache) Import(ctx context.Context, r io.Reader) (int, error) {
+	imported, err := readExport(r)
+	if err != nil {
+		return 0, err
+	}
+	return c.merge(imported)
+}
+
+// MigrateFromYAML copies the entries of a YAMLCache file into the database, keeping the newer one
+// when both have an entry for the same image, and returns how many were taken.
+// The YAML file is left as it is.
+func (c *BoltCache) MigrateFromYAML(ctx context.Context, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, errors.Wrap(err, "opening the YAML cache file")
+	}
+	defer f.Close()
+	data := make(map[string]imageData)
+	err = readImageData(f, data)
+	if err != nil {
+		return 0, err
+	}
+	return c.merge(data)
+}
+
+// merge stores the entries newer than those of the database, all in one transaction.
+func (c *BoltCache) merge(data map[string]imageData) (int, error) {
+	taken := 0
+	err := c.update(func(tx *bolt.Tx) error {
+		taken = 0
+		for image, entry := range data {
+			current, ok, err := getBoltEntry(tx, image)
+			if err != nil {
+				return err
+			}
+			if ok && !entry.FetchedAt.After(current.FetchedAt) {
+				continue
+			}
+			value, err := json.Marshal(entry)
+			if err != nil {
+				return errors.Wrap(err, "marshalling the cache entry")
+			}
+			err = tx.Bucket(boltBucket).Put([]byte(image), value)
+			if err != nil {
+				return errors.Wrap(err, "writing to the cache database")
+			}
+			taken++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return taken, nil
+}
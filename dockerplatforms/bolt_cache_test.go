@@ -0,0 +1,259 @@
+package dockerplatforms_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+)
+
+func TestBoltSetGet(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.db")
+	cache, err := dockerplatforms.NewBoltCache(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.SetCachedPlatforms(ctx, "docker.io/library/golang:latest", []dockerplatforms.DockerPlatform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.SetCachedDigest(ctx, "docker.io/library/node:latest", "sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The entries are in the file as soon as they are set.
+	cache, err = dockerplatforms.NewBoltCache(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	platforms, ok, err := cache.GetCachedPlatforms(ctx, "docker.io/library/golang:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(true, ok); diff != "" {
+		t.Errorf("GetCachedPlatforms() ok (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("linux/amd64, linux/arm64/v8", dockerplatforms.DockerPlatformList(platforms).String()); diff != "" {
+		t.Errorf("GetCachedPlatforms() platforms (-want +got):\n%s", diff)
+	}
+	d, ok, err := cache.GetCachedDigest(ctx, "docker.io/library/node:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(true, ok); diff != "" {
+		t.Errorf("GetCachedDigest() ok (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("sha256:0000000000000000000000000000000000000000000000000000000000000000", d.String()); diff != "" {
+		t.Errorf("GetCachedDigest() digest (-want +got):\n%s", diff)
+	}
+
+	err = cache.ClearCachedPlatforms(ctx, "docker.io/library/golang:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err = cache.GetCachedPlatforms(ctx, "docker.io/library/golang:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(false, ok); diff != "" {
+		t.Errorf("GetCachedPlatforms() ok after ClearCachedPlatforms (-want +got):\n%s", diff)
+	}
+}
+
+func TestBoltShared(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.db")
+	first, err := dockerplatforms.NewBoltCache(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	// Another run opening the same file while the first one is running neither waits nor fails,
+	// and each sees what the other writes.
+	done := make(chan error, 1)
+	var second *dockerplatforms.BoltCache
+	go func() {
+		var err error
+		second, err = dockerplatforms.NewBoltCache(ctx, path)
+		if err == nil {
+			err = second.SetCachedPlatforms(ctx, "docker.io/library/golang:latest", dockerplatforms.MustParseDockerPlatformList("linux/amd64"))
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the second cache waited for the first one")
+	}
+	defer second.Close()
+	err = first.SetCachedPlatforms(ctx, "docker.io/library/node:latest", dockerplatforms.MustParseDockerPlatformList("linux/arm64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		cache     *dockerplatforms.BoltCache
+		image     string
+		platforms string
+	}{
+		{cache: first, image: "docker.io/library/golang:latest", platforms: "linux/amd64"},
+		{cache: second, image: "docker.io/library/node:latest", platforms: "linux/arm64"},
+	} {
+		platforms, ok, err := tc.cache.GetCachedPlatforms(ctx, tc.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(true, ok); diff != "" {
+			t.Errorf("GetCachedPlatforms(%q) ok (-want +got):\n%s", tc.image, diff)
+		}
+		if diff := cmp.Diff(tc.platforms, dockerplatforms.DockerPlatformList(platforms).String()); diff != "" {
+			t.Errorf("GetCachedPlatforms(%q) platforms (-want +got):\n%s", tc.image, diff)
+		}
+	}
+}
+
+func TestBoltConcurrently(t *testing.T) {
+	ctx := context.Background()
+	cache, err := dockerplatforms.NewBoltCache(ctx, filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	// Concurrent changes share transactions, and are all stored.
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			image := fmt.Sprintf("docker.io/library/app%d:latest", i)
+			err := cache.SetCachedPlatforms(ctx, image, dockerplatforms.MustParseDockerPlatformList("linux/amd64"))
+			if err == nil {
+				_, _, err = cache.GetCachedPlatforms(ctx, image)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := cache.Entries(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(100, len(entries)); diff != "" {
+		t.Errorf("Entries() count (-want +got):\n%s", diff)
+	}
+}
+
+func TestBoltMigrateFromYAML(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "cache.yaml")
+	err := os.WriteFile(yamlPath, []byte(`docker.io/library/golang:latest:
+    platforms: linux/amd64
+    fetchedAt: 2024-02-01T00:00:00Z
+docker.io/library/node:latest:
+    platforms: linux/amd64
+    fetchedAt: 2023-12-01T00:00:00Z
+docker.io/library/golang@sha256:0000000000000000000000000000000000000000000000000000000000000000:
+    platforms: linux/arm64
+`), 0o666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	err = os.Chtimes(yamlPath, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := dockerplatforms.NewBoltCache(ctx, filepath.Join(dir, "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	_, err = cache.Import(ctx, strings.NewReader(`docker.io/library/node:latest:
+    platforms: linux/arm64
+    fetchedAt: 2024-01-01T00:00:00Z
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The database already has a newer entry for node.
+	taken, err := cache.MigrateFromYAML(ctx, yamlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(2, taken); diff != "" {
+		t.Errorf("MigrateFromYAML() (-want +got):\n%s", diff)
+	}
+
+	var exported strings.Builder
+	err = cache.Export(ctx, &exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(`docker.io/library/golang:latest:
+    platforms: linux/amd64
+    fetchedAt: 2024-02-01T00:00:00Z
+docker.io/library/golang@sha256:0000000000000000000000000000000000000000000000000000000000000000:
+    platforms: linux/arm64
+    fetchedAt: 2024-01-15T00:00:00Z
+docker.io/library/node:latest:
+    platforms: linux/arm64
+    fetchedAt: 2024-01-01T00:00:00Z
+`, exported.String()); diff != "" {
+		t.Errorf("exported entries (-want +got):\n%s", diff)
+	}
+
+	removed, err := cache.Prune(ctx, time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(1, removed); diff != "" {
+		t.Errorf("Prune() (-want +got):\n%s", diff)
+	}
+	entries, err := cache.Entries(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var images []string
+	for _, entry := range entries {
+		images = append(images, entry.Image)
+	}
+	if diff := cmp.Diff([]string{
+		"docker.io/library/golang:latest",
+		"docker.io/library/golang@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+	}, images); diff != "" {
+		t.Errorf("Entries() (-want +got):\n%s", diff)
+	}
+}
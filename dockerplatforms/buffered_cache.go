@@ -0,0 +1,330 @@
+package dockerplatforms
+
+import (
+	"context"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+var _ ManagedCache = &BufferedCache{}
+
+// BufferedCache is a ManagedCache holding in memory the entries read from a store,
+// along with the changes to write back to it. It is safe for concurrent use.
+//
+// It is the part YAMLCache shares with the caches storing their entries elsewhere:
+// they embed it, fill it with Load and implement their write-back with WriteChanges.
+// The zero value is an empty cache that never expires entries.
+type BufferedCache struct {
+	ExpiryPolicy
+
+	mu      sync.Mutex
+	oldData map[string]imageData
+	newData map[string]imageData
+	// deleted are the entries to remove from the store on write-back.
+	deleted map[string]bool
+}
+
+// Load replaces the entries read from the store. Changes not written back yet are kept.
+func (c *BufferedCache) Load(entries []CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data := make(map[string]imageData, len(entries))
+	for _, entry := range entries {
+		data[entry.Image] = entry.data()
+	}
+	c.load(data)
+}
+
+// load replaces the entries read from the store. The caller must hold c.mu.
+func (c *BufferedCache) load(data map[string]imageData) {
+	c.init()
+	c.oldData = data
+}
+
+// init allocates the maps of the zero value. The caller must hold c.mu.
+func (c *BufferedCache) init() {
+	if c.oldData == nil {
+		c.oldData = make(map[string]imageData)
+	}
+	if c.newData == nil {
+		c.newData = make(map[string]imageData)
+	}
+	if c.deleted == nil {
+		c.deleted = make(map[string]bool)
+	}
+}
+
+// WriteChanges calls write with the entries changed and the images removed since the last write-back,
+// unless nothing changed. When write succeeds, the entries it returns replace those read from the store,
+// as if loaded again. The other methods wait for write to return.
+func (c *BufferedCache) WriteChanges(ctx context.Context, write func(ctx context.Context, changed []CacheEntry, removed []string) ([]CacheEntry, error)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.newData) == 0 && len(c.deleted) == 0 {
+		return nil
+	}
+
+	changed := make([]CacheEntry, 0, len(c.newData))
+	for image, data := range c.newData {
+		changed = append(changed, c.entry(image, data))
+	}
+	removed := make([]string, 0, len(c.deleted))
+	for image := range c.deleted {
+		removed = append(removed, image)
+	}
+	stored, err := write(ctx, changed, removed)
+	if err != nil {
+		return err
+	}
+
+	data := make(map[string]imageData, len(stored))
+	for _, entry := range stored {
+		data[entry.Image] = entry.data()
+	}
+	c.oldData = data
+	c.newData = make(map[string]imageData)
+	c.deleted = make(map[string]bool)
+	return nil
+}
+
+// GetCachedPlatforms implements Cache.
+func (c *BufferedCache) GetCachedPlatforms(ctx context.Context, image string) ([]DockerPlatform, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	imageData, ok := c.get(image)
+	if !ok {
+		return nil, false, nil
+	}
+
+	if imageData.Error != "" {
+		return nil, false, imageData.err()
+	}
+	if imageData.Digest != "" {
+		// Tag index entries hold no platforms.
+		return nil, false, nil
+	}
+
+	return imageData.Platforms, true, nil
+}
+
+// SetCachedPlatforms implements Cache.
+func (c *BufferedCache) SetCachedPlatforms(ctx context.Context, image string, platforms []DockerPlatform) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.set(image, imageData{
+		Platforms: platforms,
+		FetchedAt: fetchTime(),
+	})
+	return nil
+}
+
+// ClearCachedPlatforms implements Cache.
+func (c *BufferedCache) ClearCachedPlatforms(ctx context.Context, image string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(image)
+	return nil
+}
+
+// GetCachedDigest implements Cache.
+func (c *BufferedCache) GetCachedDigest(ctx context.Context, image string) (digest.Digest, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	imageData, ok := c.get(image)
+	if !ok {
+		return "", false, nil
+	}
+
+	if imageData.Error != "" {
+		return "", false, imageData.err()
+	}
+
+	return imageData.Digest, imageData.Digest != "", nil
+}
+
+// SetCachedDigest implements Cache.
+func (c *BufferedCache) SetCachedDigest(ctx context.Context, image string, d digest.Digest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.set(image, imageData{
+		Digest:    d,
+		FetchedAt: fetchTime(),
+	})
+	return nil
+}
+
+// SetErrorCache implements Cache.
+func (c *BufferedCache) SetErrorCache(ctx context.Context, image string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, ok := c.errorData(err)
+	if !ok {
+		c.remove(image)
+		return
+	}
+	c.set(image, data)
+}
+
+// get looks up the entry of the image, unless it has expired. The caller must hold c.mu.
+func (c *BufferedCache) get(image string) (imageData, bool) {
+	imageData, ok := c.newData[image]
+	if !ok {
+		imageData, ok = c.oldData[image]
+	}
+	return imageData, ok && c.fresh(image, imageData)
+}
+
+// set stores an entry to write back. The caller must hold c.mu.
+func (c *BufferedCache) set(image string, data imageData) {
+	c.init()
+	c.newData[image] = data
+	delete(c.deleted, image)
+}
+
+// remove deletes the entry of the image, from the store as well on write-back. The caller must hold c.mu.
+func (c *BufferedCache) remove(image string) {
+	c.init()
+	delete(c.newData, image)
+	delete(c.oldData, image)
+	c.deleted[image] = true
+}
+
+// Entries implements ManagedCache.
+func (c *BufferedCache) Entries(ctx context.Context) ([]CacheEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var entries []CacheEntry
+	for image, data := range c.oldData {
+		if _, ok := c.newData[image]; !ok {
+			entries = append(entries, c.entry(image, data))
+		}
+	}
+	for image, data := range c.newData {
+		entries = append(entries, c.entry(image, data))
+	}
+	slices.SortFunc(entries, func(a, b CacheEntry) int {
+		return strings.Compare(a.Image, b.Image)
+	})
+	return entries, nil
+}
+
+// Entry implements ManagedCache.
+func (c *BufferedCache) Entry(ctx context.Context, image string) (CacheEntry, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, ok := c.newData[image]
+	if !ok {
+		data, ok = c.oldData[image]
+	}
+	if !ok {
+		return CacheEntry{}, false, nil
+	}
+	return c.entry(image, data), true, nil
+}
+
+// SetEntry implements ManagedCache. The entry is saved to the store on write-back.
+func (c *BufferedCache) SetEntry(ctx context.Context, entry CacheEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.set(entry.Image, entry.data())
+	return nil
+}
+
+// Invalidate implements ManagedCache. The entries are removed from the store on write-back.
+func (c *BufferedCache) Invalidate(ctx context.Context, pattern string) (int, error) {
+	match := ImagePattern(pattern)
+	return c.removeFunc(func(image string, _ imageData) bool {
+		return match(image)
+	}), nil
+}
+
+// Prune implements ManagedCache. The entries are removed from the store on write-back.
+func (c *BufferedCache) Prune(ctx context.Context, before time.Time) (int, error) {
+	return c.removeFunc(func(_ string, data imageData) bool {
+		return data.FetchedAt.Before(before)
+	}), nil
+}
+
+func (c *BufferedCache) removeFunc(fn func(image string, data imageData) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Each image is judged by its newest entry, the one lookups see.
+	effective := make(map[string]imageData, len(c.oldData)+len(c.newData))
+	maps.Copy(effective, c.oldData)
+	maps.Copy(effective, c.newData)
+	removed := 0
+	for image, entry := range effective {
+		if fn(image, entry) {
+			c.remove(image)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Export implements ManagedCache.
+func (c *BufferedCache) Export(ctx context.Context, w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data := make(map[string]imageData, len(c.oldData)+len(c.newData))
+	for image, entry := range c.oldData {
+		data[image] = entry
+	}
+	for image, entry := range c.newData {
+		data[image] = entry
+	}
+	yamlText, err := yaml.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "marshalling the cache YAML")
+	}
+	_, err = w.Write(yamlText)
+	return err
+}
+
+// Import implements ManagedCache.
+// Entries without a fetch time are only taken when the cache has none for their image.
+// They are saved to the store on write-back.
+func (c *BufferedCache) Import(ctx context.Context, r io.Reader) (int, error) {
+	imported, err := readExport(r)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	taken := 0
+	for image, entry := range imported {
+		current, ok := c.newData[image]
+		if !ok {
+			current, ok = c.oldData[image]
+		}
+		if ok && !entry.FetchedAt.After(current.FetchedAt) {
+			continue
+		}
+		c.set(image, entry)
+		taken++
+	}
+	return taken, nil
+}
@@ -1,27 +1,42 @@
 package dockerplatforms
 
 import (
+	"cmp"
 	"context"
 	"io"
+	"maps"
 	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 )
 
+// Cache stores what PlatformInspector looked up, for later runs.
+//
+// Implementations must be safe for concurrent use: a PlatformInspector shared between goroutines
+// calls its cache from all of them. Every Cache of this package is.
 type Cache interface {
 	// GetCachedPlatforms returns the precomputed list of platforms, if there is any.
 	GetCachedPlatforms(ctx context.Context, image string) ([]DockerPlatform, bool, error)
 	// SetCachedPlatforms stores the list of platforms for future use.
 	SetCachedPlatforms(ctx context.Context, image string, platforms []DockerPlatform) error
 	// SetErrorCache stores an error message for the image.
+	// How long it is kept may depend on its ErrorClass.
 	SetErrorCache(ctx context.Context, image string, err error)
 	// ClearCachedPlatforms removes the list of platforms from the cache.
 	ClearCachedPlatforms(ctx context.Context, image string) error
+	// GetCachedDigest returns the digest a tag was resolved to, if there is any.
+	GetCachedDigest(ctx context.Context, image string) (digest.Digest, bool, error)
+	// SetCachedDigest stores the digest a tag was resolved to.
+	SetCachedDigest(ctx context.Context, image string, d digest.Digest) error
 }
 
-// NewNopCache creates a Cache that does nothing.
+// NewNopCache creates a Cache that does nothing. It is safe for concurrent use, having no state.
 func NewNopCache() Cache {
 	return &nopCache{}
 }
@@ -43,141 +58,276 @@ func (c *nopCache) ClearCachedPlatforms(ctx context.Context, image string) error
 func (c *nopCache) SetErrorCache(ctx context.Context, image string, err error) {
 }
 
-// NewYAMLCache creates a Cache that reads and writes a YAML file.
-func NewYAMLCache(ctx context.Context, path string) (*YAMLCache, error) {
-	cache := YAMLCache{
-		path:    path,
-		oldData: make(map[string]imageData),
-		newData: make(map[string]imageData),
+func (c *nopCache) GetCachedDigest(ctx context.Context, image string) (digest.Digest, bool, error) {
+	return "", false, nil
+}
+
+func (c *nopCache) SetCachedDigest(ctx context.Context, image string, d digest.Digest) error {
+	return nil
+}
+
+// DefaultCachePath is where the commands keep their YAMLCache by default:
+// in the user cache directory ($XDG_CACHE_HOME or ~/.cache on Linux),
+// or in the current directory when there is none.
+func DefaultCachePath() string {
+	return defaultCacheFile("image-platforms.yaml")
+}
+
+// DefaultBoltCachePath is where the commands keep their BoltCache by default,
+// next to the YAMLCache of DefaultCachePath.
+func DefaultBoltCachePath() string {
+	return defaultCacheFile("image-platforms.db")
+}
+
+func defaultCacheFile(name string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return name
+	}
+	return filepath.Join(dir, "container-platform-tools", name)
+}
+
+// ExpiryPolicy tells how long cache entries are used.
+//
+// Each entry records when it was fetched. Entries of digest references never expire,
+// as what a digest points to cannot change, but entries of tag references do after TagTTL.
+// Errors are remembered with their ErrorClass, and retried after ErrorRetryAfter whatever the reference.
+type ExpiryPolicy struct {
+	// TagTTL is how long entries of tag references are used.
+	// When zero, they never expire.
+	TagTTL time.Duration
+	// ErrorRetryAfter is how long errors of each class are returned instead of looking the image up again.
+	// Errors of classes missing from it are not stored.
+	ErrorRetryAfter map[ErrorClass]time.Duration
+	// RetryErrors makes every stored error a miss, while keeping the other entries.
+	RetryErrors bool
+}
+
+// DefaultExpiryPolicy returns the policy of new caches:
+// tag entries never expire, and errors expire after DefaultErrorRetryAfter.
+func DefaultExpiryPolicy() ExpiryPolicy {
+	return ExpiryPolicy{
+		ErrorRetryAfter: maps.Clone(DefaultErrorRetryAfter),
+	}
+}
+
+// fresh tells if the entry of the image may still be used.
+func (p ExpiryPolicy) fresh(image string, data imageData) bool {
+	if data.Error != "" {
+		class := cmp.Or(data.ErrorClass, ErrorOther)
+		return !p.RetryErrors && time.Since(data.FetchedAt) <= p.ErrorRetryAfter[class]
 	}
+	return p.TagTTL <= 0 || isDigestKey(image) || time.Since(data.FetchedAt) <= p.TagTTL
+}
+
+// errorData makes the entry of an error, telling false if errors of its class are not stored.
+func (p ExpiryPolicy) errorData(err error) (imageData, bool) {
+	class := ClassifyError(err)
+	if p.ErrorRetryAfter[class] <= 0 {
+		return imageData{}, false
+	}
+	return imageData{
+		Error:      err.Error(),
+		ErrorClass: class,
+		FetchedAt:  fetchTime(),
+	}, true
+}
+
+// NewYAMLCache creates a Cache that reads and writes a YAML file, with DefaultExpiryPolicy.
+func NewYAMLCache(ctx context.Context, path string) (*YAMLCache, error) {
+	cache := &YAMLCache{path: path}
+	cache.ExpiryPolicy = DefaultExpiryPolicy()
 	err := cache.open(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return &cache, nil
+	return cache, nil
 }
 
-var _ Cache = &YAMLCache{}
+var _ ManagedCache = &YAMLCache{}
 
+// YAMLCache is a Cache backed by a YAML file. It is safe for concurrent use.
+// The whole file is read when the cache is created, and rewritten by WriteBack.
 type YAMLCache struct {
-	path    string
-	oldData map[string]imageData
-	newData map[string]imageData
+	BufferedCache
+
+	path string
 }
 
 func (c *YAMLCache) open(_ context.Context) error {
-	f, err := os.OpenFile(c.path, os.O_RDONLY|os.O_CREATE, 0o666)
+	err := os.MkdirAll(filepath.Dir(c.path), 0o777)
 	if err != nil {
-		return errors.Wrap(err, "opening cache file for reading")
+		return errors.Wrap(err, "creating the cache directory")
 	}
-	defer f.Close()
-
-	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+	unlock, err := c.lock(syscall.LOCK_SH)
 	if err != nil {
-		return errors.Wrap(err, "locking the cache file for reading")
+		return err
 	}
-	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	defer unlock()
 
-	yamlText, err := io.ReadAll(f)
+	f, err := os.OpenFile(c.path, os.O_RDONLY|os.O_CREATE, 0o666)
 	if err != nil {
-		return errors.Wrap(err, "reading the cache file")
+		return errors.Wrap(err, "opening cache file for reading")
 	}
-	err = yaml.Unmarshal(yamlText, &c.oldData)
+	defer f.Close()
+	data := make(map[string]imageData)
+	err = readImageData(f, data)
 	if err != nil {
-		return errors.Wrap(err, "parsing the cache YAML")
+		return err
 	}
-
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load(data)
 	return nil
 }
-func (c *YAMLCache) WriteBack(ctx context.Context) error {
-	if len(c.newData) == 0 {
-		return nil
-	}
 
-	f, err := os.OpenFile(c.path, os.O_RDWR|os.O_CREATE, 0o666)
+// lock takes a lock on the lock file next to the cache file and returns the function releasing it.
+// The cache file itself cannot be locked, as WriteBack replaces it.
+func (c *YAMLCache) lock(how int) (func(), error) {
+	f, err := os.OpenFile(c.path+".lock", os.O_RDWR|os.O_CREATE, 0o666)
 	if err != nil {
-		return errors.Wrap(err, "opening cache file for writing")
+		return nil, errors.Wrap(err, "opening the cache lock file")
 	}
-	defer f.Close()
-
-	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	err = syscall.Flock(int(f.Fd()), how)
 	if err != nil {
-		return errors.Wrap(err, "locking the cache file for writing")
+		f.Close()
+		return nil, errors.Wrap(err, "locking the cache file")
 	}
-	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
 
-	oldYAMLText, err := io.ReadAll(f)
+// readImageData parses the cache file into data.
+// Entries written before fetch times were recorded are dated by the last modification of the file,
+// which they cannot be newer than.
+func readImageData(f *os.File, data map[string]imageData) error {
+	yamlText, err := io.ReadAll(f)
 	if err != nil {
 		return errors.Wrap(err, "reading the cache file")
 	}
-	err = yaml.Unmarshal(oldYAMLText, &c.oldData)
+	err = yaml.Unmarshal(yamlText, &data)
 	if err != nil {
 		return errors.Wrap(err, "parsing the cache YAML")
 	}
 
-	for image, platforms := range c.newData {
-		c.oldData[image] = platforms
-	}
-	c.newData = make(map[string]imageData)
-
-	newYAMLText, err := yaml.Marshal(c.oldData)
-	if err != nil {
-		return errors.Wrap(err, "marshalling the cache YAML")
-	}
-	// Seek the file, write, and truncate to the new size
-	_, err = f.Seek(0, io.SeekStart)
+	info, err := f.Stat()
 	if err != nil {
-		return errors.Wrap(err, "seeking the cache file")
+		return errors.Wrap(err, "checking the cache file")
 	}
-	_, err = f.Write(newYAMLText)
-	if err != nil {
-		return errors.Wrap(err, "writing the cache file")
-	}
-	err = f.Truncate(int64(len(newYAMLText)))
-	if err != nil {
-		return errors.Wrap(err, "truncating the cache file")
+	for image, entry := range data {
+		if entry.FetchedAt.IsZero() {
+			entry.FetchedAt = info.ModTime().UTC().Truncate(time.Second)
+			data[image] = entry
+		}
 	}
-
 	return nil
 }
 
-func (c *YAMLCache) GetCachedPlatforms(ctx context.Context, image string) ([]DockerPlatform, bool, error) {
-	imageData, ok := c.newData[image]
-	if !ok {
-		imageData, ok = c.oldData[image]
-	}
-	if !ok {
-		return nil, false, nil
-	}
+// WriteBack merges the changes into the cache file, along with the changes other processes made since it was read.
+// The file is replaced atomically, so that it is never left half-written.
+func (c *YAMLCache) WriteBack(ctx context.Context) error {
+	return c.WriteChanges(ctx, func(ctx context.Context, changed []CacheEntry, removed []string) ([]CacheEntry, error) {
+		unlock, err := c.lock(syscall.LOCK_EX)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
 
-	if imageData.Error != "" {
-		return nil, false, errors.New(imageData.Error)
-	}
+		data := make(map[string]imageData)
+		f, err := os.Open(c.path)
+		if err == nil {
+			err = readImageData(f, data)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, errors.Wrap(err, "opening cache file for reading")
+		}
+
+		for _, image := range removed {
+			delete(data, image)
+		}
+		for _, entry := range changed {
+			data[entry.Image] = entry.data()
+		}
 
-	return imageData.Platforms, true, nil
+		newYAMLText, err := yaml.Marshal(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "marshalling the cache YAML")
+		}
+		err = writeFileAtomically(c.path, newYAMLText)
+		if err != nil {
+			return nil, err
+		}
+		stored := make([]CacheEntry, 0, len(data))
+		for image, entry := range data {
+			stored = append(stored, c.entry(image, entry))
+		}
+		return stored, nil
+	})
 }
 
-func (c *YAMLCache) SetCachedPlatforms(ctx context.Context, image string, platforms []DockerPlatform) error {
-	c.newData[image] = imageData{
-		Platforms: platforms,
+// writeFileAtomically writes a temporary file next to the path and renames it over the path.
+func writeFileAtomically(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return errors.Wrap(err, "creating a temporary cache file")
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "writing the cache file")
+	}
+	// CreateTemp makes the file private; keep the permissions of the file it replaces.
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	err = os.Chmod(tmp.Name(), mode)
+	if err != nil {
+		return errors.Wrap(err, "setting the cache file permissions")
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return errors.Wrap(err, "replacing the cache file")
 	}
 	return nil
 }
 
-// ClearCachedPlatforms implements Cache.
-func (c *YAMLCache) ClearCachedPlatforms(ctx context.Context, image string) error {
-	delete(c.newData, image)
-	return nil
+// fetchTime is the time recorded for entries stored now.
+func fetchTime() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
 }
 
-// SetErrorCache implements Cache.
-func (c *YAMLCache) SetErrorCache(ctx context.Context, image string, err error) {
-	c.newData[image] = imageData{
-		Error: err.Error(),
-	}
+// isDigestKey tells if a cache key is for a digest reference, whose entry never goes stale.
+// The scope after # may contain anything, so it is left out.
+func isDigestKey(image string) bool {
+	image, _, _ = strings.Cut(image, "#")
+	return strings.Contains(image, "@sha256:")
 }
 
 type imageData struct {
 	Platforms DockerPlatformList `json:"platforms" yaml:"platforms"`
-	Error     string             `json:"error,omitempty" yaml:"error,omitempty"`
+	// Digest is set on tag entries, which index the entry of the digest they resolved to.
+	Digest digest.Digest `json:"digest,omitempty" yaml:"digest,omitempty"`
+	Error  string        `json:"error,omitempty" yaml:"error,omitempty"`
+	// ErrorClass is empty for errors stored before classes were recorded, which count as ErrorOther.
+	ErrorClass ErrorClass `json:"errorClass,omitempty" yaml:"errorClass,omitempty"`
+	// FetchedAt is when the entry was stored.
+	FetchedAt time.Time `json:"fetchedAt,omitempty" yaml:"fetchedAt,omitempty"`
+}
+
+// err rebuilds the stored error, keeping its class so that ClassifyError and IsUnauthorized still tell it.
+func (d imageData) err() error {
+	return &cachedError{message: d.Error, class: cmp.Or(d.ErrorClass, ErrorOther)}
 }
@@ -0,0 +1,136 @@
+package dockerplatforms
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// CacheEntry is an entry of a YAMLCache, as shown by the cache management commands.
+type CacheEntry struct {
+	// Image is the cache key: a normalized image reference, followed by #scope for entries
+	// obtained with the pull credentials of a scope.
+	Image      string
+	Platforms  DockerPlatformList
+	Digest     digest.Digest
+	Error      string
+	ErrorClass ErrorClass
+	FetchedAt  time.Time
+	// Expired tells if the entry is too old to be used, according to the policy of the cache.
+	Expired bool
+}
+
+// ManagedCache is a Cache whose entries can be listed and edited, as the cache commands do.
+type ManagedCache interface {
+	Cache
+	// Entries lists the entries of the cache, sorted by image.
+	Entries(ctx context.Context) ([]CacheEntry, error)
+	// Entry looks up the entry of the image, expired or not.
+	Entry(ctx context.Context, image string) (CacheEntry, bool, error)
+	// SetEntry stores the entry as is, keeping its fetch time, as when copying it from another cache.
+	SetEntry(ctx context.Context, entry CacheEntry) error
+	// Invalidate removes the entries whose image matches the pattern, where * matches any text,
+	// and returns how many were removed.
+	Invalidate(ctx context.Context, pattern string) (int, error)
+	// Prune removes the entries fetched before the time and returns how many were removed.
+	Prune(ctx context.Context, before time.Time) (int, error)
+	// Export writes every entry of the cache as YAML, in the format of the YAMLCache file.
+	Export(ctx context.Context, w io.Writer) error
+	// Import merges entries exported from another cache, keeping the newer one
+	// when both caches have an entry for the same image, and returns how many were taken.
+	Import(ctx context.Context, r io.Reader) (int, error)
+}
+
+// Fresh tells if the entry may still be used.
+func (p ExpiryPolicy) Fresh(entry CacheEntry) bool {
+	return p.fresh(entry.Image, entry.data())
+}
+
+// entry makes the CacheEntry of stored data.
+func (p ExpiryPolicy) entry(image string, data imageData) CacheEntry {
+	return CacheEntry{
+		Image:      image,
+		Platforms:  data.Platforms,
+		Digest:     data.Digest,
+		Error:      data.Error,
+		ErrorClass: data.ErrorClass,
+		FetchedAt:  data.FetchedAt,
+		Expired:    !p.fresh(image, data),
+	}
+}
+
+// ImagePattern returns a function telling if an image matches a pattern where * matches any text,
+// as Invalidate takes.
+func ImagePattern(pattern string) func(image string) bool {
+	re := regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+	return re.MatchString
+}
+
+// readExport parses entries written by Export.
+func readExport(r io.Reader) (map[string]imageData, error) {
+	yamlText, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading the cache YAML")
+	}
+	var imported map[string]imageData
+	err = yaml.Unmarshal(yamlText, &imported)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing the cache YAML")
+	}
+	return imported, nil
+}
+
+func (e CacheEntry) data() imageData {
+	return imageData{
+		Platforms:  e.Platforms,
+		Digest:     e.Digest,
+		Error:      e.Error,
+		ErrorClass: e.ErrorClass,
+		FetchedAt:  e.FetchedAt,
+	}
+}
+
+// MarshalCacheEntries writes entries in the format of the YAMLCache file, for caches stored elsewhere.
+func MarshalCacheEntries(entries []CacheEntry) ([]byte, error) {
+	data := make(map[string]imageData, len(entries))
+	for _, entry := range entries {
+		data[entry.Image] = entry.data()
+	}
+	yamlText, err := yaml.Marshal(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshalling the cache YAML")
+	}
+	return yamlText, nil
+}
+
+// UnmarshalCacheEntries parses entries written by MarshalCacheEntries, sorted by image.
+// Expired is left false, as it depends on the policy of the cache reading them.
+func UnmarshalCacheEntries(yamlText []byte) ([]CacheEntry, error) {
+	var data map[string]imageData
+	err := yaml.Unmarshal(yamlText, &data)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing the cache YAML")
+	}
+	entries := make([]CacheEntry, 0, len(data))
+	for image, entry := range data {
+		entries = append(entries, CacheEntry{
+			Image:      image,
+			Platforms:  entry.Platforms,
+			Digest:     entry.Digest,
+			Error:      entry.Error,
+			ErrorClass: entry.ErrorClass,
+			FetchedAt:  entry.FetchedAt,
+		})
+	}
+	slices.SortFunc(entries, func(a, b CacheEntry) int {
+		return strings.Compare(a.Image, b.Image)
+	})
+	return entries, nil
+}
@@ -3,7 +3,11 @@ package dockerplatforms_test
 import (
 	"context"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/pkg/errors"
@@ -197,8 +201,9 @@ func TestYAMLSetWrite(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if diff := cmp.Diff(string(content), `docker.io/library/golang:latest:
+	if diff := cmp.Diff(maskFetchedAt(string(content)), `docker.io/library/golang:latest:
     platforms: linux/386, linux/amd64, linux/arm64, linux/arm/v7, linux/mips64le, linux/ppc64le, linux/s390x, windows/amd64
+    fetchedAt: <time>
 `); diff != "" {
 		t.Errorf("cache file (-want +got):\n%s", diff)
 	}
@@ -254,9 +259,11 @@ func TestYAMLSetErrorWrite(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if diff := cmp.Diff(string(content), `docker.io/library/golang:latest:
+	if diff := cmp.Diff(maskFetchedAt(string(content)), `docker.io/library/golang:latest:
     platforms: ""
     error: failed to retrieve
+    errorClass: other
+    fetchedAt: <time>
 `); diff != "" {
 		t.Errorf("cache file (-want +got):\n%s", diff)
 	}
@@ -282,6 +289,428 @@ func TestYAMLReadErrorGet(t *testing.T) {
 	}
 }
 
+func TestYAMLEmptyPlatformRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	// Earlier versions stored the platform of configs telling no OS or architecture as /.
+	content := `docker.io/library/broken:latest:
+    platforms: /
+    fetchedAt: 2024-01-01T00:00:00Z
+`
+	env, cache, err := setupYAML(ctx, "TestYAMLEmptyPlatformRoundTrip", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+
+	platforms, ok, err := cache.GetCachedPlatforms(ctx, "docker.io/library/broken:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(true, ok); diff != "" {
+		t.Errorf("GetCachedPlatforms() ok (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("/", dockerplatforms.DockerPlatformList(platforms).String()); diff != "" {
+		t.Errorf("GetCachedPlatforms() platforms (-want +got):\n%s", diff)
+	}
+
+	err = cache.SetCachedPlatforms(ctx, "docker.io/library/golang:latest", []dockerplatforms.DockerPlatform{dockerplatforms.LinuxAMD64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.WriteBack(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(env.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(content+`docker.io/library/golang:latest:
+    platforms: linux/amd64
+    fetchedAt: <time>
+`, maskFetchedAt(string(written))); diff != "" {
+		t.Errorf("cache file (-want +got):\n%s", diff)
+	}
+}
+
+func TestYAMLTagTTL(t *testing.T) {
+	ctx := context.Background()
+	fresh := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+	stale := time.Now().UTC().Add(-48 * time.Hour).Format(time.RFC3339)
+	env, cache, err := setupYAML(ctx, "TestYAMLTagTTL", `docker.io/library/golang:fresh:
+    platforms: linux/amd64
+    fetchedAt: `+fresh+`
+docker.io/library/golang:stale:
+    platforms: linux/amd64
+    fetchedAt: `+stale+`
+docker.io/library/golang@sha256:1111111111111111111111111111111111111111111111111111111111111111:
+    platforms: linux/amd64
+    fetchedAt: `+stale+`
+docker.io/library/golang@sha256:1111111111111111111111111111111111111111111111111111111111111111#team-a/pull:
+    platforms: linux/amd64
+    fetchedAt: `+stale+`
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+
+	// Tag entries never expire by default.
+	_, ok, err := cache.GetCachedPlatforms(ctx, "docker.io/library/golang:stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("stale entry expired with no TTL")
+	}
+
+	cache.TagTTL = 24 * time.Hour
+	testcases := []struct {
+		image    string
+		expected bool
+	}{
+		{image: "docker.io/library/golang:fresh", expected: true},
+		{image: "docker.io/library/golang:stale", expected: false},
+		{image: "docker.io/library/golang@sha256:1111111111111111111111111111111111111111111111111111111111111111", expected: true},
+		{image: "docker.io/library/golang@sha256:1111111111111111111111111111111111111111111111111111111111111111#team-a/pull", expected: true},
+	}
+	for _, tc := range testcases {
+		_, ok, err := cache.GetCachedPlatforms(ctx, tc.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tc.expected, ok); diff != "" {
+			t.Errorf("GetCachedPlatforms(%q) ok (-want +got):\n%s", tc.image, diff)
+		}
+	}
+}
+
+func TestYAMLMigrateFetchedAt(t *testing.T) {
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	path := tmpdir + "/cache.yaml"
+	err := os.WriteFile(path, []byte(`docker.io/library/golang:latest:
+    platforms: linux/amd64
+docker.io/library/golang@sha256:1111111111111111111111111111111111111111111111111111111111111111:
+    platforms: linux/amd64
+`), 0o666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Entries without a fetch time are as old as the file.
+	modTime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = os.Chtimes(path, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := dockerplatforms.NewYAMLCache(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.TagTTL = 24 * time.Hour
+	_, ok, err := cache.GetCachedPlatforms(ctx, "docker.io/library/golang:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("old tag entry did not expire")
+	}
+	_, ok, err = cache.GetCachedPlatforms(ctx, "docker.io/library/golang@sha256:1111111111111111111111111111111111111111111111111111111111111111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("old digest entry expired")
+	}
+
+	err = cache.SetCachedDigest(ctx, "docker.io/library/golang:1.22", "sha256:1111111111111111111111111111111111111111111111111111111111111111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.WriteBack(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(`docker.io/library/golang:1.22:
+    platforms: ""
+    digest: sha256:1111111111111111111111111111111111111111111111111111111111111111
+    fetchedAt: <time>
+docker.io/library/golang:latest:
+    platforms: linux/amd64
+    fetchedAt: 2021-01-01T00:00:00Z
+docker.io/library/golang@sha256:1111111111111111111111111111111111111111111111111111111111111111:
+    platforms: linux/amd64
+    fetchedAt: 2021-01-01T00:00:00Z
+`, maskFetchedAt(string(content))); diff != "" {
+		t.Errorf("cache file (-want +got):\n%s", diff)
+	}
+}
+
+func TestYAMLErrorRetryAfter(t *testing.T) {
+	ctx := context.Background()
+	recent := time.Now().UTC().Add(-5 * time.Minute).Format(time.RFC3339)
+	old := time.Now().UTC().Add(-2 * time.Hour).Format(time.RFC3339)
+	env, cache, err := setupYAML(ctx, "TestYAMLErrorRetryAfter", `docker.io/library/golang:missing:
+    platforms: ""
+    error: not found
+    errorClass: not-found
+    fetchedAt: `+old+`
+docker.io/library/golang:private:
+    platforms: ""
+    error: unauthorized
+    errorClass: unauthorized
+    fetchedAt: `+recent+`
+docker.io/library/golang:limited:
+    platforms: ""
+    error: too many requests
+    errorClass: rate-limited
+    fetchedAt: `+old+`
+docker.io/library/golang:latest:
+    platforms: linux/amd64
+    fetchedAt: `+recent+`
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+
+	testcases := []struct {
+		image       string
+		retryErrors bool
+		expectedErr string
+		expectedOK  bool
+	}{
+		{image: "docker.io/library/golang:missing"},
+		{image: "docker.io/library/golang:private", expectedErr: "unauthorized"},
+		{image: "docker.io/library/golang:limited"},
+		{image: "docker.io/library/golang:latest", expectedOK: true},
+		{image: "docker.io/library/golang:private", retryErrors: true},
+		{image: "docker.io/library/golang:latest", retryErrors: true, expectedOK: true},
+	}
+	for _, tc := range testcases {
+		cache.RetryErrors = tc.retryErrors
+		_, ok, err := cache.GetCachedPlatforms(ctx, tc.image)
+		var errText string
+		if err != nil {
+			errText = err.Error()
+		}
+		if diff := cmp.Diff(tc.expectedErr, errText); diff != "" {
+			t.Errorf("GetCachedPlatforms(%q) error with RetryErrors=%t (-want +got):\n%s", tc.image, tc.retryErrors, diff)
+		}
+		if diff := cmp.Diff(tc.expectedOK, ok); diff != "" {
+			t.Errorf("GetCachedPlatforms(%q) ok with RetryErrors=%t (-want +got):\n%s", tc.image, tc.retryErrors, diff)
+		}
+		if diff := cmp.Diff(tc.expectedErr == "unauthorized", dockerplatforms.IsUnauthorized(err)); diff != "" {
+			t.Errorf("IsUnauthorized(GetCachedPlatforms(%q)) with RetryErrors=%t (-want +got):\n%s", tc.image, tc.retryErrors, diff)
+		}
+	}
+}
+
+func TestYAMLInvalidatePrune(t *testing.T) {
+	ctx := context.Background()
+	recent := time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+	env, cache, err := setupYAML(ctx, "TestYAMLInvalidatePrune", `docker.io/library/golang:1.22:
+    platforms: linux/amd64
+    fetchedAt: `+recent+`
+docker.io/library/golang:latest:
+    platforms: linux/amd64
+    fetchedAt: `+recent+`
+docker.io/library/node:latest:
+    platforms: linux/amd64
+    fetchedAt: 2021-01-01T00:00:00Z
+docker.io/library/ruby:latest:
+    platforms: linux/amd64
+    fetchedAt: `+recent+`
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+
+	removed, err := cache.Invalidate(ctx, "docker.io/library/golang:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(2, removed); diff != "" {
+		t.Errorf("Invalidate() (-want +got):\n%s", diff)
+	}
+	removed, err = cache.Prune(ctx, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(1, removed); diff != "" {
+		t.Errorf("Prune() (-want +got):\n%s", diff)
+	}
+	err = cache.WriteBack(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(env.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(`docker.io/library/ruby:latest:
+    platforms: linux/amd64
+    fetchedAt: `+recent+`
+`, string(content)); diff != "" {
+		t.Errorf("cache file (-want +got):\n%s", diff)
+	}
+}
+
+func TestYAMLPruneChanged(t *testing.T) {
+	ctx := context.Background()
+	env, cache, err := setupYAML(ctx, "TestYAMLPruneChanged", `docker.io/library/node:latest:
+    platforms: linux/amd64
+    fetchedAt: 2021-01-01T00:00:00Z
+docker.io/library/ruby:latest:
+    platforms: linux/amd64
+    fetchedAt: 2021-01-01T00:00:00Z
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+
+	// Images are judged by their newest entry, and errors that are not stored clear the stale one.
+	err = cache.SetCachedPlatforms(ctx, "docker.io/library/node:latest", dockerplatforms.MustParseDockerPlatformList("linux/arm64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := cache.Prune(ctx, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(1, removed); diff != "" {
+		t.Errorf("Prune() (-want +got):\n%s", diff)
+	}
+	cache.SetErrorCache(ctx, "docker.io/library/node:latest", transientTestError{})
+	entries, err := cache.Entries(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(0, len(entries)); diff != "" {
+		t.Errorf("Entries() count (-want +got):\n%s", diff)
+	}
+}
+
+func TestYAMLExportImport(t *testing.T) {
+	ctx := context.Background()
+	env, cache, err := setupYAML(ctx, "TestYAMLExportImport", `docker.io/library/golang:latest:
+    platforms: linux/amd64
+    fetchedAt: 2024-01-01T00:00:00Z
+docker.io/library/node:latest:
+    platforms: linux/amd64
+    fetchedAt: 2024-01-01T00:00:00Z
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+
+	// The other machine saw golang more recently, node less recently, and ruby only there.
+	taken, err := cache.Import(ctx, strings.NewReader(`docker.io/library/golang:latest:
+    platforms: linux/amd64, linux/arm64
+    fetchedAt: 2024-02-01T00:00:00Z
+docker.io/library/node:latest:
+    platforms: linux/arm64
+    fetchedAt: 2023-12-01T00:00:00Z
+docker.io/library/ruby:latest:
+    platforms: linux/arm64
+    fetchedAt: 2024-01-01T00:00:00Z
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(2, taken); diff != "" {
+		t.Errorf("Import() (-want +got):\n%s", diff)
+	}
+
+	var exported strings.Builder
+	err = cache.Export(ctx, &exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(`docker.io/library/golang:latest:
+    platforms: linux/amd64, linux/arm64
+    fetchedAt: 2024-02-01T00:00:00Z
+docker.io/library/node:latest:
+    platforms: linux/amd64
+    fetchedAt: 2024-01-01T00:00:00Z
+docker.io/library/ruby:latest:
+    platforms: linux/arm64
+    fetchedAt: 2024-01-01T00:00:00Z
+`, exported.String()); diff != "" {
+		t.Errorf("Export() (-want +got):\n%s", diff)
+	}
+}
+
+func TestYAMLWriteBackMerge(t *testing.T) {
+	ctx := context.Background()
+	// The cache directory is created as needed.
+	path := t.TempDir() + "/cache/image-platforms.yaml"
+	cache1, err := dockerplatforms.NewYAMLCache(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache2, err := dockerplatforms.NewYAMLCache(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cache1.SetCachedPlatforms(ctx, "docker.io/library/golang:latest", []dockerplatforms.DockerPlatform{dockerplatforms.LinuxAMD64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache2.SetCachedPlatforms(ctx, "docker.io/library/node:latest", []dockerplatforms.DockerPlatform{dockerplatforms.LinuxARM64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cache := range []*dockerplatforms.YAMLCache{cache1, cache2} {
+		err = cache.WriteBack(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(`docker.io/library/golang:latest:
+    platforms: linux/amd64
+    fetchedAt: <time>
+docker.io/library/node:latest:
+    platforms: linux/arm64
+    fetchedAt: <time>
+`, maskFetchedAt(string(content))); diff != "" {
+		t.Errorf("cache file (-want +got):\n%s", diff)
+	}
+	matches, err := filepath.Glob(path + ".tmp*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) > 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
+
+// maskFetchedAt hides the fetch times of the current run, which tests cannot predict.
+func maskFetchedAt(content string) string {
+	return regexp.MustCompile(`fetchedAt: \S+`).ReplaceAllStringFunc(content, func(line string) string {
+		fetchedAt, err := time.Parse(time.RFC3339, line[len("fetchedAt: "):])
+		if err != nil || time.Since(fetchedAt) > time.Hour {
+			return line
+		}
+		return "fetchedAt: <time>"
+	})
+}
+
 type yamlEnv struct {
 	tmpdir string
 	path   string
@@ -320,3 +749,45 @@ func setupYAMLImpl(ctx context.Context, name string, hasContent bool, content st
 	}
 	return &yamlEnv{tmpdir, path}, initCache, nil
 }
+
+type transientTestError struct{}
+
+func (transientTestError) Error() string   { return "connection reset" }
+func (transientTestError) Transient() bool { return true }
+
+func TestMemorySetError(t *testing.T) {
+	ctx := context.Background()
+	cache := dockerplatforms.NewMemoryCache()
+
+	// Errors keep their class, while network errors are not stored.
+	cache.SetErrorCache(ctx, "docker.io/library/golang:private", &dockerplatforms.UnauthorizedError{Registry: "docker.io", Repository: "library/golang", StatusCode: 401})
+	cache.SetErrorCache(ctx, "docker.io/library/golang:latest", transientTestError{})
+	_, _, err := cache.GetCachedPlatforms(ctx, "docker.io/library/golang:private")
+	if diff := cmp.Diff(dockerplatforms.ErrorUnauthorized, dockerplatforms.ClassifyError(err)); diff != "" {
+		t.Errorf("ClassifyError(GetCachedPlatforms()) (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(true, dockerplatforms.IsUnauthorized(err)); diff != "" {
+		t.Errorf("IsUnauthorized(GetCachedPlatforms()) (-want +got):\n%s", diff)
+	}
+	_, ok, err := cache.GetCachedPlatforms(ctx, "docker.io/library/golang:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(false, ok); diff != "" {
+		t.Errorf("GetCachedPlatforms() ok (-want +got):\n%s", diff)
+	}
+
+	// The policy makes stored errors misses, and errors expire after their retry-after.
+	cache.RetryErrors = true
+	_, _, err = cache.GetCachedPlatforms(ctx, "docker.io/library/golang:private")
+	if err != nil {
+		t.Errorf("GetCachedPlatforms() with RetryErrors: %v", err)
+	}
+	cache.RetryErrors = false
+	cache.ErrorRetryAfter[dockerplatforms.ErrorUnauthorized] = time.Nanosecond
+	cache.SetErrorCache(ctx, "docker.io/library/golang:private", &dockerplatforms.UnauthorizedError{Registry: "docker.io", Repository: "library/golang", StatusCode: 401})
+	_, _, err = cache.GetCachedPlatforms(ctx, "docker.io/library/golang:private")
+	if err != nil {
+		t.Errorf("GetCachedPlatforms() after the retry-after: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package dockerplatforms_test
+
+// These tests are meant to be run with the race detector: go test -race ./...
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+	dockerplatformstesting "github.com/wantedly/container-platform-tools/dockerplatforms/testing"
+	"go.uber.org/mock/gomock"
+)
+
+// concurrentCaches creates a cache of each implementation, with the function to call once it is no longer used.
+var concurrentCaches = []struct {
+	name     string
+	newCache func(t *testing.T) (dockerplatforms.Cache, func() error)
+}{
+	{
+		name: "nop",
+		newCache: func(t *testing.T) (dockerplatforms.Cache, func() error) {
+			return dockerplatforms.NewNopCache(), func() error { return nil }
+		},
+	},
+	{
+		name: "memory",
+		newCache: func(t *testing.T) (dockerplatforms.Cache, func() error) {
+			return dockerplatforms.NewMemoryCache(), func() error { return nil }
+		},
+	},
+	{
+		name: "yaml",
+		newCache: func(t *testing.T) (dockerplatforms.Cache, func() error) {
+			cache, err := dockerplatforms.NewYAMLCache(context.Background(), filepath.Join(t.TempDir(), "cache.yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return cache, func() error { return cache.WriteBack(context.Background()) }
+		},
+	},
+	{
+		name: "bolt",
+		newCache: func(t *testing.T) (dockerplatforms.Cache, func() error) {
+			cache, err := dockerplatforms.NewBoltCache(context.Background(), filepath.Join(t.TempDir(), "cache.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return cache, cache.Close
+		},
+	},
+	{
+		name: "layered",
+		newCache: func(t *testing.T) (dockerplatforms.Cache, func() error) {
+			cache, err := dockerplatforms.NewYAMLCache(context.Background(), filepath.Join(t.TempDir(), "cache.yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			layered := dockerplatforms.NewLayeredCache(
+				dockerplatforms.CacheLayer{Name: "memory", Cache: dockerplatforms.NewMemoryCache()},
+				dockerplatforms.CacheLayer{Name: "yaml", Cache: cache, WriteBack: true},
+			)
+			return layered, func() error {
+				err := layered.Flush(context.Background())
+				if err != nil {
+					return err
+				}
+				return cache.WriteBack(context.Background())
+			}
+		},
+	},
+}
+
+func TestGetPlatformsConcurrently(t *testing.T) {
+	ctx := context.Background()
+	var images []string
+	for _, repository := range []string{"golang", "node", "ruby", "python"} {
+		for _, tag := range []string{"latest", "1", "2"} {
+			images = append(images, fmt.Sprintf("docker.io/library/%s:%s", repository, tag))
+		}
+	}
+
+	for _, tc := range concurrentCaches {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			retriever := dockerplatformstesting.NewMockManifestRetriever(ctrl)
+			manifest := mustReadFixture(t, "golang-latest.json")
+			for _, image := range images {
+				retriever.EXPECT().GetManifest(gomock.Any(), image).Return(manifest, "", nil).MinTimes(1)
+			}
+			retriever.EXPECT().GetManifest(gomock.Any(), "docker.io/library/missing:latest").Return(nil, "", errors.New("manifest unknown")).MinTimes(1)
+			cache, closeCache := tc.newCache(t)
+			inspector := dockerplatforms.New(retriever, cache)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 64; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := range images {
+						image := images[(i+j)%len(images)]
+						platforms, err := inspector.GetPlatforms(ctx, image)
+						if err != nil {
+							t.Errorf("GetPlatforms(%q): %v", image, err)
+							return
+						}
+						if diff := cmp.Diff(9, len(platforms)); diff != "" {
+							t.Errorf("GetPlatforms(%q) count (-want +got):\n%s", image, diff)
+						}
+					}
+					_, err := inspector.GetPlatforms(ctx, "docker.io/library/missing:latest")
+					if err == nil {
+						t.Error("expected an error for a missing image")
+					}
+				}()
+			}
+			wg.Wait()
+
+			err := closeCache()
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCachesConcurrently(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range concurrentCaches {
+		t.Run(tc.name, func(t *testing.T) {
+			cache, closeCache := tc.newCache(t)
+			writeBack, canWriteBack := cache.(interface{ WriteBack(context.Context) error })
+
+			var wg sync.WaitGroup
+			for i := 0; i < 32; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					image := fmt.Sprintf("docker.io/library/app%d:latest", i%4)
+					digestImage := fmt.Sprintf("docker.io/library/app%d@sha256:%064d", i%4, i%4)
+					err := cache.SetCachedPlatforms(ctx, digestImage, []dockerplatforms.DockerPlatform{dockerplatforms.LinuxAMD64})
+					if err != nil {
+						t.Error(err)
+					}
+					err = cache.SetCachedDigest(ctx, image, "sha256:0000000000000000000000000000000000000000000000000000000000000000")
+					if err != nil {
+						t.Error(err)
+					}
+					_, _, err = cache.GetCachedPlatforms(ctx, digestImage)
+					if err != nil {
+						t.Error(err)
+					}
+					_, _, err = cache.GetCachedDigest(ctx, image)
+					if err != nil {
+						t.Error(err)
+					}
+					cache.SetErrorCache(ctx, image+"-broken", errors.New("manifest unknown"))
+					err = cache.ClearCachedPlatforms(ctx, image)
+					if err != nil {
+						t.Error(err)
+					}
+					if canWriteBack && i%8 == 0 {
+						err = writeBack.WriteBack(ctx)
+						if err != nil {
+							t.Error(err)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			err := closeCache()
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package dockerplatforms
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorClass classifies lookup errors, so that caches can tell how long each is worth remembering.
+type ErrorClass string
+
+const (
+	// ErrorNotFound is for images or manifests the registry does not know.
+	ErrorNotFound ErrorClass = "not-found"
+	// ErrorUnauthorized is for registries denying access, which may be fixed by logging in again.
+	ErrorUnauthorized ErrorClass = "unauthorized"
+	// ErrorRateLimited is for registries asking to slow down.
+	ErrorRateLimited ErrorClass = "rate-limited"
+	// ErrorNetwork is for connection failures and server errors.
+	ErrorNetwork ErrorClass = "network"
+	// ErrorOther is for everything else, such as manifests that cannot be parsed.
+	ErrorOther ErrorClass = "other"
+)
+
+// DefaultErrorRetryAfter is how long YAMLCache remembers errors of each class by default.
+// Network errors are not remembered at all.
+var DefaultErrorRetryAfter = map[ErrorClass]time.Duration{
+	ErrorNotFound:     time.Hour,
+	ErrorUnauthorized: 15 * time.Minute,
+	ErrorRateLimited:  5 * time.Minute,
+	ErrorNetwork:      0,
+	ErrorOther:        24 * time.Hour,
+}
+
+// ClassifyError tells the class of an error returned by a lookup.
+func ClassifyError(err error) ErrorClass {
+	var cachedErr *cachedError
+	var statusErr *registryStatusError
+	switch {
+	case errors.As(err, &cachedErr):
+		return cachedErr.class
+	case IsUnauthorized(err):
+		return ErrorUnauthorized
+	case errors.As(err, &statusErr) && statusErr.statusCode == http.StatusNotFound:
+		return ErrorNotFound
+	case errors.As(err, &statusErr) && statusErr.statusCode == http.StatusTooManyRequests:
+		return ErrorRateLimited
+	case IsTransient(err), isTLSError(err):
+		return ErrorNetwork
+	default:
+		return ErrorOther
+	}
+}
+
+// cachedError is a lookup error read back from a cache, with the class it was stored with.
+type cachedError struct {
+	message string
+	class   ErrorClass
+}
+
+func (e *cachedError) Error() string {
+	return e.message
+}
@@ -3,21 +3,31 @@ package dockerplatforms
 
 import (
 	"context"
+	"slices"
 
 	"github.com/containers/image/v5/docker/reference"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
 )
 
 type PlatformInspector interface {
 	GetPlatforms(ctx context.Context, image string) ([]DockerPlatform, error)
+	// Inspect is like GetPlatforms, but also tells the digest the image resolved to.
+	Inspect(ctx context.Context, image string, opts InspectOptions) (InspectResult, error)
 }
 
 type platformInspectorImpl struct {
 	retriever ManifestRetriever
 	cache     Cache
+	lookups   singleflight.Group
 }
 
 // New creates a new PlatformInspector.
+// It is safe for concurrent use as long as the retriever and the cache are.
+// Concurrent requests for the same image share a single lookup.
+//
+// Platforms are cached by digest; tags are cached as an index to the digest they resolved to.
 func New(retriever ManifestRetriever, cache Cache) PlatformInspector {
 	return &platformInspectorImpl{
 		retriever: retriever,
@@ -27,44 +37,186 @@ func New(retriever ManifestRetriever, cache Cache) PlatformInspector {
 
 // GetPlatforms returns the list of supported platforms of the given image.
 func (p *platformInspectorImpl) GetPlatforms(ctx context.Context, image string) ([]DockerPlatform, error) {
+	result, err := p.Inspect(ctx, image, InspectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return result.Platforms, nil
+}
+
+// Inspect implements PlatformInspector.
+func (p *platformInspectorImpl) Inspect(ctx context.Context, image string, opts InspectOptions) (InspectResult, error) {
 	imageRef, err := reference.ParseNormalizedNamed(image)
 	if err != nil {
-		return nil, errors.Wrap(err, "parsing image reference")
+		return InspectResult{}, errors.Wrap(err, "parsing image reference")
 	}
 	imageRef = reference.TagNameOnly(imageRef)
 	// Remove tag if there is a digest
 	if ref2, ok := imageRef.(namedTaggedDigested); ok {
 		named, err := reference.WithName(ref2.Name())
 		if err != nil {
-			return nil, errors.Wrap(err, "removing digest from reference")
+			return InspectResult{}, errors.Wrap(err, "removing digest from reference")
 		}
 		imageRef, err = reference.WithDigest(named, ref2.Digest())
 		if err != nil {
-			return nil, errors.Wrap(err, "removing digest from reference")
+			return InspectResult{}, errors.Wrap(err, "removing digest from reference")
+		}
+	}
+
+	// Short names resolved through unqualified-search registries may name other images than their docker.io names.
+	searched := false
+	if IsShortName(image) {
+		ctx = withShortName(ctx)
+		retriever, ok := p.retriever.(interface{ searchesShortNames() bool })
+		searched = ok && retriever.searchesShortNames()
+	}
+
+	pull, hasPull := pullCredentialsFromContext(ctx)
+	if !hasPull {
+		return p.lookup(ctx, imageRef, searched, "", opts)
+	}
+
+	// Try without the pull credentials first so that public results are shared across scopes.
+	// Only results that need the credentials are cached under the scope,
+	// which keeps one namespace from seeing what another namespace's secrets give access to.
+	cached, ok, err := p.cached(ctx, imageRef, searched, "", opts)
+	if err == nil && ok {
+		return cached, nil
+	}
+	if err == nil {
+		result, err := p.lookup(withoutPullCredentials(ctx), imageRef, searched, "", opts)
+		if err == nil || !IsUnauthorized(err) {
+			return result, err
 		}
 	}
+	return p.lookup(ctx, imageRef, searched, pull.scope, opts)
+}
 
-	image = imageRef.String()
+// lookup returns the result from the cache entries of the scope, analyzing the manifest on a miss.
+func (p *platformInspectorImpl) lookup(ctx context.Context, imageRef reference.Named, searched bool, scope string, opts InspectOptions) (InspectResult, error) {
+	key := imageCacheKey(imageRef, searched, scope)
+	if opts.VerifyPlatforms {
+		key += "!verify"
+	}
+	// The lookup runs without the cancellation of the caller starting it, as the others share its result;
+	// each caller stops waiting when its own ctx is done.
+	shared := context.WithoutCancel(ctx)
+	ch := p.lookups.DoChan(key, func() (interface{}, error) {
+		return p.lookupImpl(shared, imageRef, searched, scope, opts)
+	})
+	var result singleflight.Result
+	select {
+	case <-ctx.Done():
+		return InspectResult{}, ctx.Err()
+	case result = <-ch:
+	}
+	if result.Err != nil {
+		return InspectResult{}, result.Err
+	}
+	return InspectResult{
+		Digest:     result.Val.(InspectResult).Digest,
+		Platforms:  slices.Clone(result.Val.(InspectResult).Platforms),
+		Mismatches: slices.Clone(result.Val.(InspectResult).Mismatches),
+	}, nil
+}
 
-	cached, ok, err := p.cache.GetCachedPlatforms(ctx, image)
+func (p *platformInspectorImpl) lookupImpl(ctx context.Context, imageRef reference.Named, searched bool, scope string, opts InspectOptions) (InspectResult, error) {
+	cached, ok, err := p.cached(ctx, imageRef, searched, scope, opts)
 	if err != nil {
-		return nil, errors.Wrap(err, "looking for cached data")
+		return InspectResult{}, errors.Wrap(err, "looking for cached data")
 	}
 	if ok {
 		return cached, nil
 	}
 
-	platforms, err := AnalyzeManifest(ctx, imageRef, p.retriever)
+	key := imageCacheKey(imageRef, searched, scope)
+	result, err := InspectManifest(ctx, imageRef, p.retriever, opts)
 	if err != nil {
-		p.cache.SetErrorCache(ctx, image, err)
-		return nil, err
+		// The cache tells from the class of the error how soon it is worth another try.
+		p.cache.SetErrorCache(ctx, key, err)
+		return InspectResult{}, err
+	}
+
+	// Verified results are written to the same entries as the others:
+	// the platforms do not depend on the verification, and mismatches are not cached.
+	digestKey, err := digestCacheKey(imageRef, result.Digest, scope)
+	if err != nil {
+		return InspectResult{}, err
+	}
+	err = p.cache.SetCachedPlatforms(ctx, digestKey, result.Platforms)
+	if err != nil {
+		return InspectResult{}, errors.Wrap(err, "caching platforms")
+	}
+	if digestKey != key {
+		err = p.cache.SetCachedDigest(ctx, key, result.Digest)
+		if err != nil {
+			return InspectResult{}, errors.Wrap(err, "caching digest")
+		}
+	}
+
+	return result, nil
+}
+
+// cached looks the reference up in the cache entries of the scope.
+// Tags go through the tag to digest index.
+// Nothing is read when verifying platforms, as mismatches are not cached.
+func (p *platformInspectorImpl) cached(ctx context.Context, imageRef reference.Named, searched bool, scope string, opts InspectOptions) (InspectResult, bool, error) {
+	if opts.VerifyPlatforms {
+		return InspectResult{}, false, nil
+	}
+	key := imageCacheKey(imageRef, searched, scope)
+	if digested, ok := imageRef.(reference.Digested); ok {
+		platforms, ok, err := p.cache.GetCachedPlatforms(ctx, key)
+		return InspectResult{Digest: digested.Digest(), Platforms: platforms}, ok, err
+	}
+
+	d, ok, err := p.cache.GetCachedDigest(ctx, key)
+	if err != nil {
+		return InspectResult{}, false, err
 	}
-	err = p.cache.SetCachedPlatforms(ctx, image, platforms)
+	if !ok {
+		// Entries written before digests were recorded hold the platforms under the tag.
+		platforms, ok, err := p.cache.GetCachedPlatforms(ctx, key)
+		return InspectResult{Platforms: platforms}, ok, err
+	}
+	digestKey, err := digestCacheKey(imageRef, d, scope)
 	if err != nil {
-		return nil, errors.Wrap(err, "caching platforms")
+		return InspectResult{}, false, err
+	}
+	platforms, ok, err := p.cache.GetCachedPlatforms(ctx, digestKey)
+	return InspectResult{Digest: d, Platforms: platforms}, ok, err
+}
+
+// imageCacheKey is the cache key of the reference in the scope.
+// Tags given as short names searched through unqualified-search registries are kept apart from their docker.io names,
+// as they may resolve to other images; digests stand for the same content wherever it is found.
+func imageCacheKey(imageRef reference.Named, searched bool, scope string) string {
+	image := imageRef.String()
+	if _, digested := imageRef.(reference.Digested); searched && !digested {
+		image += "#short"
+	}
+	return scopedCacheKey(image, scope)
+}
+
+// scopedCacheKey is the cache key for results obtained with the pull credentials of the scope.
+func scopedCacheKey(image, scope string) string {
+	if scope == "" {
+		return image
 	}
+	return image + "#" + scope
+}
 
-	return platforms, nil
+// digestCacheKey is the cache key of the platforms of the manifest with the digest in the repository of imageRef.
+func digestCacheKey(imageRef reference.Named, d digest.Digest, scope string) (string, error) {
+	named, err := reference.WithName(imageRef.Name())
+	if err != nil {
+		return "", errors.Wrap(err, "getting image name")
+	}
+	canonical, err := reference.WithDigest(named, d)
+	if err != nil {
+		return "", errors.Wrap(err, "getting digest reference")
+	}
+	return scopedCacheKey(canonical.String(), scope), nil
 }
 
 type namedTaggedDigested interface {
@@ -0,0 +1,293 @@
+package dockerplatforms_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+	dockerplatformstesting "github.com/wantedly/container-platform-tools/dockerplatforms/testing"
+	"go.uber.org/mock/gomock"
+)
+
+func TestGetPlatformsPullCredentials(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.token = "secret-token"
+	registry.username = "alice"
+	registry.password = "s3cret"
+	registry.addManifest("private/app", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	env, cache, err := setupEmptyYAML(ctx, "TestGetPlatformsPullCredentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+	inspector := dockerplatforms.New(registry.client(), cache)
+	image := registry.host + "/private/app:latest"
+
+	goodSecret, err := dockerplatforms.ParseDockerConfig([]byte(`{"auths": {"` + registry.host + `": {"username": "alice", "password": "s3cret"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	platforms, err := inspector.GetPlatforms(dockerplatforms.WithPullCredentials(ctx, "team-a/regcred", goodSecret), image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(len(platforms), 9); diff != "" {
+		t.Errorf("GetPlatforms() count (-want +got):\n%s", diff)
+	}
+
+	// Another namespace must not benefit from the result obtained with team-a's secret.
+	badSecret, err := dockerplatforms.ParseDockerConfig([]byte(`{"auths": {"` + registry.host + `": {"username": "mallory", "password": "guess"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = inspector.GetPlatforms(dockerplatforms.WithPullCredentials(ctx, "team-b/regcred", badSecret), image)
+	if !dockerplatforms.IsUnauthorized(err) {
+		t.Errorf("expected an unauthorized error, got: %v", err)
+	}
+	_, err = inspector.GetPlatforms(ctx, image)
+	if err == nil {
+		t.Error("expected an error without credentials")
+	}
+
+	err = cache.WriteBack(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(env.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{image + ":", image + "#team-a/regcred:", image + "#team-b/regcred:"} {
+		if !strings.Contains(string(content), "\n"+key) && !strings.HasPrefix(string(content), key) {
+			t.Errorf("cache file does not contain %q:\n%s", key, content)
+		}
+	}
+}
+
+func TestGetPlatformsPullCredentialsPublicImage(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.addManifest("library/golang", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	env, cache, err := setupEmptyYAML(ctx, "TestGetPlatformsPullCredentialsPublicImage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+	inspector := dockerplatforms.New(registry.client(), cache)
+
+	_, err = inspector.GetPlatforms(dockerplatforms.WithPullCredentials(ctx, "team-a/regcred", dockerplatforms.CredentialStores{}), registry.host+"/library/golang:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cache.WriteBack(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(env.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "#team-a") {
+		t.Errorf("public image cached under a scoped key:\n%s", content)
+	}
+}
+
+func TestGetPlatformsDeduplicatesConcurrentLookups(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.delay = 20 * time.Millisecond
+	registry.addManifest("library/golang", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	env, cache, err := setupEmptyYAML(ctx, "TestGetPlatformsDeduplicatesConcurrentLookups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+	inspector := dockerplatforms.New(registry.client(), cache)
+
+	var wg sync.WaitGroup
+	for _, image := range []string{registry.host + "/library/golang", registry.host + "/library/golang:latest"} {
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				platforms, err := inspector.GetPlatforms(ctx, image)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(platforms) != 9 {
+					t.Errorf("GetPlatforms() returned %d platforms", len(platforms))
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	if diff := cmp.Diff(registry.requests, 1); diff != "" {
+		t.Errorf("requests (-want +got):\n%s", diff)
+	}
+}
+
+func TestGetPlatformsCancelledSharedLookup(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.delay = 200 * time.Millisecond
+	registry.addManifest("library/golang", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	env, cache, err := setupEmptyYAML(ctx, "TestGetPlatformsCancelledSharedLookup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+	inspector := dockerplatforms.New(registry.client(), cache)
+
+	// The lookup starting the request is cancelled while another one waits for it.
+	startCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	startErr := make(chan error)
+	go func() {
+		_, err := inspector.GetPlatforms(startCtx, registry.host+"/library/golang:latest")
+		startErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	waitErr := make(chan error)
+	go func() {
+		platforms, err := inspector.GetPlatforms(ctx, registry.host+"/library/golang:latest")
+		if err == nil && len(platforms) != 9 {
+			t.Errorf("GetPlatforms() returned %d platforms", len(platforms))
+		}
+		waitErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-startErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("GetPlatforms() with a cancelled context: got %v, want %v", err, context.Canceled)
+	}
+	if err := <-waitErr; err != nil {
+		t.Errorf("GetPlatforms() failed with the cancelled lookup: %v", err)
+	}
+	if diff := cmp.Diff(registry.requests, 1); diff != "" {
+		t.Errorf("requests (-want +got):\n%s", diff)
+	}
+}
+
+func TestInspectRecordsDigest(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.addManifest("library/golang", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	manifestDigest := digest.FromBytes(mustReadFixture(t, "golang-latest.json"))
+	image := registry.host + "/library/golang:latest"
+	env, cache, err := setupEmptyYAML(ctx, "TestInspectRecordsDigest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+
+	result, err := dockerplatforms.New(registry.client(), cache).Inspect(ctx, image, dockerplatforms.InspectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(result.Digest, manifestDigest); diff != "" {
+		t.Errorf("Inspect() digest (-want +got):\n%s", diff)
+	}
+	err = cache.WriteBack(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(env.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{
+		image + ":\n    platforms: \"\"\n    digest: " + manifestDigest.String() + "\n",
+		registry.host + "/library/golang@" + manifestDigest.String() + ":\n    platforms:",
+	} {
+		if !strings.Contains(string(content), entry) {
+			t.Errorf("cache file does not contain %q:\n%s", entry, content)
+		}
+	}
+
+	// Both the tag and the digest are answered from the cache.
+	cache, err = dockerplatforms.NewYAMLCache(ctx, env.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspector := dockerplatforms.New(registry.client(), cache)
+	for _, ref := range []string{image, registry.host + "/library/golang@" + manifestDigest.String()} {
+		result, err := inspector.Inspect(ctx, ref, dockerplatforms.InspectOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(result.Digest, manifestDigest); diff != "" {
+			t.Errorf("Inspect(%s) digest (-want +got):\n%s", ref, diff)
+		}
+		if diff := cmp.Diff(len(result.Platforms), 9); diff != "" {
+			t.Errorf("Inspect(%s) count (-want +got):\n%s", ref, diff)
+		}
+	}
+	if diff := cmp.Diff(registry.requests, 1); diff != "" {
+		t.Errorf("requests (-want +got):\n%s", diff)
+	}
+}
+
+func TestInspectVerificationCache(t *testing.T) {
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	// Each manifest is retrieved once: the second inspection is answered from the cache.
+	retriever := dockerplatformstesting.NewMockManifestRetriever(ctrl)
+	retriever.EXPECT().GetManifest(gomock.Any(), "docker.io/library/app:latest").Return(mustReadFixture(t, "mislabeled-index.json"), "", nil)
+	retriever.EXPECT().GetManifest(gomock.Any(), "docker.io/library/app@sha256:3be07b667a868a246b9cee4ddc5ecce2ad1e211958bd6043a25fc1d19d55e6ba").Return(mustReadFixture(t, "golang-1.5.json"), "", nil)
+	retriever.EXPECT().GetManifest(gomock.Any(), "docker.io/library/app@sha256:99668503de157252ba311f570f036490602095f2620c46cb407d3d2dd88aeb6e").Return(mustReadFixture(t, "golang-1.5-99668503de157252ba311f570f036490602095f2620c46cb407d3d2dd88aeb6e.json"), "", nil)
+	retriever.EXPECT().GetManifest(gomock.Any(), "docker.io/library/app@sha256:c5ac615754c6dfdabc488532f6721140c3fa990c3fdaaebf7a06bcfe0af652ab").Return(mustReadFixture(t, "nested-index-windows-c5ac615754c6dfdabc488532f6721140c3fa990c3fdaaebf7a06bcfe0af652ab.json"), "", nil)
+	retriever.EXPECT().GetManifest(gomock.Any(), "docker.io/library/app@sha256:f4b94ddf9d8c26713dadc655c0fb4f013684fec14e0475a267bafee9b385669c").Return(mustReadFixture(t, "nested-index-windows-config-f4b94ddf9d8c26713dadc655c0fb4f013684fec14e0475a267bafee9b385669c.json"), "", nil)
+	cache := dockerplatforms.NewMemoryCache()
+	err := cache.SetCachedPlatforms(ctx, "docker.io/library/app:latest", dockerplatforms.MustParseDockerPlatformList("linux/s390x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspector := dockerplatforms.New(retriever, cache)
+
+	// Verifying reads nothing from the cache, but writes its results to the usual entries.
+	verified, err := inspector.Inspect(ctx, "app:latest", dockerplatforms.InspectOptions{VerifyPlatforms: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(1, len(verified.Mismatches)); diff != "" {
+		t.Errorf("Inspect() verifying mismatch count (-want +got):\n%s", diff)
+	}
+	result, err := inspector.Inspect(ctx, "app:latest", dockerplatforms.InspectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(verified.Platforms, result.Platforms); diff != "" {
+		t.Errorf("Inspect() platforms (-want +got):\n%s", diff)
+	}
+}
+
+func TestInspectLegacyCacheEntry(t *testing.T) {
+	ctx := context.Background()
+	env, cache, err := setupYAML(ctx, "TestInspectLegacyCacheEntry", `docker.io/library/golang:latest:
+    platforms: linux/amd64, linux/arm64
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+
+	result, err := dockerplatforms.New(nil, cache).Inspect(ctx, "golang", dockerplatforms.InspectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(result, dockerplatforms.InspectResult{
+		Platforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm64"),
+	}); diff != "" {
+		t.Errorf("Inspect() (-want +got):\n%s", diff)
+	}
+}
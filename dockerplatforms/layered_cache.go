@@ -0,0 +1,206 @@
+package dockerplatforms
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// CacheLayer is a layer of a LayeredCache.
+type CacheLayer struct {
+	// Name tells the layer apart in the statistics, such as memory, yaml or configmap.
+	Name  string
+	Cache Cache
+	// WriteBack keeps the writes to the layer until Flush, instead of writing them through.
+	// Use it for slow layers, such as caches shared over the network that are written on every change.
+	WriteBack bool
+}
+
+// CacheLayerStats are the lookups a layer of a LayeredCache answered.
+type CacheLayerStats struct {
+	Name string
+	// Hits are the lookups the layer answered, including cached errors.
+	Hits int64
+	// Misses are the lookups the layer did not answer, which went on to the next layer.
+	Misses int64
+}
+
+// NewLayeredCache creates a Cache composed of layers, from the fastest to the slowest.
+func NewLayeredCache(layers ...CacheLayer) *LayeredCache {
+	cache := &LayeredCache{
+		layers:  layers,
+		stats:   make([]layerCounters, len(layers)),
+		pending: make([]map[string]func(ctx context.Context, cache Cache) error, len(layers)),
+	}
+	for i := range cache.pending {
+		cache.pending[i] = make(map[string]func(ctx context.Context, cache Cache) error)
+	}
+	return cache
+}
+
+var _ Cache = &LayeredCache{}
+
+// LayeredCache is a Cache that looks images up through its layers in order, until one has them.
+// The platforms and digests found in a layer are promoted to the faster layers before it.
+// Entries promoted from a ManagedCache to a ManagedCache keep their fetch time, so that they expire
+// when they would have in the layer they come from. Cached errors are returned, but not promoted.
+// Writes go to every layer, through or back as each layer says.
+// It is safe for concurrent use if its layers are.
+type LayeredCache struct {
+	layers []CacheLayer
+	stats  []layerCounters
+
+	mu sync.Mutex
+	// pending are the writes kept for each layer until Flush, by image. Only the last write to an image counts.
+	pending []map[string]func(ctx context.Context, cache Cache) error
+}
+
+type layerCounters struct {
+	hits, misses atomic.Int64
+}
+
+// Stats returns the hits and misses of each layer so far.
+func (c *LayeredCache) Stats() []CacheLayerStats {
+	stats := make([]CacheLayerStats, len(c.layers))
+	for i, layer := range c.layers {
+		stats[i] = CacheLayerStats{
+			Name:   layer.Name,
+			Hits:   c.stats[i].hits.Load(),
+			Misses: c.stats[i].misses.Load(),
+		}
+	}
+	return stats
+}
+
+// Flush writes the writes kept for the write-back layers.
+// The layers may keep them in turn, such as a YAMLCache until its own WriteBack.
+func (c *LayeredCache) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make([]map[string]func(ctx context.Context, cache Cache) error, len(c.layers))
+	for i := range c.pending {
+		c.pending[i] = make(map[string]func(ctx context.Context, cache Cache) error)
+	}
+	c.mu.Unlock()
+
+	for i, writes := range pending {
+		for _, write := range writes {
+			err := write(ctx, c.layers[i].Cache)
+			if err != nil {
+				return errors.Wrapf(err, "writing to the %s cache", c.layers[i].Name)
+			}
+		}
+	}
+	return nil
+}
+
+// GetCachedPlatforms implements Cache.
+func (c *LayeredCache) GetCachedPlatforms(ctx context.Context, image string) ([]DockerPlatform, bool, error) {
+	for i, layer := range c.layers {
+		platforms, ok, err := layer.Cache.GetCachedPlatforms(ctx, image)
+		if err != nil {
+			c.stats[i].hits.Add(1)
+			return nil, false, err
+		}
+		if !ok {
+			c.stats[i].misses.Add(1)
+			continue
+		}
+		c.stats[i].hits.Add(1)
+		err = c.writeUpTo(ctx, i, image, promotion(ctx, layer.Cache, image, func(ctx context.Context, cache Cache) error {
+			return cache.SetCachedPlatforms(ctx, image, platforms)
+		}))
+		return platforms, true, err
+	}
+	return nil, false, nil
+}
+
+// SetCachedPlatforms implements Cache.
+func (c *LayeredCache) SetCachedPlatforms(ctx context.Context, image string, platforms []DockerPlatform) error {
+	return c.writeUpTo(ctx, len(c.layers), image, func(ctx context.Context, cache Cache) error {
+		return cache.SetCachedPlatforms(ctx, image, platforms)
+	})
+}
+
+// ClearCachedPlatforms implements Cache.
+func (c *LayeredCache) ClearCachedPlatforms(ctx context.Context, image string) error {
+	return c.writeUpTo(ctx, len(c.layers), image, func(ctx context.Context, cache Cache) error {
+		return cache.ClearCachedPlatforms(ctx, image)
+	})
+}
+
+// GetCachedDigest implements Cache.
+func (c *LayeredCache) GetCachedDigest(ctx context.Context, image string) (digest.Digest, bool, error) {
+	for i, layer := range c.layers {
+		d, ok, err := layer.Cache.GetCachedDigest(ctx, image)
+		if err != nil {
+			c.stats[i].hits.Add(1)
+			return "", false, err
+		}
+		if !ok {
+			c.stats[i].misses.Add(1)
+			continue
+		}
+		c.stats[i].hits.Add(1)
+		err = c.writeUpTo(ctx, i, image, promotion(ctx, layer.Cache, image, func(ctx context.Context, cache Cache) error {
+			return cache.SetCachedDigest(ctx, image, d)
+		}))
+		return d, true, err
+	}
+	return "", false, nil
+}
+
+// SetCachedDigest implements Cache.
+func (c *LayeredCache) SetCachedDigest(ctx context.Context, image string, d digest.Digest) error {
+	return c.writeUpTo(ctx, len(c.layers), image, func(ctx context.Context, cache Cache) error {
+		return cache.SetCachedDigest(ctx, image, d)
+	})
+}
+
+// SetErrorCache implements Cache.
+func (c *LayeredCache) SetErrorCache(ctx context.Context, image string, err error) {
+	c.writeUpTo(ctx, len(c.layers), image, func(ctx context.Context, cache Cache) error {
+		cache.SetErrorCache(ctx, image, err)
+		return nil
+	})
+}
+
+// promotion returns the write promoting the entry of the image found in a layer.
+// It copies the entry with its fetch time into the layers that are ManagedCaches when the layer is one,
+// and falls back to set otherwise.
+func promotion(ctx context.Context, layer Cache, image string, set func(ctx context.Context, cache Cache) error) func(ctx context.Context, cache Cache) error {
+	managed, ok := layer.(ManagedCache)
+	if !ok {
+		return set
+	}
+	entry, ok, err := managed.Entry(ctx, image)
+	if err != nil || !ok {
+		return set
+	}
+	return func(ctx context.Context, cache Cache) error {
+		if managed, ok := cache.(ManagedCache); ok {
+			return managed.SetEntry(ctx, entry)
+		}
+		return set(ctx, cache)
+	}
+}
+
+// writeUpTo applies the write to the layers before the nth, keeping it for Flush in the write-back layers.
+func (c *LayeredCache) writeUpTo(ctx context.Context, n int, image string, write func(ctx context.Context, cache Cache) error) error {
+	for i, layer := range c.layers[:n] {
+		if layer.WriteBack {
+			c.mu.Lock()
+			c.pending[i][image] = write
+			c.mu.Unlock()
+			continue
+		}
+		err := write(ctx, layer.Cache)
+		if err != nil {
+			return errors.Wrapf(err, "writing to the %s cache", layer.Name)
+		}
+	}
+	return nil
+}
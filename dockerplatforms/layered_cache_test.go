@@ -0,0 +1,135 @@
+package dockerplatforms_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+)
+
+func TestLayeredCache(t *testing.T) {
+	ctx := context.Background()
+	memory := dockerplatforms.NewMemoryCache()
+	local := dockerplatforms.NewMemoryCache()
+	remote := dockerplatforms.NewMemoryCache()
+	err := remote.SetCachedPlatforms(ctx, "docker.io/library/golang:latest", dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := dockerplatforms.NewLayeredCache(
+		dockerplatforms.CacheLayer{Name: "memory", Cache: memory},
+		dockerplatforms.CacheLayer{Name: "local", Cache: local},
+		dockerplatforms.CacheLayer{Name: "remote", Cache: remote, WriteBack: true},
+	)
+
+	// The remote hit is promoted, so that the second lookup stops at the memory.
+	for i := 0; i < 2; i++ {
+		platforms, ok, err := cache.GetCachedPlatforms(ctx, "docker.io/library/golang:latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(true, ok); diff != "" {
+			t.Errorf("GetCachedPlatforms() ok (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff("linux/amd64, linux/arm64", dockerplatforms.DockerPlatformList(platforms).String()); diff != "" {
+			t.Errorf("GetCachedPlatforms() platforms (-want +got):\n%s", diff)
+		}
+	}
+	_, ok, err := local.GetCachedPlatforms(ctx, "docker.io/library/golang:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(true, ok); diff != "" {
+		t.Errorf("promoted to the local layer (-want +got):\n%s", diff)
+	}
+
+	// New entries reach the remote layer on Flush only.
+	err = cache.SetCachedPlatforms(ctx, "docker.io/library/node:latest", dockerplatforms.MustParseDockerPlatformList("linux/amd64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err = remote.GetCachedPlatforms(ctx, "docker.io/library/node:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(false, ok); diff != "" {
+		t.Errorf("in the remote layer before Flush (-want +got):\n%s", diff)
+	}
+	err = cache.Flush(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err = remote.GetCachedPlatforms(ctx, "docker.io/library/node:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(true, ok); diff != "" {
+		t.Errorf("in the remote layer after Flush (-want +got):\n%s", diff)
+	}
+
+	_, _, err = cache.GetCachedPlatforms(ctx, "docker.io/library/ruby:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]dockerplatforms.CacheLayerStats{
+		{Name: "memory", Hits: 1, Misses: 2},
+		{Name: "local", Misses: 2},
+		{Name: "remote", Hits: 1, Misses: 1},
+	}, cache.Stats()); diff != "" {
+		t.Errorf("Stats() (-want +got):\n%s", diff)
+	}
+}
+
+func TestLayeredCachePromotionKeepsFetchedAt(t *testing.T) {
+	ctx := context.Background()
+	fetchedAt := time.Now().UTC().Add(-20 * time.Hour).Truncate(time.Second)
+	remoteEnv, remote, err := setupYAML(ctx, "TestLayeredCachePromotionKeepsFetchedAt", `docker.io/library/golang:latest:
+    platforms: linux/amd64
+    fetchedAt: `+fetchedAt.Format(time.RFC3339)+`
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remoteEnv.Close()
+	localEnv, local, err := setupEmptyYAML(ctx, "TestLayeredCachePromotionKeepsFetchedAt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer localEnv.Close()
+	remote.TagTTL = 24 * time.Hour
+	local.TagTTL = 24 * time.Hour
+	cache := dockerplatforms.NewLayeredCache(
+		dockerplatforms.CacheLayer{Name: "local", Cache: local},
+		dockerplatforms.CacheLayer{Name: "remote", Cache: remote},
+	)
+
+	_, ok, err := cache.GetCachedPlatforms(ctx, "docker.io/library/golang:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(true, ok); diff != "" {
+		t.Errorf("GetCachedPlatforms() ok (-want +got):\n%s", diff)
+	}
+	entry, ok, err := local.Entry(ctx, "docker.io/library/golang:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("not promoted to the local layer")
+	}
+	if diff := cmp.Diff(fetchedAt, entry.FetchedAt); diff != "" {
+		t.Errorf("promoted FetchedAt (-want +got):\n%s", diff)
+	}
+
+	// Under a TTL shorter than its age, the promoted entry expires, as it would not if stamped when promoted.
+	local.TagTTL = 15 * time.Hour
+	_, ok, err = local.GetCachedPlatforms(ctx, "docker.io/library/golang:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(false, ok); diff != "" {
+		t.Errorf("promoted entry fresh after its original expiry (-want +got):\n%s", diff)
+	}
+}
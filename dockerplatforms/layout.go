@@ -0,0 +1,572 @@
+package dockerplatforms
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// annotationContainerdImageName is the annotation containerd and docker use for the full image name.
+const annotationContainerdImageName = "io.containerd.image.name"
+
+// unnamedLayoutImage is the repository name used for layout entries without any name annotation.
+const unnamedLayoutImage = "localhost/layout"
+
+// LayoutRetriever is a ManifestRetriever reading images stored locally,
+// either as an OCI image layout or as a tarball produced by `docker save`
+// or `docker buildx build --output type=oci`.
+//
+// Manifests, nested indexes and config blobs are read straight from the blob store.
+// Tag references are matched against the names recorded in the layout.
+type LayoutRetriever struct {
+	store layoutStore
+
+	once    sync.Once
+	entries []layoutEntry
+	// synthesized holds the manifests made up for images saved in the legacy docker format.
+	synthesized map[digest.Digest][]byte
+	// legacyBlobs maps the blobs of images saved in the legacy docker format to their path.
+	legacyBlobs map[digest.Digest]string
+	err         error
+}
+
+var _ ManifestRetriever = &LayoutRetriever{}
+var _ BlobRetriever = &LayoutRetriever{}
+
+type layoutEntry struct {
+	descriptor imgspecv1.Descriptor
+	// names are the references under which the entry is known, as written in the layout.
+	names []string
+}
+
+// NewOCILayout creates a LayoutRetriever reading an OCI image layout directory.
+func NewOCILayout(dir string) *LayoutRetriever {
+	return &LayoutRetriever{store: dirStore{dir: dir}}
+}
+
+// NewArchive creates a LayoutRetriever reading a tarball, optionally gzip-compressed.
+// Both OCI archives and `docker save` archives (including the legacy format) are supported.
+func NewArchive(path string) *LayoutRetriever {
+	return &LayoutRetriever{store: &tarStore{path: path}}
+}
+
+// GetManifest implements ManifestRetriever.
+func (l *LayoutRetriever) GetManifest(ctx context.Context, image string) ([]byte, string, error) {
+	err := l.load()
+	if err != nil {
+		return nil, "", err
+	}
+
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "parsing image reference")
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		return l.getBlob(digested.Digest())
+	}
+
+	entry, err := l.find(reference.TagNameOnly(named))
+	if err != nil {
+		return nil, "", err
+	}
+	return l.getBlob(entry.descriptor.Digest)
+}
+
+// GetBlob implements BlobRetriever.
+func (l *LayoutRetriever) GetBlob(ctx context.Context, image string) (io.ReadCloser, error) {
+	err := l.load()
+	if err != nil {
+		return nil, err
+	}
+
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing image reference")
+	}
+	digested, ok := named.(reference.Digested)
+	if !ok {
+		return nil, errors.Errorf("%s is not a digest reference", image)
+	}
+	d := digested.Digest()
+	name := path.Join(imgspecv1.ImageBlobsDir, d.Algorithm().String(), d.Encoded())
+	if legacy, ok := l.legacyBlobs[d]; ok {
+		name = legacy
+	}
+	f, err := l.store.open(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening blob %s", d)
+	}
+	return newVerifyingReader(f, d), nil
+}
+
+// Resolve finds the image named ref in the layout and returns a digest reference to it,
+// suitable for AnalyzeManifest. ref may be a full image name, a tag, or the name recorded
+// in the layout; when it is empty, the layout must contain a single image.
+func (l *LayoutRetriever) Resolve(ctx context.Context, ref string) (reference.Named, error) {
+	err := l.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var entry layoutEntry
+	if ref == "" {
+		if len(l.entries) != 1 {
+			return nil, errors.Errorf("the layout contains %d images; specify which one to use", len(l.entries))
+		}
+		entry = l.entries[0]
+	} else {
+		matches := l.match(ref)
+		if !strings.ContainsAny(ref, "/:") {
+			// A bare word is a tag rather than a repository name.
+			matches = append(matches, l.matchTag(ref)...)
+		} else if named, err := reference.ParseNormalizedNamed(ref); err == nil && len(matches) == 0 {
+			matches = l.matchNamed(reference.TagNameOnly(named))
+		}
+		if len(matches) == 0 {
+			return nil, errors.Errorf("%s not found in the layout", ref)
+		}
+		entry = matches[0]
+	}
+
+	name := unnamedLayoutImage
+	if names := entry.imageNames(); len(names) > 0 {
+		name = names[0].Name()
+	}
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "naming the layout image")
+	}
+	return reference.WithDigest(named, entry.descriptor.Digest)
+}
+
+// imageNames returns the recorded names that are image references rather than bare tags.
+func (e layoutEntry) imageNames() []reference.Named {
+	var names []reference.Named
+	for _, name := range e.names {
+		if !strings.ContainsAny(name, "/:") {
+			continue
+		}
+		named, err := reference.ParseNormalizedNamed(name)
+		if err != nil {
+			continue
+		}
+		names = append(names, reference.TagNameOnly(named))
+	}
+	return names
+}
+
+func (l *LayoutRetriever) find(named reference.Named) (layoutEntry, error) {
+	matches := l.matchNamed(named)
+	if len(matches) == 0 {
+		return layoutEntry{}, errors.Errorf("%s not found in the layout", named)
+	}
+	return matches[0], nil
+}
+
+// matchNamed looks for entries by full name first, falling back to the tag alone
+// for entries without a full name, as layouts written by buildx record only the tag
+// in org.opencontainers.image.ref.name.
+func (l *LayoutRetriever) matchNamed(named reference.Named) []layoutEntry {
+	var byName, byTag []layoutEntry
+	tagged, isTagged := named.(reference.Tagged)
+	for _, entry := range l.entries {
+		names := entry.imageNames()
+		for _, other := range names {
+			if other.String() == named.String() {
+				byName = append(byName, entry)
+				break
+			}
+		}
+		if isTagged && len(names) == 0 && slices.Contains(entry.names, tagged.Tag()) {
+			byTag = append(byTag, entry)
+		}
+	}
+	if len(byName) > 0 {
+		return byName
+	}
+	return byTag
+}
+
+// matchTag looks for entries recorded under a full name with the given tag.
+func (l *LayoutRetriever) matchTag(tag string) []layoutEntry {
+	var matches []layoutEntry
+	for _, entry := range l.entries {
+		for _, named := range entry.imageNames() {
+			if tagged, ok := named.(reference.Tagged); ok && tagged.Tag() == tag {
+				matches = append(matches, entry)
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// match looks for entries whose recorded name is exactly ref.
+func (l *LayoutRetriever) match(ref string) []layoutEntry {
+	var matches []layoutEntry
+	for _, entry := range l.entries {
+		for _, name := range entry.names {
+			if name == ref {
+				matches = append(matches, entry)
+				break
+			}
+		}
+	}
+	return matches
+}
+
+func (l *LayoutRetriever) getBlob(d digest.Digest) ([]byte, string, error) {
+	err := d.Validate()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "invalid digest")
+	}
+
+	var mediaType string
+	for _, entry := range l.entries {
+		if entry.descriptor.Digest == d {
+			mediaType = entry.descriptor.MediaType
+		}
+	}
+
+	if synthesized, ok := l.synthesized[d]; ok {
+		return synthesized, manifest.DockerV2Schema2MediaType, nil
+	}
+	name := path.Join(imgspecv1.ImageBlobsDir, d.Algorithm().String(), d.Encoded())
+	if legacy, ok := l.legacyBlobs[d]; ok {
+		name = legacy
+	}
+	data, err := l.readFile(name)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "reading blob %s", d)
+	}
+	if d.Algorithm() == digest.SHA256 && digest.FromBytes(data) != d {
+		return nil, "", errors.Errorf("digest mismatch for blob %s", d)
+	}
+	return data, mediaType, nil
+}
+
+func (l *LayoutRetriever) readFile(name string) ([]byte, error) {
+	f, err := l.store.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxManifestSize {
+		return nil, errors.Errorf("%s is too large", name)
+	}
+	return data, nil
+}
+
+func (l *LayoutRetriever) load() error {
+	l.once.Do(func() {
+		l.err = l.loadImpl()
+	})
+	return l.err
+}
+
+func (l *LayoutRetriever) loadImpl() error {
+	indexText, err := l.readFile(imgspecv1.ImageIndexFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return l.loadLegacy()
+	}
+	if err != nil {
+		return errors.Wrap(err, "reading index.json")
+	}
+
+	var index imgspecv1.Index
+	err = json.Unmarshal(indexText, &index)
+	if err != nil {
+		return errors.Wrap(err, "parsing index.json")
+	}
+	for _, descriptor := range index.Manifests {
+		var names []string
+		if name := descriptor.Annotations[annotationContainerdImageName]; name != "" {
+			names = append(names, name)
+		}
+		if name := descriptor.Annotations[imgspecv1.AnnotationRefName]; name != "" {
+			names = append(names, name)
+		}
+		l.entries = append(l.entries, layoutEntry{descriptor: descriptor, names: names})
+	}
+	return nil
+}
+
+// loadLegacy reads the manifest.json of an archive written by `docker save` before Docker 25.
+// Such archives contain no manifests, so one is synthesized for each image.
+func (l *LayoutRetriever) loadLegacy() error {
+	manifestText, err := l.readFile("manifest.json")
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("neither index.json nor manifest.json found; not an image layout")
+	}
+	if err != nil {
+		return errors.Wrap(err, "reading manifest.json")
+	}
+
+	var items []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	err = json.Unmarshal(manifestText, &items)
+	if err != nil {
+		return errors.Wrap(err, "parsing manifest.json")
+	}
+
+	l.synthesized = make(map[digest.Digest][]byte)
+	l.legacyBlobs = make(map[digest.Digest]string)
+	for _, item := range items {
+		configText, err := l.readFile(item.Config)
+		if err != nil {
+			return errors.Wrapf(err, "reading config %s", item.Config)
+		}
+		configDigest := digest.FromBytes(configText)
+		l.legacyBlobs[configDigest] = item.Config
+
+		var config struct {
+			RootFS struct {
+				DiffIDs []digest.Digest `json:"diff_ids"`
+			} `json:"rootfs"`
+		}
+		err = json.Unmarshal(configText, &config)
+		if err != nil {
+			return errors.Wrapf(err, "parsing config %s", item.Config)
+		}
+
+		// The layers of legacy archives are uncompressed, so their digests are the diff IDs.
+		layers := make([]manifest.Schema2Descriptor, len(item.Layers))
+		for i, layer := range item.Layers {
+			size, err := l.store.size(layer)
+			if err != nil {
+				return errors.Wrapf(err, "reading layer %s", layer)
+			}
+			layers[i] = manifest.Schema2Descriptor{
+				MediaType: manifest.DockerV2Schema2LayerMediaType,
+				Size:      size,
+			}
+			if i < len(config.RootFS.DiffIDs) {
+				layers[i].Digest = config.RootFS.DiffIDs[i]
+				l.legacyBlobs[config.RootFS.DiffIDs[i]] = layer
+			}
+		}
+		synthesized, err := manifest.Schema2FromComponents(manifest.Schema2Descriptor{
+			MediaType: manifest.DockerV2Schema2ConfigMediaType,
+			Size:      int64(len(configText)),
+			Digest:    configDigest,
+		}, layers).Serialize()
+		if err != nil {
+			return errors.Wrap(err, "synthesizing manifest")
+		}
+		synthesizedDigest := digest.FromBytes(synthesized)
+		l.synthesized[synthesizedDigest] = synthesized
+
+		l.entries = append(l.entries, layoutEntry{
+			descriptor: imgspecv1.Descriptor{
+				MediaType: manifest.DockerV2Schema2MediaType,
+				Digest:    synthesizedDigest,
+				Size:      int64(len(synthesized)),
+			},
+			names: item.RepoTags,
+		})
+	}
+	return nil
+}
+
+// layoutStore gives access to the files of a layout by their slash-separated path.
+type layoutStore interface {
+	open(name string) (io.ReadCloser, error)
+	size(name string) (int64, error)
+}
+
+type dirStore struct {
+	dir string
+}
+
+func (s dirStore) open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, filepath.FromSlash(name)))
+}
+
+func (s dirStore) size(name string) (int64, error) {
+	info, err := os.Stat(filepath.Join(s.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// tarStore reads files from a tarball.
+// The files no larger than manifests, such as the metadata files, manifests and configs, are kept in memory after the first scan.
+// The others, such as layers, are read from their offset in uncompressed tarballs, and by scanning again in compressed ones,
+// so that archives of many layers are not held in memory.
+type tarStore struct {
+	path string
+
+	once  sync.Once
+	small map[string][]byte
+	sizes map[string]int64
+	// offsets are where the files start in the tarball, when it is not compressed.
+	offsets map[string]int64
+	err     error
+}
+
+func (s *tarStore) size(name string) (int64, error) {
+	s.once.Do(func() {
+		s.err = s.index()
+	})
+	if s.err != nil {
+		return 0, s.err
+	}
+	size, ok := s.sizes[path.Clean(name)]
+	if !ok {
+		return 0, errors.Wrapf(os.ErrNotExist, "%s in %s", name, s.path)
+	}
+	return size, nil
+}
+
+func (s *tarStore) open(name string) (io.ReadCloser, error) {
+	size, err := s.size(name)
+	if err != nil {
+		return nil, err
+	}
+
+	name = path.Clean(name)
+	if data, ok := s.small[name]; ok {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	if offset, ok := s.offsets[name]; ok {
+		f, err := os.Open(s.path)
+		if err != nil {
+			return nil, errors.Wrap(err, "opening archive")
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(f, offset, size), f}, nil
+	}
+
+	var found io.ReadCloser
+	err = s.walk(func(entryName string, _ int64, _ int64, tr *tar.Reader, closer io.Closer) (bool, error) {
+		if entryName != name {
+			return false, nil
+		}
+		found = struct {
+			io.Reader
+			io.Closer
+		}{tr, closer}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, errors.Wrapf(os.ErrNotExist, "%s in %s", name, s.path)
+	}
+	return found, nil
+}
+
+func (s *tarStore) index() error {
+	s.small = make(map[string][]byte)
+	s.sizes = make(map[string]int64)
+	s.offsets = make(map[string]int64)
+	return s.walk(func(name string, size int64, offset int64, tr *tar.Reader, _ io.Closer) (bool, error) {
+		s.sizes[name] = size
+		if offset >= 0 {
+			s.offsets[name] = offset
+		}
+		if size > maxManifestSize {
+			return false, nil
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return false, errors.Wrapf(err, "reading %s", name)
+		}
+		s.small[name] = data
+		return false, nil
+	})
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// walk calls fn for each regular file in the tarball until it returns true,
+// with the offset of the file in the tarball, or -1 when the tarball is compressed.
+// When fn returns true, closing the closer passed to it is the responsibility of fn.
+func (s *tarStore) walk(fn func(name string, size int64, offset int64, tr *tar.Reader, closer io.Closer) (bool, error)) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return errors.Wrap(err, "opening archive")
+	}
+	keepOpen := false
+	defer func() {
+		if !keepOpen {
+			f.Close()
+		}
+	}()
+
+	br := bufio.NewReader(f)
+	// The tar reader reads no further than the header of each file, so what it has read tells where the file starts.
+	counter := &countingReader{r: br}
+	var r io.Reader = counter
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return errors.Wrap(err, "decompressing archive")
+		}
+		r = gz
+		counter = nil
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading archive")
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		offset := int64(-1)
+		if counter != nil {
+			offset = counter.n
+		}
+		done, err := fn(path.Clean(header.Name), header.Size, offset, tr, f)
+		if err != nil {
+			return err
+		}
+		if done {
+			keepOpen = true
+			return nil
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package dockerplatforms_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+)
+
+const golang15ConfigFixture = "golang-1.5-99668503de157252ba311f570f036490602095f2620c46cb407d3d2dd88aeb6e.json"
+
+func TestLayoutIndex(t *testing.T) {
+	ctx := context.Background()
+	files := ociLayoutFiles(t, "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"), map[string]string{
+		"io.containerd.image.name":          "docker.io/library/golang:latest",
+		"org.opencontainers.image.ref.name": "latest",
+	})
+	dir := writeLayoutDir(t, files)
+
+	for _, arg := range []string{"oci:" + dir, "oci:" + dir + ":latest", "oci:" + dir + ":golang:latest", "oci:" + dir + ":docker.io/library/golang"} {
+		t.Run(arg, func(t *testing.T) {
+			imageRef, retriever, err := dockerplatforms.ParseImageArgument(ctx, arg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(imageRef.String(), "docker.io/library/golang@"+digest.FromBytes(mustReadFixture(t, "golang-latest.json")).String()); diff != "" {
+				t.Errorf("ParseImageArgument() reference (-want +got):\n%s", diff)
+			}
+			platforms, err := dockerplatforms.AnalyzeManifest(ctx, imageRef, retriever)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(len(platforms), 9); diff != "" {
+				t.Errorf("AnalyzeManifest() count (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	_, _, err := dockerplatforms.ParseImageArgument(ctx, "oci:"+dir+":nonexistent")
+	if err == nil {
+		t.Error("Missing error for a nonexistent reference")
+	}
+}
+
+func TestLayoutManifestByTag(t *testing.T) {
+	ctx := context.Background()
+	files := ociLayoutFiles(t, "application/vnd.docker.distribution.manifest.v2+json", mustReadFixture(t, "golang-1.5.json"), map[string]string{
+		"org.opencontainers.image.ref.name": "1.5",
+	})
+	retriever := dockerplatforms.NewOCILayout(writeLayoutDir(t, files))
+
+	manifest, mediaType, err := retriever.GetManifest(ctx, "docker.io/library/golang:1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(manifest), string(mustReadFixture(t, "golang-1.5.json"))); diff != "" {
+		t.Errorf("GetManifest() manifest (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(mediaType, "application/vnd.docker.distribution.manifest.v2+json"); diff != "" {
+		t.Errorf("GetManifest() mediaType (-want +got):\n%s", diff)
+	}
+}
+
+func TestOCIArchive(t *testing.T) {
+	ctx := context.Background()
+	files := ociLayoutFiles(t, "application/vnd.docker.distribution.manifest.v2+json", mustReadFixture(t, "golang-1.5.json"), nil)
+
+	for _, compressed := range []bool{false, true} {
+		path := writeArchive(t, files, compressed)
+		imageRef, retriever, err := dockerplatforms.ParseImageArgument(ctx, "oci-archive:"+path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(imageRef.Name(), "localhost/layout"); diff != "" {
+			t.Errorf("ParseImageArgument() name (-want +got):\n%s", diff)
+		}
+		platforms, err := dockerplatforms.AnalyzeManifest(ctx, imageRef, retriever)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(platforms, []dockerplatforms.DockerPlatform{dockerplatforms.LinuxAMD64}); diff != "" {
+			t.Errorf("AnalyzeManifest() (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestOCIArchiveBlobs(t *testing.T) {
+	ctx := context.Background()
+	files := ociLayoutFiles(t, "application/vnd.docker.distribution.manifest.v2+json", mustReadFixture(t, "golang-1.5.json"), nil)
+	// The layer is larger than manifests, so that it is read from the archive instead of memory.
+	layer := make([]byte, 5<<20)
+	for i := range layer {
+		layer[i] = byte(i * 7 / 251)
+	}
+	layerDigest := digest.FromBytes(layer)
+	files["blobs/sha256/"+layerDigest.Encoded()] = layer
+	config := mustReadFixture(t, golang15ConfigFixture)
+
+	for _, compressed := range []bool{false, true} {
+		path := writeArchive(t, files, compressed)
+		_, retriever, err := dockerplatforms.ParseImageArgument(ctx, "oci-archive:"+path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, blob := range [][]byte{layer, config, layer} {
+			r, err := retriever.(dockerplatforms.BlobRetriever).GetBlob(ctx, "localhost/layout@"+digest.FromBytes(blob).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(blob, content) {
+				t.Errorf("GetBlob(%s) with compressed=%t returned other content", digest.FromBytes(blob), compressed)
+			}
+		}
+	}
+}
+
+func TestLegacyDockerArchive(t *testing.T) {
+	ctx := context.Background()
+	config := mustReadFixture(t, golang15ConfigFixture)
+	manifestJSON, err := json.Marshal([]map[string]interface{}{
+		{
+			"Config":   digest.FromBytes(config).Encoded() + ".json",
+			"RepoTags": []string{"golang:1.5"},
+			"Layers":   []string{"0123/layer.tar"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeArchive(t, map[string][]byte{
+		"manifest.json": manifestJSON,
+		digest.FromBytes(config).Encoded() + ".json": config,
+		"0123/layer.tar": []byte("not really a layer"),
+	}, false)
+
+	for _, arg := range []string{"docker-archive:" + path, "docker-archive:" + path + ":golang:1.5", "docker-archive:" + path + ":1.5"} {
+		t.Run(arg, func(t *testing.T) {
+			imageRef, retriever, err := dockerplatforms.ParseImageArgument(ctx, arg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(imageRef.Name(), "docker.io/library/golang"); diff != "" {
+				t.Errorf("ParseImageArgument() name (-want +got):\n%s", diff)
+			}
+			platforms, err := dockerplatforms.AnalyzeManifest(ctx, imageRef, retriever)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(platforms, []dockerplatforms.DockerPlatform{dockerplatforms.LinuxAMD64}); diff != "" {
+				t.Errorf("AnalyzeManifest() (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseImageArgumentRegistry(t *testing.T) {
+	ctx := context.Background()
+	for _, arg := range []string{"golang:1.5", "docker://golang:1.5"} {
+		imageRef, retriever, err := dockerplatforms.ParseImageArgument(ctx, arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retriever != nil {
+			t.Errorf("unexpected retriever for %s", arg)
+		}
+		if diff := cmp.Diff(imageRef.String(), "docker.io/library/golang:1.5"); diff != "" {
+			t.Errorf("ParseImageArgument() reference (-want +got):\n%s", diff)
+		}
+	}
+}
+
+// ociLayoutFiles returns the files of an OCI image layout holding the golang fixtures,
+// with the given manifest referenced from index.json.
+func ociLayoutFiles(t *testing.T, mediaType string, manifest []byte, annotations map[string]string) map[string][]byte {
+	t.Helper()
+
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.index.v1+json",
+		"manifests": []map[string]interface{}{
+			{
+				"mediaType":   mediaType,
+				"digest":      digest.FromBytes(manifest),
+				"size":        len(manifest),
+				"annotations": annotations,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"oci-layout": []byte(`{"imageLayoutVersion":"1.0.0"}`),
+		"index.json": index,
+	}
+	for _, blob := range [][]byte{manifest, mustReadFixture(t, golang15ConfigFixture)} {
+		files["blobs/sha256/"+digest.FromBytes(blob).Encoded()] = blob
+	}
+	return files
+}
+
+func writeLayoutDir(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, content, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func writeArchive(t *testing.T, files map[string][]byte, compressed bool) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "image.tar")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var gz *gzip.Writer
+	tw := tar.NewWriter(f)
+	if compressed {
+		gz = gzip.NewWriter(f)
+		tw = tar.NewWriter(gz)
+	}
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		err = gz.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
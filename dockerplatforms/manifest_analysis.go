@@ -2,18 +2,99 @@ package dockerplatforms
 
 import (
 	"context"
+	"encoding/json"
 
 	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
+// InspectResult is what inspecting an image tells.
+type InspectResult struct {
+	// Digest is the digest of the manifest the reference resolved to.
+	// It is empty for results cached before digests were recorded.
+	Digest    digest.Digest
+	Platforms []DockerPlatform
+	// Mismatches are the index entries whose platform disagrees with their config.
+	// They are only looked for when InspectOptions.VerifyPlatforms is set.
+	Mismatches []PlatformMismatch
+}
+
+// InspectOptions are the options of inspections.
+type InspectOptions struct {
+	// VerifyPlatforms checks the platform of every index entry against the config of its image,
+	// and reports disagreements as InspectResult.Mismatches.
+	// This costs two requests for each platform. PlatformInspector then reads no results from the cache,
+	// but still writes them to it, as the platforms do not depend on the verification.
+	VerifyPlatforms bool
+}
+
 func AnalyzeManifest(ctx context.Context, imageRef reference.Named, retriever ManifestRetriever) ([]DockerPlatform, error) {
+	result, err := InspectManifest(ctx, imageRef, retriever, InspectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return result.Platforms, nil
+}
+
+// InspectManifest is like AnalyzeManifest, but also tells the digest of the manifest the reference resolved to.
+func InspectManifest(ctx context.Context, imageRef reference.Named, retriever ManifestRetriever, opts InspectOptions) (InspectResult, error) {
+	analysis, err := analyzeManifest(ctx, imageRef, retriever, opts)
+	if err != nil {
+		return InspectResult{}, err
+	}
+	platforms := []DockerPlatform{}
+	for _, m := range analysis.manifests {
+		platforms = append(platforms, m.Platform)
+	}
+	return InspectResult{Digest: analysis.digest, Platforms: platforms, Mismatches: analysis.mismatches}, nil
+}
+
+func analyzeManifest(ctx context.Context, imageRef reference.Named, retriever ManifestRetriever, opts InspectOptions) (*manifestAnalysis, error) {
 	manifestText, mediaType, err := retriever.GetManifest(ctx, imageRef.String())
 	if err != nil {
 		return nil, errors.Wrap(err, "retrieving manifest")
 	}
+	var manifestDigest digest.Digest
+	if digested, ok := imageRef.(reference.Digested); ok {
+		manifestDigest = digested.Digest()
+	} else {
+		manifestDigest, err = manifest.Digest(manifestText)
+		if err != nil {
+			return nil, errors.Wrap(err, "computing manifest digest")
+		}
+	}
+	analysis := &manifestAnalysis{
+		digest:       manifestDigest,
+		attestations: make(map[digest.Digest][]digest.Digest),
+		verify:       opts.VerifyPlatforms,
+	}
+	err = analysis.analyze(ctx, imageRef, retriever, manifestText, mediaType, manifestDigest, 0)
+	if err != nil {
+		return nil, err
+	}
+	return analysis, nil
+}
+
+// maxIndexDepth is how deep image indexes may nest.
+const maxIndexDepth = 8
+
+// manifestAnalysis accumulates what a manifest and the manifests it refers to tell.
+type manifestAnalysis struct {
+	// digest is the digest of the manifest the reference resolved to.
+	digest digest.Digest
+	// manifests are the image manifests found, with their platform but no attestations.
+	manifests []PlatformManifest
+	// attestations maps the digest of an image manifest to the BuildKit attestation manifests describing it.
+	attestations map[digest.Digest][]digest.Digest
+	// verify makes the analysis check index entries against their configs.
+	verify     bool
+	mismatches []PlatformMismatch
+}
+
+func (a *manifestAnalysis) analyze(ctx context.Context, imageRef reference.Named, retriever ManifestRetriever, manifestText []byte, mediaType string, manifestDigest digest.Digest, depth int) error {
 	if mediaType == "" {
 		mediaType = manifest.GuessMIMEType(manifestText)
 	}
@@ -21,57 +102,158 @@ func AnalyzeManifest(ctx context.Context, imageRef reference.Named, retriever Ma
 	mediaType = manifest.NormalizedMIMEType(mediaType)
 
 	if manifest.MIMETypeIsMultiImage(mediaType) {
-		platforms := []DockerPlatform{}
+		if depth >= maxIndexDepth {
+			return errors.Errorf("image indexes nested deeper than %d levels", maxIndexDepth)
+		}
+		found := len(a.manifests)
 		list, err := manifest.ListFromBlob(manifestText, mediaType)
 		if err != nil {
-			return nil, errors.Wrap(err, "parsing manifest list")
+			return errors.Wrap(err, "parsing manifest list")
 		}
+		var artifactErr *ArtifactError
 		for _, instanceDigest := range list.Instances() {
 			instance, err := list.Instance(instanceDigest)
 			if err != nil {
-				return nil, errors.Wrap(err, "getting instance")
+				return errors.Wrap(err, "getting instance")
 			}
-			if instance.ReadOnly.Platform.OS == "unknown" && instance.ReadOnly.Platform.Architecture == "unknown" {
+			platform := instance.ReadOnly.Platform
+			if platform != nil && platform.OS == "unknown" && platform.Architecture == "unknown" {
+				// Attestations attached by BuildKit
+				if instance.ReadOnly.Annotations[annotationReferenceType] == referenceTypeAttestation {
+					subject := digest.Digest(instance.ReadOnly.Annotations[annotationReferenceDigest])
+					a.attestations[subject] = append(a.attestations[subject], instance.Digest)
+				}
 				continue
 			}
-			platforms = append(platforms, DockerPlatform{
-				OS:           instance.ReadOnly.Platform.OS,
-				Architecture: instance.ReadOnly.Platform.Architecture,
-				Variant:      instance.ReadOnly.Platform.Variant,
-			})
-		}
-		return platforms, nil
-	} else {
-		manifest, err := manifest.FromBlob(manifestText, mediaType)
-		if err != nil {
-			return nil, errors.Wrap(err, "parsing manifest")
-		}
-
-		image, err := manifest.Inspect(func(blobInfo types.BlobInfo) ([]byte, error) {
-			imageNameOnly, err := reference.WithName(imageRef.Name())
-			if err != nil {
-				return nil, errors.Wrap(err, "getting image name")
+			if instance.ReadOnly.ArtifactType != "" {
+				// Signatures and SBOMs stored in the index; the index is an artifact if it holds nothing else.
+				artifactErr = newArtifactError(instance.ReadOnly.ArtifactType)
+				continue
 			}
-			configReference, err := reference.WithDigest(imageNameOnly, manifest.ConfigInfo().Digest)
-			if err != nil {
-				return nil, errors.Wrap(err, "getting config reference")
+			if platform != nil && platform.OS != "" && platform.Architecture != "" && !manifest.MIMETypeIsMultiImage(instance.MediaType) {
+				declared := DockerPlatform{
+					OS:           platform.OS,
+					Architecture: platform.Architecture,
+					Variant:      platform.Variant,
+					OSVersion:    platform.OSVersion,
+					OSFeatures:   JoinOSFeatures(platform.OSFeatures),
+				}
+				if a.verify {
+					err = a.verifyInstance(ctx, imageRef, retriever, instance.Digest, instance.MediaType, declared)
+					if err != nil {
+						return errors.Wrapf(err, "verifying instance %s", instance.Digest)
+					}
+				}
+				a.manifests = append(a.manifests, PlatformManifest{
+					Platform: declared,
+					Digest:   instance.Digest,
+				})
+				continue
 			}
 
-			configText, _, err := retriever.GetManifest(ctx, configReference.String())
+			// Nested indexes and descriptors without a platform are read to find out.
+			err = a.analyzeInstance(ctx, imageRef, retriever, instance.Digest, instance.MediaType, depth)
+			if errors.As(err, &artifactErr) {
+				continue
+			}
 			if err != nil {
-				return nil, errors.Wrap(err, "retrieving config")
+				return errors.Wrapf(err, "analyzing instance %s", instance.Digest)
 			}
-			return configText, nil
+		}
+		if len(a.manifests) == found && artifactErr != nil {
+			return artifactErr
+		}
+		return nil
+	} else {
+		platform, err := inspectImageManifest(ctx, imageRef, retriever, manifestText, mediaType)
+		if err != nil {
+			return err
+		}
+		a.manifests = append(a.manifests, PlatformManifest{
+			Platform: platform,
+			Digest:   manifestDigest,
 		})
+		return nil
+	}
+}
+
+// inspectImageManifest reads the platform of an image manifest from its config.
+// It fails when the config tells no OS or architecture, which no platform list could hold.
+func inspectImageManifest(ctx context.Context, imageRef reference.Named, retriever ManifestRetriever, manifestText []byte, mediaType string) (DockerPlatform, error) {
+	err := classifyArtifact(manifestText, mediaType)
+	if err != nil {
+		return DockerPlatform{}, err
+	}
+
+	manifest, err := manifest.FromBlob(manifestText, mediaType)
+	if err != nil {
+		return DockerPlatform{}, errors.Wrap(err, "parsing manifest")
+	}
+
+	var configText []byte
+	image, err := manifest.Inspect(func(blobInfo types.BlobInfo) ([]byte, error) {
+		configReference, err := withDigest(imageRef, manifest.ConfigInfo().Digest)
+		if err != nil {
+			return nil, errors.Wrap(err, "getting config reference")
+		}
+
+		configText, _, err = retriever.GetManifest(ctx, configReference.String())
+		if err != nil {
+			return nil, errors.Wrap(err, "retrieving config")
+		}
+		return configText, nil
+	})
+	if err != nil {
+		return DockerPlatform{}, errors.Wrap(err, "inspecting manifest")
+	}
+	// ImageInspectInfo lacks the OS version and features, which Windows images set.
+	var config struct {
+		OSVersion  string   `json:"os.version"`
+		OSFeatures []string `json:"os.features"`
+	}
+	if configText != nil {
+		err = json.Unmarshal(configText, &config)
 		if err != nil {
-			return nil, errors.Wrap(err, "inspecting manifest")
+			return DockerPlatform{}, errors.Wrap(err, "parsing config")
 		}
-		return []DockerPlatform{
-			{
-				OS:           image.Os,
-				Architecture: image.Architecture,
-				Variant:      image.Variant,
-			},
-		}, nil
 	}
+	if image.Os == "" || image.Architecture == "" {
+		return DockerPlatform{}, errors.Errorf("config declares no platform: os %q, architecture %q", image.Os, image.Architecture)
+	}
+	return DockerPlatform{
+		OS:           image.Os,
+		Architecture: image.Architecture,
+		Variant:      image.Variant,
+		OSVersion:    config.OSVersion,
+		OSFeatures:   JoinOSFeatures(config.OSFeatures),
+	}, nil
+}
+
+// analyzeInstance retrieves and analyzes a manifest referenced from an index.
+func (a *manifestAnalysis) analyzeInstance(ctx context.Context, imageRef reference.Named, retriever ManifestRetriever, instanceDigest digest.Digest, mediaType string, depth int) error {
+	instanceRef, err := withDigest(imageRef, instanceDigest)
+	if err != nil {
+		return err
+	}
+	manifestText, instanceMediaType, err := retriever.GetManifest(ctx, instanceRef.String())
+	if err != nil {
+		return errors.Wrap(err, "retrieving manifest")
+	}
+	if instanceMediaType == "" {
+		instanceMediaType = mediaType
+	}
+	return a.analyze(ctx, instanceRef, retriever, manifestText, instanceMediaType, instanceDigest, depth+1)
+}
+
+// withDigest returns the reference to another manifest of the repository.
+func withDigest(imageRef reference.Named, d digest.Digest) (reference.Canonical, error) {
+	imageNameOnly, err := reference.WithName(imageRef.Name())
+	if err != nil {
+		return nil, errors.Wrap(err, "getting image name")
+	}
+	ref, err := reference.WithDigest(imageNameOnly, d)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting digest reference")
+	}
+	return ref, nil
 }
@@ -2,7 +2,9 @@ package dockerplatforms_test
 
 import (
 	"context"
+	"errors"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/containers/image/v5/docker/reference"
@@ -35,8 +37,8 @@ func TestAnalyzeManifestIndex(t *testing.T) {
 		dockerplatforms.LinuxMIPS64LE,
 		dockerplatforms.LinuxPPC64LE,
 		dockerplatforms.LinuxS390X,
-		dockerplatforms.WindowsAMD64,
-		dockerplatforms.WindowsAMD64,
+		dockerplatforms.MustParseDockerPlatform("windows(10.0.20348.2529)/amd64"),
+		dockerplatforms.MustParseDockerPlatform("windows(10.0.17763.5936)/amd64"),
 	}); diff != "" {
 		t.Errorf("AnalyzeManifest() (-want +got):\n%s", diff)
 	}
@@ -65,6 +67,26 @@ func TestAnalyzeManifestV2(t *testing.T) {
 	}
 }
 
+func TestAnalyzeManifestNoPlatform(t *testing.T) {
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	retriever := dockerplatformstesting.NewMockManifestRetriever(ctrl)
+	retriever.EXPECT().GetManifest(gomock.Any(), "docker.io/library/app:latest").Return(mustReadFixture(t, "no-platform.json"), "", nil)
+	retriever.EXPECT().GetManifest(gomock.Any(), "docker.io/library/app@sha256:e3a437be6fde2aa8bc763355286302887732015dadcd8374791fa0309eb46e1a").Return(mustReadFixture(t, "no-platform-config-e3a437be6fde2aa8bc763355286302887732015dadcd8374791fa0309eb46e1a.json"), "", nil)
+	imageRef, err := reference.ParseNormalizedNamed("app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = dockerplatforms.AnalyzeManifest(ctx, imageRef, retriever)
+	if err == nil {
+		t.Fatal("AnalyzeManifest() succeeded with a config declaring no platform")
+	}
+	if diff := cmp.Diff(`config declares no platform: os "", architecture ""`, err.Error()); diff != "" {
+		t.Errorf("AnalyzeManifest() error (-want +got):\n%s", diff)
+	}
+}
+
 func TestAnalyzeManifestV1(t *testing.T) {
 	ctx := context.Background()
 	ctrl := gomock.NewController(t)
@@ -87,6 +109,102 @@ func TestAnalyzeManifestV1(t *testing.T) {
 	}
 }
 
+func TestAnalyzeManifestNestedIndex(t *testing.T) {
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	retriever := dockerplatformstesting.NewMockManifestRetriever(ctrl)
+	retriever.EXPECT().GetManifest(gomock.Any(), "docker.io/library/app:latest").Return(mustReadFixture(t, "nested-index.json"), "", nil)
+	for _, fixture := range []string{
+		"nested-index-linux-14415ddfab3e45651c170012198ef59efbb1ba8ab0f2afed0eee960906726532",
+		"nested-index-windows-c5ac615754c6dfdabc488532f6721140c3fa990c3fdaaebf7a06bcfe0af652ab",
+		"nested-index-windows-config-f4b94ddf9d8c26713dadc655c0fb4f013684fec14e0475a267bafee9b385669c",
+		"nested-index-signature-d2822e1487e6f9e9aba0a5d1117060498ce31fbeb756a9c594124cce123f8124",
+	} {
+		digest := fixture[strings.LastIndex(fixture, "-")+1:]
+		retriever.EXPECT().GetManifest(gomock.Any(), "docker.io/library/app@sha256:"+digest).Return(mustReadFixture(t, fixture+".json"), "", nil)
+	}
+	imageRef, err := reference.ParseNormalizedNamed("app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	platforms, err := dockerplatforms.AnalyzeManifest(ctx, imageRef, retriever)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(platforms, []dockerplatforms.DockerPlatform{
+		dockerplatforms.LinuxAMD64,
+		dockerplatforms.LinuxARM64V8,
+		dockerplatforms.MustParseDockerPlatform("windows(10.0.20348.2527)/amd64"),
+	}); diff != "" {
+		t.Errorf("AnalyzeManifest() (-want +got):\n%s", diff)
+	}
+}
+
+func TestAnalyzeManifestArtifact(t *testing.T) {
+	testcases := []struct {
+		fixture  string
+		expected dockerplatforms.ArtifactKind
+	}{
+		{fixture: "helm-chart.json", expected: dockerplatforms.ArtifactHelmChart},
+		{fixture: "wasm-module.json", expected: dockerplatforms.ArtifactWASM},
+		{fixture: "oci-artifact.json", expected: dockerplatforms.ArtifactOther},
+		{fixture: "artifact-index.json", expected: dockerplatforms.ArtifactSignature},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.fixture, func(t *testing.T) {
+			ctx := context.Background()
+			ctrl := gomock.NewController(t)
+			retriever := dockerplatformstesting.NewMockManifestRetriever(ctrl)
+			retriever.EXPECT().GetManifest(gomock.Any(), "docker.io/library/app:latest").Return(mustReadFixture(t, tc.fixture), "", nil)
+			imageRef, err := reference.ParseNormalizedNamed("app:latest")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = dockerplatforms.AnalyzeManifest(ctx, imageRef, retriever)
+			var artifactErr *dockerplatforms.ArtifactError
+			if !errors.As(err, &artifactErr) {
+				t.Fatalf("AnalyzeManifest() error = %v, want an ArtifactError", err)
+			}
+			if diff := cmp.Diff(tc.expected, artifactErr.Kind); diff != "" {
+				t.Errorf("ArtifactError.Kind (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestInspectManifestVerification(t *testing.T) {
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	retriever := dockerplatformstesting.NewMockManifestRetriever(ctrl)
+	retriever.EXPECT().GetManifest(gomock.Any(), "docker.io/library/app:latest").Return(mustReadFixture(t, "mislabeled-index.json"), "", nil)
+	retriever.EXPECT().GetManifest(gomock.Any(), "docker.io/library/app@sha256:3be07b667a868a246b9cee4ddc5ecce2ad1e211958bd6043a25fc1d19d55e6ba").Return(mustReadFixture(t, "golang-1.5.json"), "", nil)
+	retriever.EXPECT().GetManifest(gomock.Any(), "docker.io/library/app@sha256:99668503de157252ba311f570f036490602095f2620c46cb407d3d2dd88aeb6e").Return(mustReadFixture(t, "golang-1.5-99668503de157252ba311f570f036490602095f2620c46cb407d3d2dd88aeb6e.json"), "", nil)
+	retriever.EXPECT().GetManifest(gomock.Any(), "docker.io/library/app@sha256:c5ac615754c6dfdabc488532f6721140c3fa990c3fdaaebf7a06bcfe0af652ab").Return(mustReadFixture(t, "nested-index-windows-c5ac615754c6dfdabc488532f6721140c3fa990c3fdaaebf7a06bcfe0af652ab.json"), "", nil)
+	retriever.EXPECT().GetManifest(gomock.Any(), "docker.io/library/app@sha256:f4b94ddf9d8c26713dadc655c0fb4f013684fec14e0475a267bafee9b385669c").Return(mustReadFixture(t, "nested-index-windows-config-f4b94ddf9d8c26713dadc655c0fb4f013684fec14e0475a267bafee9b385669c.json"), "", nil)
+	imageRef, err := reference.ParseNormalizedNamed("app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := dockerplatforms.InspectManifest(ctx, imageRef, retriever, dockerplatforms.InspectOptions{VerifyPlatforms: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(result.Mismatches, []dockerplatforms.PlatformMismatch{
+		{
+			Digest:   "sha256:3be07b667a868a246b9cee4ddc5ecce2ad1e211958bd6043a25fc1d19d55e6ba",
+			Declared: dockerplatforms.LinuxARM64V8,
+			Actual:   dockerplatforms.LinuxAMD64,
+		},
+	}); diff != "" {
+		t.Errorf("InspectManifest() mismatches (-want +got):\n%s", diff)
+	}
+}
+
 func mustReadFixture(t *testing.T, name string) []byte {
 	t.Helper()
 
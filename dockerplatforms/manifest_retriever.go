@@ -3,8 +3,10 @@ package dockerplatforms
 
 import (
 	"context"
+	"io"
 	"os/exec"
 
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 )
 
@@ -13,6 +15,21 @@ type ManifestRetriever interface {
 	GetManifest(ctx context.Context, image string) ([]byte, string, error)
 }
 
+// ReferrersRetriever is implemented by ManifestRetrievers that can list the manifests referring to another one,
+// as the OCI referrers API does.
+type ReferrersRetriever interface {
+	// GetReferrers returns the descriptors of the manifests whose subject is the image, given by digest.
+	GetReferrers(ctx context.Context, image string) ([]imgspecv1.Descriptor, error)
+}
+
+// BlobRetriever is implemented by ManifestRetrievers that can also read layer blobs,
+// which may be too large to hold in memory as GetManifest does.
+type BlobRetriever interface {
+	// GetBlob opens the blob named by a digest reference.
+	// Reading the blob fails if its content does not match the digest.
+	GetBlob(ctx context.Context, image string) (io.ReadCloser, error)
+}
+
 // ImageTools is a ManifestRetriever backend using `docker buildx imagetools`.
 type ImageTools struct {
 	dockerExecPath string
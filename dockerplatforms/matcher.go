@@ -0,0 +1,123 @@
+package dockerplatforms
+
+import (
+	"slices"
+	"strings"
+)
+
+// Matcher tells if a host runs images of a platform,
+// following the compatibility rules of the platforms package of containerd:
+// https://github.com/containerd/platforms/blob/v0.2.1/compare.go
+type Matcher interface {
+	Match(platform DockerPlatform) bool
+}
+
+// NewMatcher creates a Matcher for images the host runs on its own architecture:
+// the platforms equal to the host once normalized, and the older variants of the architecture,
+// such as linux/arm/v6 on linux/arm/v7 and linux/amd64/v2 on linux/amd64/v3.
+// Windows images only match hosts of the same build; builds are not compared when either side does not tell it.
+func NewMatcher(host DockerPlatform) Matcher {
+	return newMatcher(host, false)
+}
+
+// NewCompatibleMatcher creates a Matcher that also matches the 32-bit platforms the host runs,
+// linux/386 on linux/amd64 and linux/arm on linux/arm64, as containerd's platforms.Only does.
+// Not every arm64 CPU runs 32-bit code, so it is for clusters whose nodes are known to.
+func NewCompatibleMatcher(host DockerPlatform) Matcher {
+	return newMatcher(host, true)
+}
+
+var _ Matcher = matcher{}
+
+type matcher struct {
+	host DockerPlatform
+	// runs are the platforms the host runs, normalized and without the OS version and features.
+	runs []DockerPlatform
+}
+
+// amd64Levels and armVariants are the variants of the architectures, from the oldest,
+// each running the ones before it.
+var (
+	amd64Levels = []string{"", "v2", "v3", "v4"}
+	armVariants = []string{"v5", "v6", "v7", "v8"}
+)
+
+func newMatcher(host DockerPlatform, compatible bool) matcher {
+	host = host.Normalize()
+	m := matcher{host: host}
+	add := func(architecture string, variants ...string) {
+		for _, variant := range variants {
+			m.runs = append(m.runs, DockerPlatform{OS: host.OS, Architecture: architecture, Variant: variant})
+		}
+	}
+	add(host.Architecture, host.Variant)
+	switch host.Architecture {
+	case "amd64":
+		if i := slices.Index(amd64Levels, host.Variant); i >= 0 {
+			add("amd64", amd64Levels[:i]...)
+		}
+		if compatible {
+			add("386", "")
+		}
+	case "arm":
+		if i := slices.Index(armVariants, host.Variant); i >= 0 {
+			add("arm", armVariants[:i]...)
+		}
+	case "arm64":
+		if compatible && host.Variant == "" {
+			add("arm", armVariants...)
+		}
+	}
+	return m
+}
+
+// Match implements Matcher.
+func (m matcher) Match(platform DockerPlatform) bool {
+	platform = platform.Normalize()
+	hostBuild, build := m.host.WindowsBuild(), platform.WindowsBuild()
+	if hostBuild != "" && build != "" && hostBuild != build {
+		return false
+	}
+	return slices.Contains(m.runs, DockerPlatform{OS: platform.OS, Architecture: platform.Architecture, Variant: platform.Variant})
+}
+
+// Normalize returns the platform spelled as containerd normalizes it:
+// aliases such as x86_64 and aarch64 become the GOARCH names,
+// linux/amd64/v1 becomes linux/amd64, linux/arm64/v8 becomes linux/arm64, and linux/arm becomes linux/arm/v7.
+// Wildcards are left as they are.
+func (p DockerPlatform) Normalize() DockerPlatform {
+	p.OS = strings.ToLower(p.OS)
+	if p.OS == "macos" {
+		p.OS = "darwin"
+	}
+	switch strings.ToLower(p.Architecture) {
+	case "i386":
+		p.Architecture = "386"
+		p.Variant = ""
+	case "x86_64", "x86-64", "amd64":
+		p.Architecture = "amd64"
+		if p.Variant == "v1" {
+			p.Variant = ""
+		}
+	case "aarch64", "arm64":
+		p.Architecture = "arm64"
+		switch p.Variant {
+		case "8", "v8":
+			p.Variant = ""
+		}
+	case "armhf":
+		p.Architecture = "arm"
+		p.Variant = "v7"
+	case "armel":
+		p.Architecture = "arm"
+		p.Variant = "v6"
+	case "arm":
+		switch p.Variant {
+		case "", "7":
+			p.Variant = "v7"
+		case "5", "6", "8":
+			p.Variant = "v" + p.Variant
+		}
+	}
+	return p
+}
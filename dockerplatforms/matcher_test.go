@@ -0,0 +1,72 @@
+package dockerplatforms_test
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+)
+
+func TestDockerPlatformNormalize(t *testing.T) {
+	testcases := []struct {
+		input    string
+		expected string
+	}{
+		{input: "linux/amd64", expected: "linux/amd64"},
+		{input: "linux/amd64/v1", expected: "linux/amd64"},
+		{input: "linux/x86_64/v3", expected: "linux/amd64/v3"},
+		{input: "linux/arm64/v8", expected: "linux/arm64"},
+		{input: "linux/aarch64", expected: "linux/arm64"},
+		{input: "linux/arm", expected: "linux/arm/v7"},
+		{input: "linux/arm/6", expected: "linux/arm/v6"},
+		{input: "linux/armhf", expected: "linux/arm/v7"},
+		{input: "linux/i386", expected: "linux/386"},
+		{input: "Windows(10.0.20348.2529)/AMD64", expected: "windows(10.0.20348.2529)/amd64"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.input, func(t *testing.T) {
+			got := dockerplatforms.MustParseDockerPlatform(tc.input).Normalize()
+			if diff := cmp.Diff(tc.expected, got.String()); diff != "" {
+				t.Errorf("Normalize() (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	testcases := []struct {
+		host       string
+		platform   string
+		strict     bool
+		compatible bool
+	}{
+		{host: "linux/arm64", platform: "linux/arm64/v8", strict: true, compatible: true},
+		{host: "linux/arm64/v8", platform: "linux/arm64", strict: true, compatible: true},
+		{host: "linux/arm64", platform: "linux/arm/v7", strict: false, compatible: true},
+		{host: "linux/arm64", platform: "linux/amd64", strict: false, compatible: false},
+		{host: "linux/arm/v7", platform: "linux/arm/v6", strict: true, compatible: true},
+		{host: "linux/arm/v6", platform: "linux/arm/v7", strict: false, compatible: false},
+		{host: "linux/arm", platform: "linux/arm/v7", strict: true, compatible: true},
+		{host: "linux/amd64", platform: "linux/amd64/v1", strict: true, compatible: true},
+		{host: "linux/amd64", platform: "linux/amd64/v3", strict: false, compatible: false},
+		{host: "linux/amd64/v3", platform: "linux/amd64/v2", strict: true, compatible: true},
+		{host: "linux/amd64/v3", platform: "linux/amd64", strict: true, compatible: true},
+		{host: "linux/amd64", platform: "linux/386", strict: false, compatible: true},
+		{host: "windows/amd64", platform: "linux/amd64", strict: false, compatible: false},
+		{host: "windows(10.0.20348)/amd64", platform: "windows(10.0.20348.2529)+win32k/amd64", strict: true, compatible: true},
+		{host: "windows(10.0.17763)/amd64", platform: "windows(10.0.20348.2529)/amd64", strict: false, compatible: false},
+		{host: "windows/amd64", platform: "windows(10.0.20348.2529)/amd64", strict: true, compatible: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.host+" runs "+tc.platform, func(t *testing.T) {
+			host := dockerplatforms.MustParseDockerPlatform(tc.host)
+			platform := dockerplatforms.MustParseDockerPlatform(tc.platform)
+			if diff := cmp.Diff(tc.strict, dockerplatforms.NewMatcher(host).Match(platform)); diff != "" {
+				t.Errorf("NewMatcher().Match() (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.compatible, dockerplatforms.NewCompatibleMatcher(host).Match(platform)); diff != "" {
+				t.Errorf("NewCompatibleMatcher().Match() (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package dockerplatforms
+
+import (
+	"context"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// NewMemoryCache creates a Cache that keeps the entries in memory for the lifetime of the process, with DefaultExpiryPolicy.
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		ExpiryPolicy: DefaultExpiryPolicy(),
+		data:         make(map[string]imageData),
+	}
+}
+
+var _ Cache = &MemoryCache{}
+
+// MemoryCache is a Cache kept in memory, as the fastest layer of a LayeredCache. It is safe for concurrent use.
+// It is meant to live no longer than a run, but its entries still expire as the ExpiryPolicy tells,
+// so that errors are retried as soon as in the other caches.
+type MemoryCache struct {
+	ExpiryPolicy
+
+	mu   sync.Mutex
+	data map[string]imageData
+}
+
+// GetCachedPlatforms implements Cache.
+func (c *MemoryCache) GetCachedPlatforms(ctx context.Context, image string) ([]DockerPlatform, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	imageData, ok := c.get(image)
+	if !ok {
+		return nil, false, nil
+	}
+
+	if imageData.Error != "" {
+		return nil, false, imageData.err()
+	}
+	if imageData.Digest != "" {
+		// Tag index entries hold no platforms.
+		return nil, false, nil
+	}
+
+	return imageData.Platforms, true, nil
+}
+
+// SetCachedPlatforms implements Cache.
+func (c *MemoryCache) SetCachedPlatforms(ctx context.Context, image string, platforms []DockerPlatform) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.data[image] = imageData{
+		Platforms: platforms,
+		FetchedAt: fetchTime(),
+	}
+	return nil
+}
+
+// ClearCachedPlatforms implements Cache.
+func (c *MemoryCache) ClearCachedPlatforms(ctx context.Context, image string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.data, image)
+	return nil
+}
+
+// GetCachedDigest implements Cache.
+func (c *MemoryCache) GetCachedDigest(ctx context.Context, image string) (digest.Digest, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	imageData, ok := c.get(image)
+	if !ok {
+		return "", false, nil
+	}
+
+	if imageData.Error != "" {
+		return "", false, imageData.err()
+	}
+
+	return imageData.Digest, imageData.Digest != "", nil
+}
+
+// SetCachedDigest implements Cache.
+func (c *MemoryCache) SetCachedDigest(ctx context.Context, image string, d digest.Digest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.data[image] = imageData{
+		Digest:    d,
+		FetchedAt: fetchTime(),
+	}
+	return nil
+}
+
+// SetErrorCache implements Cache.
+func (c *MemoryCache) SetErrorCache(ctx context.Context, image string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, ok := c.errorData(err)
+	if !ok {
+		delete(c.data, image)
+		return
+	}
+	c.data[image] = data
+}
+
+// get looks up the entry of the image, unless it has expired. The caller must hold c.mu.
+func (c *MemoryCache) get(image string) (imageData, bool) {
+	imageData, ok := c.data[image]
+	return imageData, ok && c.fresh(image, imageData)
+}
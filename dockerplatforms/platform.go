@@ -3,6 +3,7 @@ package dockerplatforms
 import (
 	"encoding/json"
 	"fmt"
+	"slices"
 	"strings"
 
 	"gopkg.in/yaml.v3"
@@ -54,6 +55,15 @@ type DockerPlatform struct {
 	// - */arm/v8
 	// - */arm64/v8
 	Variant string
+	// OSVersion specifies the version of the operating system the image is built for.
+	// It matters for Windows, where the build of the host and the image must agree,
+	// e.g. 10.0.17763.5936 for ltsc2019 and 10.0.20348.2529 for ltsc2022.
+	// When not used, the value is empty.
+	OSVersion string
+	// OSFeatures lists the features of the operating system the image requires, such as win32k.
+	// The features are sorted and joined with "+" so that DockerPlatform stays comparable.
+	// When not used, the value is empty.
+	OSFeatures string
 }
 
 var _ json.Unmarshaler = &DockerPlatform{}
@@ -61,11 +71,21 @@ var _ json.Marshaler = &DockerPlatform{}
 var _ yaml.Unmarshaler = &DockerPlatform{}
 var _ yaml.Marshaler = &DockerPlatform{}
 
+// String formats the platform as os/arch or os/arch/variant.
+// The OS version follows the OS in parentheses, as containerd does,
+// and each OS feature follows with a "+", e.g. windows(10.0.17763.5936)+win32k/amd64.
 func (p DockerPlatform) String() string {
+	os := p.OS
+	if p.OSVersion != "" {
+		os += "(" + p.OSVersion + ")"
+	}
+	if p.OSFeatures != "" {
+		os += "+" + p.OSFeatures
+	}
 	if p.Variant != "" {
-		return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+		return fmt.Sprintf("%s/%s/%s", os, p.Architecture, p.Variant)
 	}
-	return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+	return fmt.Sprintf("%s/%s", os, p.Architecture)
 }
 
 func ParseDockerPlatform(platform string) (DockerPlatform, error) {
@@ -77,9 +97,21 @@ func ParseDockerPlatform(platform string) (DockerPlatform, error) {
 	if len(parts) > 3 {
 		return DockerPlatform{}, fmt.Errorf("invalid platform: too many parts: %s", platform)
 	}
+	os, features, _ := strings.Cut(parts[0], "+")
 	result := DockerPlatform{
-		OS:           parts[0],
+		OS:           os,
 		Architecture: parts[1],
+		OSFeatures:   JoinOSFeatures(strings.Split(features, "+")),
+	}
+	if name, version, ok := strings.Cut(os, "("); ok {
+		version, ok = strings.CutSuffix(version, ")")
+		if !ok || version == "" || strings.ContainsAny(version, "()") {
+			return DockerPlatform{}, fmt.Errorf("invalid platform: malformed OS version: %s", platform)
+		}
+		result.OS = name
+		result.OSVersion = version
+	} else if strings.Contains(os, ")") {
+		return DockerPlatform{}, fmt.Errorf("invalid platform: malformed OS version: %s", platform)
 	}
 	if len(parts) >= 3 {
 		result.Variant = parts[2]
@@ -87,6 +119,73 @@ func ParseDockerPlatform(platform string) (DockerPlatform, error) {
 	return result, nil
 }
 
+// validatePattern checks a platform or pattern given by users, which ParseDockerPlatform accepts
+// with empty parts or partial wildcards so as to read back whatever images declare.
+func (p DockerPlatform) validatePattern() error {
+	for _, part := range []string{p.OS, p.Architecture, p.Variant} {
+		if part != Wildcard && strings.Contains(part, Wildcard) {
+			return fmt.Errorf("invalid platform: wildcard not standing for a whole part: %s", p)
+		}
+	}
+	if p.OS == "" || p.Architecture == "" {
+		return fmt.Errorf("invalid platform: empty part: %s", p)
+	}
+	return nil
+}
+
+// Wildcard stands for any OS, architecture or variant in platform patterns, such as linux/* and */arm64.
+const Wildcard = "*"
+
+// IsPattern tells if the platform has a wildcard, standing for several platforms.
+func (p DockerPlatform) IsPattern() bool {
+	return p.OS == Wildcard || p.Architecture == Wildcard || p.Variant == Wildcard
+}
+
+// Includes tells if the platform, once normalized, is the same as p or one the pattern p stands for.
+// A wildcard architecture stands for its variants as well, and patterns telling no OS version or features
+// stand for any, so that windows/* includes windows(10.0.20348.2529)/amd64.
+func (p DockerPlatform) Includes(platform DockerPlatform) bool {
+	pattern := p.IsPattern()
+	p, platform = p.Normalize(), platform.Normalize()
+	if p.OS != Wildcard && p.OS != platform.OS {
+		return false
+	}
+	if p.Architecture != Wildcard && p.Architecture != platform.Architecture {
+		return false
+	}
+	anyVariant := p.Variant == Wildcard || (p.Architecture == Wildcard && p.Variant == "")
+	if !anyVariant && p.Variant != platform.Variant {
+		return false
+	}
+	if pattern {
+		return (p.OSVersion == "" || p.OSVersion == platform.OSVersion) && (p.OSFeatures == "" || p.OSFeatures == platform.OSFeatures)
+	}
+	return p.OSVersion == platform.OSVersion && p.OSFeatures == platform.OSFeatures
+}
+
+// JoinOSFeatures formats OS features for DockerPlatform.OSFeatures.
+func JoinOSFeatures(features []string) string {
+	features = slices.DeleteFunc(slices.Clone(features), func(feature string) bool {
+		return feature == ""
+	})
+	slices.Sort(features)
+	return strings.Join(slices.Compact(features), "+")
+}
+
+// WindowsBuild returns the major, minor and build numbers of the OS version of a Windows platform,
+// as the node.kubernetes.io/windows-build label of nodes tells them.
+// It returns an empty string for other platforms or when the version is unknown.
+func (p DockerPlatform) WindowsBuild() string {
+	if p.OS != "windows" || p.OSVersion == "" {
+		return ""
+	}
+	components := strings.Split(p.OSVersion, ".")
+	if len(components) > 3 {
+		components = components[:3]
+	}
+	return strings.Join(components, ".")
+}
+
 func (p DockerPlatform) MarshalJSON() ([]byte, error) {
 	return json.Marshal(p.String())
 }
@@ -141,6 +240,16 @@ func (p DockerPlatform) Cmp(other DockerPlatform) int {
 	} else if p.Variant > other.Variant {
 		return 1
 	}
+	if p.OSVersion < other.OSVersion {
+		return -1
+	} else if p.OSVersion > other.OSVersion {
+		return 1
+	}
+	if p.OSFeatures < other.OSFeatures {
+		return -1
+	} else if p.OSFeatures > other.OSFeatures {
+		return 1
+	}
 	return 0
 }
 
@@ -2,6 +2,7 @@ package dockerplatforms
 
 import (
 	"encoding/json"
+	"fmt"
 	"slices"
 	"strings"
 
@@ -34,13 +35,32 @@ func ParseDockerPlatformList(s string) (DockerPlatformList, error) {
 		platformText = strings.TrimSpace(platformText)
 		platform, err := ParseDockerPlatform(platformText)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("element %d of the platform list: %w", i+1, err)
 		}
 		platforms[i] = platform
 	}
 	return platforms, nil
 }
 
+// ParseDockerPlatformPatterns parses a list of platforms and platform patterns given by users, such as linux/*,
+// normalizing the platforms as containerd does so that aliases such as aarch64, x86_64 and armhf are accepted.
+// Unlike ParseDockerPlatformList, which keeps the platforms as they are spelled to read back the platforms of images,
+// it rejects platforms with empty parts and wildcards not standing for a whole part.
+func ParseDockerPlatformPatterns(s string) (DockerPlatformList, error) {
+	platforms, err := ParseDockerPlatformList(s)
+	if err != nil {
+		return nil, err
+	}
+	for i, platform := range platforms {
+		err := platform.validatePattern()
+		if err != nil {
+			return nil, fmt.Errorf("element %d of the platform list: %w", i+1, err)
+		}
+		platforms[i] = platform.Normalize()
+	}
+	return platforms.Normalized(), nil
+}
+
 func (p DockerPlatformList) MarshalJSON() ([]byte, error) {
 	return json.Marshal(p.String())
 }
@@ -106,19 +126,52 @@ func (p DockerPlatformList) Variantless() DockerPlatformList {
 	return variantless.Normalized()
 }
 
+// Includes tells if every platform of other is in p, or included by a platform or pattern of p as DockerPlatform.Includes tells.
 func (p DockerPlatformList) Includes(other DockerPlatformList) bool {
 	pMap := make(map[DockerPlatform]struct{})
 	for _, platform := range p {
 		pMap[platform] = struct{}{}
 	}
 	for _, platform := range other {
-		if _, ok := pMap[platform]; !ok {
+		if _, ok := pMap[platform]; ok {
+			continue
+		}
+		if !slices.ContainsFunc(p, func(q DockerPlatform) bool { return q.Includes(platform) }) {
 			return false
 		}
 	}
 	return true
 }
 
+// HasPattern tells if a platform of the list is a pattern.
+func (p DockerPlatformList) HasPattern() bool {
+	return slices.ContainsFunc(p, DockerPlatform.IsPattern)
+}
+
+// Expand replaces the patterns of the list with the platforms they include among platforms,
+// e.g. to turn linux/* into the linux platforms of the nodes of a cluster.
+// It fails when a pattern includes none of them, as it would silently stand for nothing.
+func (p DockerPlatformList) Expand(platforms DockerPlatformList) (DockerPlatformList, error) {
+	expanded := make(DockerPlatformList, 0, len(p))
+	for _, pattern := range p {
+		if !pattern.IsPattern() {
+			expanded = append(expanded, pattern)
+			continue
+		}
+		matched := false
+		for _, platform := range platforms {
+			if pattern.Includes(platform) {
+				expanded = append(expanded, platform)
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no platform matches %s among %s", pattern, platforms)
+		}
+	}
+	return expanded.Normalized(), nil
+}
+
 func (p DockerPlatformList) Intersection(other DockerPlatformList) DockerPlatformList {
 	otherMap := make(map[DockerPlatform]struct{})
 	for _, platform := range other {
@@ -133,6 +186,29 @@ func (p DockerPlatformList) Intersection(other DockerPlatformList) DockerPlatfor
 	return newList
 }
 
+// IncludesMatching is like Includes, but compares platforms with matchers instead of equality:
+// it tells if each of the hosts runs one of the image platforms p, by the matcher newMatcher creates for it.
+func (p DockerPlatformList) IncludesMatching(hosts DockerPlatformList, newMatcher func(host DockerPlatform) Matcher) bool {
+	for _, host := range hosts {
+		if !slices.ContainsFunc(p, newMatcher(host).Match) {
+			return false
+		}
+	}
+	return true
+}
+
+// IntersectionMatching is like Intersection, but compares platforms with matchers instead of equality:
+// it returns the hosts running one of the image platforms p, by the matcher newMatcher creates for each.
+func (p DockerPlatformList) IntersectionMatching(hosts DockerPlatformList, newMatcher func(host DockerPlatform) Matcher) DockerPlatformList {
+	newList := make(DockerPlatformList, 0, len(hosts))
+	for _, host := range hosts {
+		if slices.ContainsFunc(p, newMatcher(host).Match) {
+			newList = append(newList, host)
+		}
+	}
+	return newList
+}
+
 func MustParseDockerPlatformList(s string) DockerPlatformList {
 	platforms, err := ParseDockerPlatformList(s)
 	if err != nil {
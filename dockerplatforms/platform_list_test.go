@@ -53,6 +53,25 @@ func TestDockerPlatformListString(t *testing.T) {
 			json:   `"linux/arm64, linux/arm/v7"`,
 			yaml:   "linux/arm64, linux/arm/v7\n",
 		},
+		{
+			name: "Windows entries",
+			platforms: dockerplatforms.DockerPlatformList{
+				{
+					OS:           "windows",
+					Architecture: "amd64",
+					OSVersion:    "10.0.17763.5936",
+				},
+				{
+					OS:           "windows",
+					Architecture: "amd64",
+					OSVersion:    "10.0.20348.2529",
+					OSFeatures:   "win32k",
+				},
+			},
+			string: "windows(10.0.17763.5936)/amd64, windows(10.0.20348.2529)+win32k/amd64",
+			json:   `"windows(10.0.17763.5936)/amd64, windows(10.0.20348.2529)+win32k/amd64"`,
+			yaml:   "windows(10.0.17763.5936)/amd64, windows(10.0.20348.2529)+win32k/amd64\n",
+		},
 	}
 
 	for _, tc := range testcases {
@@ -348,3 +367,98 @@ func TestDockerPlatformListIncludes(t *testing.T) {
 		})
 	}
 }
+
+func TestDockerPlatformListMatching(t *testing.T) {
+	images := dockerplatforms.MustParseDockerPlatformList("linux/amd64/v3, linux/arm64/v8, linux/arm/v7")
+	hosts := dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/amd64/v3, linux/arm64, linux/arm/v6")
+
+	if diff := cmp.Diff(
+		dockerplatforms.MustParseDockerPlatformList("linux/amd64/v3, linux/arm64"),
+		images.IntersectionMatching(hosts, dockerplatforms.NewMatcher),
+	); diff != "" {
+		t.Errorf("IntersectionMatching() (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(false, images.IncludesMatching(hosts, dockerplatforms.NewMatcher)); diff != "" {
+		t.Errorf("IncludesMatching() (-want +got):\n%s", diff)
+	}
+	// linux/arm64/v8 images run on linux/arm64 hosts, and older x86-64 levels on newer ones.
+	if diff := cmp.Diff(true, images.IncludesMatching(dockerplatforms.MustParseDockerPlatformList("linux/amd64/v4, linux/arm64"), dockerplatforms.NewMatcher)); diff != "" {
+		t.Errorf("IncludesMatching() (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(true, dockerplatforms.MustParseDockerPlatformList("linux/arm64").IncludesMatching(dockerplatforms.MustParseDockerPlatformList("linux/arm64/v8"), dockerplatforms.NewMatcher)); diff != "" {
+		t.Errorf("IncludesMatching() (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseDockerPlatformPatterns(t *testing.T) {
+	platforms, err := dockerplatforms.ParseDockerPlatformPatterns("linux/aarch64, linux/x86_64, linux/armhf, linux/arm64/v8, linux/*, */arm64, linux/arm/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("*/arm64, linux/*, linux/amd64, linux/arm/*, linux/arm/v7, linux/arm64", platforms.String()); diff != "" {
+		t.Errorf("ParseDockerPlatformPatterns() (-want +got):\n%s", diff)
+	}
+
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{input: "linux/amd64, linux", expected: "element 2 of the platform list: invalid platform: too few parts: linux"},
+		{input: "linux/amd64, linux/arm*", expected: "element 2 of the platform list: invalid platform: wildcard not standing for a whole part: linux/arm*"},
+		{input: "linux/amd64,,linux/arm64", expected: "element 2 of the platform list: invalid platform: too few parts: "},
+		{input: "/amd64", expected: "element 1 of the platform list: invalid platform: empty part: /amd64"},
+	} {
+		_, err := dockerplatforms.ParseDockerPlatformPatterns(tc.input)
+		if err == nil {
+			t.Errorf("ParseDockerPlatformPatterns(%q): expected an error", tc.input)
+			continue
+		}
+		if diff := cmp.Diff(tc.expected, err.Error()); diff != "" {
+			t.Errorf("ParseDockerPlatformPatterns(%q) error (-want +got):\n%s", tc.input, diff)
+		}
+	}
+}
+
+func TestDockerPlatformListIncludesPatterns(t *testing.T) {
+	testcases := []struct {
+		patterns string
+		other    string
+		expected bool
+	}{
+		{patterns: "linux/*", other: "linux/amd64, linux/arm/v7, linux/arm64/v8", expected: true},
+		{patterns: "linux/*", other: "linux/amd64, windows/amd64", expected: false},
+		{patterns: "*/arm64", other: "linux/arm64/v8, windows/arm64", expected: true},
+		{patterns: "*/arm64", other: "linux/arm/v7", expected: false},
+		{patterns: "linux/arm/*", other: "linux/arm/v6, linux/arm", expected: true},
+		{patterns: "windows/*", other: "windows(10.0.20348.2529)/amd64", expected: true},
+		{patterns: "linux/arm64/v8", other: "linux/arm64", expected: true},
+		{patterns: "linux/amd64", other: "linux/amd64/v2", expected: false},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.patterns+" includes "+tc.other, func(t *testing.T) {
+			patterns := dockerplatforms.MustParseDockerPlatformList(tc.patterns)
+			if diff := cmp.Diff(tc.expected, patterns.Includes(dockerplatforms.MustParseDockerPlatformList(tc.other))); diff != "" {
+				t.Errorf("Includes() (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDockerPlatformListExpand(t *testing.T) {
+	patterns := dockerplatforms.MustParseDockerPlatformList("*/arm64, linux/s390x")
+	expanded, err := patterns.Expand(dockerplatforms.MustParseDockerPlatformList("linux/amd64/v3, linux/arm64, windows(10.0.20348)/arm64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("linux/arm64, linux/s390x, windows(10.0.20348)/arm64", expanded.String()); diff != "" {
+		t.Errorf("Expand() (-want +got):\n%s", diff)
+	}
+
+	_, err = dockerplatforms.MustParseDockerPlatformList("linux/*, windows/*").Expand(dockerplatforms.MustParseDockerPlatformList("linux/amd64"))
+	if err == nil {
+		t.Fatal("Expand() succeeded with a pattern matching nothing")
+	}
+	if diff := cmp.Diff("no platform matches windows/* among linux/amd64", err.Error()); diff != "" {
+		t.Errorf("Expand() error (-want +got):\n%s", diff)
+	}
+}
@@ -48,6 +48,18 @@ func TestDockerPlatformString(t *testing.T) {
 			json:   `"linux/arm/v7"`,
 			yaml:   "linux/arm/v7\n",
 		},
+		{
+			name: "windows/amd64 with OS version and features",
+			platform: dockerplatforms.DockerPlatform{
+				OS:           "windows",
+				Architecture: "amd64",
+				OSVersion:    "10.0.17763.5936",
+				OSFeatures:   "win32k",
+			},
+			string: "windows(10.0.17763.5936)+win32k/amd64",
+			json:   `"windows(10.0.17763.5936)+win32k/amd64"`,
+			yaml:   "windows(10.0.17763.5936)+win32k/amd64\n",
+		},
 	}
 
 	for _, tc := range testcases {
@@ -115,6 +127,24 @@ func TestParseDockerPlatform(t *testing.T) {
 				Variant:      "v7",
 			},
 		},
+		{
+			name:   "Parse String windows with OS version",
+			string: "windows(10.0.20348.2529)/amd64",
+			expected: dockerplatforms.DockerPlatform{
+				OS:           "windows",
+				Architecture: "amd64",
+				OSVersion:    "10.0.20348.2529",
+			},
+		},
+		{
+			name:   "Parse String OS features",
+			string: "windows+win32k+a/amd64",
+			expected: dockerplatforms.DockerPlatform{
+				OS:           "windows",
+				Architecture: "amd64",
+				OSFeatures:   "a+win32k",
+			},
+		},
 		{
 			name: "Parse JSON linux/amd64",
 			json: `"linux/amd64"`,
@@ -156,6 +186,16 @@ func TestParseDockerPlatform(t *testing.T) {
 				Architecture: "arm64",
 			},
 		},
+		{
+			name: "Parse YAML windows with OS version and features",
+			yaml: "windows(10.0.17763.5936)+win32k/amd64",
+			expected: dockerplatforms.DockerPlatform{
+				OS:           "windows",
+				Architecture: "amd64",
+				OSVersion:    "10.0.17763.5936",
+				OSFeatures:   "win32k",
+			},
+		},
 		{
 			name: "Parse YAML linux/arm/v7",
 			yaml: "linux/arm/v7",
@@ -190,6 +230,33 @@ func TestParseDockerPlatform(t *testing.T) {
 	}
 }
 
+func TestParseDockerPlatformMalformedOSVersion(t *testing.T) {
+	for _, platform := range []string{"windows(/amd64", "windows()/amd64", "windows)/amd64", "windows(1)(2)/amd64"} {
+		_, err := dockerplatforms.ParseDockerPlatform(platform)
+		if err == nil {
+			t.Errorf("ParseDockerPlatform(%q) succeeded unexpectedly", platform)
+		}
+	}
+}
+
+func TestDockerPlatformWindowsBuild(t *testing.T) {
+	testcases := []struct {
+		platform string
+		expected string
+	}{
+		{platform: "windows(10.0.20348.2529)/amd64", expected: "10.0.20348"},
+		{platform: "windows(10.0.17763)/amd64", expected: "10.0.17763"},
+		{platform: "windows/amd64", expected: ""},
+		{platform: "linux/amd64", expected: ""},
+	}
+	for _, tc := range testcases {
+		build := dockerplatforms.MustParseDockerPlatform(tc.platform).WindowsBuild()
+		if diff := cmp.Diff(tc.expected, build); diff != "" {
+			t.Errorf("WindowsBuild() of %s (-want +got):\n%s", tc.platform, diff)
+		}
+	}
+}
+
 func TestDockerPlatformVariantless(t *testing.T) {
 	testcases := []struct {
 		name     string
@@ -0,0 +1,182 @@
+package dockerplatforms
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/pkg/sysregistriesv2"
+	"github.com/containers/image/v5/pkg/tlsclientconfig"
+	"github.com/containers/image/v5/types"
+	"github.com/pkg/errors"
+)
+
+// RegistriesConfig describes how registries are reached, in the format of containers-registries.conf(5):
+// mirrors tried in order before the registry itself, prefix rewrites, unqualified-search registries
+// and insecure registries. Custom CA bundles and client certificates are read from certs.d directories
+// as described in containers-certs.d(5).
+type RegistriesConfig struct {
+	// CertDirs are searched for a subdirectory named after the registry host,
+	// holding *.crt CA bundles and *.cert/*.key client certificates.
+	CertDirs []string
+
+	sys *types.SystemContext
+}
+
+// LoadRegistriesConfig reads a registries.conf file.
+// When path is empty, the system configuration is used, which may not exist.
+func LoadRegistriesConfig(path string) (*RegistriesConfig, error) {
+	config := &RegistriesConfig{
+		CertDirs: defaultCertDirs(),
+		sys:      &types.SystemContext{SystemRegistriesConfPath: path},
+	}
+	_, err := sysregistriesv2.GetRegistries(config.sys)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading registries configuration")
+	}
+	return config, nil
+}
+
+func defaultCertDirs() []string {
+	dirs := []string{"/etc/containers/certs.d", "/etc/docker/certs.d"}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append([]string{filepath.Join(home, ".config", "containers", "certs.d")}, dirs...)
+	}
+	return dirs
+}
+
+// pullSource is a location to try for an image.
+type pullSource struct {
+	named    reference.Named
+	insecure bool
+}
+
+// pullSources returns the locations to try for the reference, in order.
+// Short names are expanded with the unqualified-search registries first.
+func (c *RegistriesConfig) pullSources(ctx context.Context, named reference.Named) ([]pullSource, error) {
+	if c == nil {
+		return []pullSource{{named: named}}, nil
+	}
+
+	candidates := []reference.Named{named}
+	if isShortNameContext(ctx) {
+		search, err := sysregistriesv2.UnqualifiedSearchRegistries(c.sys)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading unqualified-search registries")
+		}
+		if len(search) > 0 {
+			candidates = nil
+		}
+		for _, registry := range search {
+			candidate, err := reference.ParseNormalizedNamed(registry + "/" + reference.FamiliarString(named))
+			if err != nil {
+				return nil, errors.Wrapf(err, "qualifying %s with %s", reference.FamiliarString(named), registry)
+			}
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	var sources []pullSource
+	for _, candidate := range candidates {
+		registry, err := sysregistriesv2.FindRegistry(c.sys, candidate.String())
+		if err != nil {
+			return nil, errors.Wrap(err, "looking up registry configuration")
+		}
+		if registry == nil {
+			sources = append(sources, pullSource{named: candidate})
+			continue
+		}
+		if registry.Blocked {
+			return nil, errors.Errorf("registry %s is blocked in the registries configuration", registry.Prefix)
+		}
+		registrySources, err := registry.PullSourcesFromReference(candidate)
+		if err != nil {
+			return nil, errors.Wrap(err, "rewriting reference")
+		}
+		for _, source := range registrySources {
+			sources = append(sources, pullSource{named: source.Reference, insecure: source.Endpoint.Insecure})
+		}
+	}
+	return sources, nil
+}
+
+// httpClient derives a client for the host from base, trusting the host's certs.d bundles,
+// or skipping verification altogether for insecure registries.
+// base is returned as is when there is nothing to configure.
+func (c *RegistriesConfig) httpClient(base *http.Client, host string, insecure bool) (*http.Client, error) {
+	if c == nil {
+		return base, nil
+	}
+	baseTransport := base.Transport
+	if baseTransport == nil {
+		baseTransport = http.DefaultTransport
+	}
+	transport, ok := baseTransport.(*http.Transport)
+	if !ok {
+		return base, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	configured := insecure
+	for _, dir := range c.CertDirs {
+		certDir := filepath.Join(dir, host)
+		if _, err := os.Stat(certDir); err != nil {
+			continue
+		}
+		err := tlsclientconfig.SetupCertificates(certDir, tlsConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "loading certificates from %s", certDir)
+		}
+		configured = true
+	}
+	if !configured {
+		return base, nil
+	}
+	tlsConfig.InsecureSkipVerify = insecure
+
+	transport = transport.Clone()
+	transport.TLSClientConfig = tlsConfig
+	client := *base
+	client.Transport = transport
+	return &client, nil
+}
+
+// searchesShortNames tells if short names may resolve to other registries than docker.io,
+// through the unqualified-search registries.
+func (c *RegistriesConfig) searchesShortNames() bool {
+	if c == nil {
+		return false
+	}
+	search, err := sysregistriesv2.UnqualifiedSearchRegistries(c.sys)
+	return err != nil || len(search) > 0
+}
+
+type shortNameKey struct{}
+
+// withShortName marks the context as looking up an image that was given without a registry,
+// so that the unqualified-search registries apply to it.
+func withShortName(ctx context.Context) context.Context {
+	return context.WithValue(ctx, shortNameKey{}, true)
+}
+
+func isShortNameContext(ctx context.Context) bool {
+	short, _ := ctx.Value(shortNameKey{}).(bool)
+	return short
+}
+
+// IsShortName tells if the image reference has no registry part, following the rules of reference.ParseNormalizedNamed.
+// Under unqualified-search registries, a short name may name another image than its docker.io name.
+func IsShortName(image string) bool {
+	first, _, ok := strings.Cut(image, "/")
+	if !ok {
+		return true
+	}
+	return !strings.ContainsAny(first, ".:") && first != "localhost" && strings.ToLower(first) == first
+}
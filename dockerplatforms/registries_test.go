@@ -0,0 +1,195 @@
+package dockerplatforms_test
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+)
+
+func TestRegistriesMirror(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.addManifest("mirror/library/golang", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	client := registry.client()
+	client.Registries = loadRegistriesConfig(t, `
+[[registry]]
+location = "docker.io"
+
+[[registry.mirror]]
+location = "`+registry.host+`/missing"
+
+[[registry.mirror]]
+location = "`+registry.host+`/mirror"
+`)
+	env, cache, err := setupEmptyYAML(ctx, "TestRegistriesMirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+
+	platforms, err := dockerplatforms.New(client, cache).GetPlatforms(ctx, "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(len(platforms), 9); diff != "" {
+		t.Errorf("GetPlatforms() count (-want +got):\n%s", diff)
+	}
+
+	// The cache is keyed by the reference the workload uses, not by the mirror.
+	err = cache.WriteBack(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(env.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "docker.io/library/golang:latest:") || strings.Contains(string(content), registry.host) {
+		t.Errorf("unexpected cache content:\n%s", content)
+	}
+}
+
+func TestRegistriesRewrite(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.addManifest("mirror/team/app", "1.0", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	client := registry.client()
+	client.Registries = loadRegistriesConfig(t, `
+[[registry]]
+prefix = "example.com/team"
+location = "`+registry.host+`/mirror/team"
+`)
+
+	_, _, err := client.GetManifest(ctx, "example.com/team/app:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistriesUnqualifiedSearch(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.addManifest("app", "1.0", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	client := registry.client()
+	client.Registries = loadRegistriesConfig(t, `
+unqualified-search-registries = ["`+registry.host+`"]
+`)
+	inspector := dockerplatforms.New(client, dockerplatforms.NewNopCache())
+
+	platforms, err := inspector.GetPlatforms(ctx, "app:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(len(platforms), 9); diff != "" {
+		t.Errorf("GetPlatforms() count (-want +got):\n%s", diff)
+	}
+}
+
+func TestRegistriesUnqualifiedSearchCacheKey(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.addManifest("app", "1.0", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	client := registry.client()
+	client.Registries = loadRegistriesConfig(t, `
+unqualified-search-registries = ["`+registry.host+`"]
+`)
+	// The fully qualified name is another image, cached from an earlier run.
+	cache := dockerplatforms.NewMemoryCache()
+	err := cache.SetCachedPlatforms(ctx, "docker.io/library/app:1.0", dockerplatforms.MustParseDockerPlatformList("linux/s390x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspector := dockerplatforms.New(client, cache)
+
+	platforms, err := inspector.GetPlatforms(ctx, "app:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(9, len(platforms)); diff != "" {
+		t.Errorf("GetPlatforms() of the short name count (-want +got):\n%s", diff)
+	}
+	platforms, err = inspector.GetPlatforms(ctx, "docker.io/library/app:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("linux/s390x", dockerplatforms.DockerPlatformList(platforms).String()); diff != "" {
+		t.Errorf("GetPlatforms() of the qualified name (-want +got):\n%s", diff)
+	}
+}
+
+func TestRegistriesCABundle(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.addManifest("library/golang", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	image := registry.host + "/library/golang:latest"
+
+	client := dockerplatforms.NewRegistryClient()
+	client.Registries = loadRegistriesConfig(t, "")
+	_, _, err := client.GetManifest(ctx, image)
+	if err == nil {
+		t.Fatal("Missing error for an untrusted certificate")
+	}
+
+	certDir := t.TempDir()
+	err = os.MkdirAll(filepath.Join(certDir, registry.host), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: registry.server.Certificate().Raw})
+	err = os.WriteFile(filepath.Join(certDir, registry.host, "ca.crt"), ca, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = dockerplatforms.NewRegistryClient()
+	client.Registries = loadRegistriesConfig(t, "")
+	client.Registries.CertDirs = []string{certDir}
+	_, _, err = client.GetManifest(ctx, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistriesInsecure(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.addManifest("library/golang", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	server := httptest.NewServer(http.HandlerFunc(registry.serveHTTP))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	client := dockerplatforms.NewRegistryClient()
+	client.Registries = loadRegistriesConfig(t, `
+[[registry]]
+location = "`+host+`"
+insecure = true
+`)
+	_, _, err := client.GetManifest(ctx, host+"/library/golang:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// loadRegistriesConfig loads a registries.conf with the content, without any certs.d directory.
+func loadRegistriesConfig(t *testing.T, content string) *dockerplatforms.RegistriesConfig {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "registries.conf")
+	err := os.WriteFile(path, []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := dockerplatforms.LoadRegistriesConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.CertDirs = nil
+	return config
+}
@@ -0,0 +1,554 @@
+package dockerplatforms
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// maxManifestSize is the maximum size of a manifest or config blob we accept from a registry.
+const maxManifestSize = 4 << 20
+
+// RegistryClient is a ManifestRetriever backend that speaks the OCI distribution API directly.
+type RegistryClient struct {
+	// HTTPClient is the client used for all requests.
+	// When nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+	// Credentials are used to answer authentication challenges.
+	// Credentials attached with WithPullCredentials take precedence.
+	// When nil, registries are otherwise accessed anonymously.
+	Credentials CredentialStore
+	// Registries configures mirrors, rewrites, insecure registries and CA bundles.
+	// When nil, references are looked up as they are.
+	Registries *RegistriesConfig
+	// Retry tells how requests failing with a transient error are retried.
+	Retry RetryPolicy
+	// RateLimit limits the requests sent to each registry host,
+	// unless HostRateLimits has an entry for the host.
+	RateLimit      RateLimit
+	HostRateLimits map[string]RateLimit
+
+	mu       sync.Mutex
+	tokens   map[tokenKey]string
+	clients  map[clientKey]*http.Client
+	limiters map[string]*hostLimiter
+}
+
+var _ ManifestRetriever = &RegistryClient{}
+var _ ReferrersRetriever = &RegistryClient{}
+var _ BlobRetriever = &RegistryClient{}
+
+// NewRegistryClient creates a RegistryClient with anonymous access and DefaultRetryPolicy.
+// Set Credentials to authenticate.
+func NewRegistryClient() *RegistryClient {
+	return &RegistryClient{
+		Retry:  DefaultRetryPolicy,
+		tokens: make(map[tokenKey]string),
+	}
+}
+
+// searchesShortNames tells if short names may resolve to other registries than docker.io.
+func (r *RegistryClient) searchesShortNames() bool {
+	return r.Registries.searchesShortNames()
+}
+
+type tokenKey struct {
+	host        string
+	scope       string
+	credentials string
+}
+
+type clientKey struct {
+	host     string
+	insecure bool
+}
+
+// GetManifest implements ManifestRetriever.
+//
+// For digest references that do not name a manifest, it falls back to the blob endpoint,
+// because AnalyzeManifest retrieves config blobs through GetManifest as well.
+// With Registries set, mirrors are tried in order before the registry itself.
+func (r *RegistryClient) GetManifest(ctx context.Context, image string) ([]byte, string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "parsing image reference")
+	}
+	named = reference.TagNameOnly(named)
+
+	sources, err := r.Registries.pullSources(ctx, named)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, source := range sources {
+		var body []byte
+		var mediaType string
+		body, mediaType, err = r.getManifest(ctx, source)
+		if err == nil {
+			return body, mediaType, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, "", err
+}
+
+// GetReferrers implements ReferrersRetriever.
+// Registries without the referrers API are reported as having no referrers.
+func (r *RegistryClient) GetReferrers(ctx context.Context, image string) ([]imgspecv1.Descriptor, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing image reference")
+	}
+	digested, ok := named.(reference.Digested)
+	if !ok {
+		return nil, errors.Errorf("%s is not a digest reference", image)
+	}
+
+	sources, err := r.Registries.pullSources(ctx, named)
+	if err != nil {
+		return nil, err
+	}
+	for _, source := range sources {
+		var body []byte
+		body, _, err = r.fetch(ctx, source, "referrers", digested.Digest().String(), []string{imgspecv1.MediaTypeImageIndex})
+		if err == nil {
+			var index imgspecv1.Index
+			err = json.Unmarshal(body, &index)
+			if err != nil {
+				return nil, errors.Wrap(err, "parsing referrers")
+			}
+			return index.Manifests, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return nil, err
+}
+
+// GetBlob implements BlobRetriever.
+func (r *RegistryClient) GetBlob(ctx context.Context, image string) (io.ReadCloser, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing image reference")
+	}
+	digested, ok := named.(reference.Digested)
+	if !ok {
+		return nil, errors.Errorf("%s is not a digest reference", image)
+	}
+
+	sources, err := r.Registries.pullSources(ctx, named)
+	if err != nil {
+		return nil, err
+	}
+	for _, source := range sources {
+		var resp *http.Response
+		resp, _, err = r.open(ctx, source, "blobs", digested.Digest().String(), nil)
+		if err == nil {
+			return newVerifyingReader(resp.Body, digested.Digest()), nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+func (r *RegistryClient) getManifest(ctx context.Context, source pullSource) ([]byte, string, error) {
+	var tagOrDigest string
+	var expectedDigest digest.Digest
+	if digested, ok := source.named.(reference.Digested); ok {
+		expectedDigest = digested.Digest()
+		tagOrDigest = expectedDigest.String()
+	} else if tagged, ok := source.named.(reference.Tagged); ok {
+		tagOrDigest = tagged.Tag()
+	}
+
+	body, mediaType, err := r.fetch(ctx, source, "manifests", tagOrDigest, manifest.DefaultRequestedManifestMIMETypes)
+	if err != nil && expectedDigest != "" && isNotFound(err) {
+		body, mediaType, err = r.fetch(ctx, source, "blobs", tagOrDigest, nil)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if expectedDigest != "" {
+		verifier := expectedDigest.Verifier()
+		verifier.Write(body)
+		if !verifier.Verified() {
+			return nil, "", errors.Errorf("digest mismatch for %s", source.named)
+		}
+	}
+	return body, mediaType, nil
+}
+
+func (r *RegistryClient) fetch(ctx context.Context, source pullSource, kind, tagOrDigest string, accept []string) ([]byte, string, error) {
+	resp, u, err := r.open(ctx, source, kind, tagOrDigest, accept)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "reading response body")
+	}
+	if len(body) > maxManifestSize {
+		return nil, "", errors.Errorf("%s is too large", u)
+	}
+
+	var mediaType string
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "parsing Content-Type")
+		}
+	}
+	if mediaType == "application/octet-stream" || mediaType == "text/plain" {
+		// Some registries do not know better; let the caller guess instead.
+		mediaType = ""
+	}
+	return body, mediaType, nil
+}
+
+// open sends a GET request for the manifest or blob and returns the successful response with its URL.
+// The caller must close the response body.
+func (r *RegistryClient) open(ctx context.Context, source pullSource, kind, tagOrDigest string, accept []string) (*http.Response, string, error) {
+	domain := reference.Domain(source.named)
+	repository := reference.Path(source.named)
+	host := registryHost(domain)
+
+	var u string
+	var resp *http.Response
+	var err error
+	for _, scheme := range []string{"https", "http"} {
+		u = fmt.Sprintf("%s://%s/v2/%s/%s/%s", scheme, host, repository, kind, tagOrDigest)
+		resp, err = r.do(ctx, source, host, func() (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+			if err != nil {
+				return nil, err
+			}
+			for _, mediaType := range accept {
+				req.Header.Add("Accept", mediaType)
+			}
+			return req, nil
+		})
+		// Insecure registries may not speak TLS at all.
+		if err == nil || !source.insecure || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		resp.Body.Close()
+		return nil, "", &UnauthorizedError{Registry: domain, Repository: repository, StatusCode: resp.StatusCode}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, "", &registryStatusError{url: u, statusCode: resp.StatusCode}
+	}
+	return resp, u, nil
+}
+
+// do sends a request to the host of the source, answering a Bearer or Basic challenge once if the registry asks for it.
+// The caller is responsible for interpreting the status code of the final response.
+func (r *RegistryClient) do(ctx context.Context, source pullSource, host string, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	domain := reference.Domain(source.named)
+	repository := reference.Path(source.named)
+	credentials, err := r.credentials(ctx, domain)
+	if err != nil {
+		return nil, errors.Wrap(err, "looking up credentials")
+	}
+	scope := fmt.Sprintf("repository:%s:pull", repository)
+	key := tokenKey{host: host, scope: scope, credentials: credentials.fingerprint()}
+
+	client, err := r.clientFor(host, source.insecure)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.send(ctx, client, func() (*http.Request, error) {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		if token, ok := r.cachedToken(key); ok {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenges := resp.Header.Values("WWW-Authenticate")
+	var authorization string
+	if challenge, ok := parseChallenge(challenges, "Bearer"); ok {
+		resp.Body.Close()
+		if challenge["scope"] == "" {
+			challenge["scope"] = scope
+		}
+		token, err := r.fetchToken(ctx, challenge, credentials)
+		if err != nil {
+			var unauthorizedErr *UnauthorizedError
+			if errors.As(err, &unauthorizedErr) {
+				unauthorizedErr.Registry = domain
+				unauthorizedErr.Repository = repository
+				return nil, unauthorizedErr
+			}
+			return nil, errors.Wrap(err, "fetching bearer token")
+		}
+		r.storeToken(key, token)
+		authorization = "Bearer " + token
+	} else if _, ok := parseChallenge(challenges, "Basic"); ok && credentials.Username != "" {
+		resp.Body.Close()
+		authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials.Username+":"+credentials.Password))
+	} else {
+		return resp, nil
+	}
+
+	return r.send(ctx, client, func() (*http.Request, error) {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", authorization)
+		return req, nil
+	})
+}
+
+func (r *RegistryClient) credentials(ctx context.Context, domain string) (Credentials, error) {
+	if pull, ok := pullCredentialsFromContext(ctx); ok {
+		credentials, ok, err := pull.store.GetCredentials(ctx, domain)
+		if err != nil || ok {
+			return credentials, err
+		}
+	}
+	if r.Credentials == nil {
+		return Credentials{}, nil
+	}
+	credentials, _, err := r.Credentials.GetCredentials(ctx, domain)
+	return credentials, err
+}
+
+// fetchToken obtains a bearer token as described in
+// https://distribution.github.io/distribution/spec/auth/token/
+func (r *RegistryClient) fetchToken(ctx context.Context, challenge map[string]string, credentials Credentials) (string, error) {
+	realm, err := url.Parse(challenge["realm"])
+	if err != nil || realm.Scheme == "" {
+		return "", errors.Errorf("invalid realm in challenge: %q", challenge["realm"])
+	}
+	scopes := strings.Fields(challenge["scope"])
+
+	newRequest := func() (*http.Request, error) {
+		if credentials.IdentityToken != "" {
+			// https://distribution.github.io/distribution/spec/auth/oauth/
+			form := url.Values{}
+			form.Set("grant_type", "refresh_token")
+			form.Set("refresh_token", credentials.IdentityToken)
+			form.Set("service", challenge["service"])
+			form.Set("scope", strings.Join(scopes, " "))
+			form.Set("client_id", "container-platform-tools")
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, realm.String(), strings.NewReader(form.Encode()))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return req, nil
+		}
+
+		query := realm.Query()
+		if service := challenge["service"]; service != "" {
+			query.Set("service", service)
+		}
+		for _, scope := range scopes {
+			query.Add("scope", scope)
+		}
+		u := *realm
+		u.RawQuery = query.Encode()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if credentials.Username != "" {
+			req.SetBasicAuth(credentials.Username, credentials.Password)
+		}
+		return req, nil
+	}
+
+	client, err := r.clientFor(realm.Host, false)
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.send(ctx, client, newRequest)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", &UnauthorizedError{StatusCode: resp.StatusCode}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", &registryStatusError{url: realm.String(), statusCode: resp.StatusCode}
+	}
+
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&tokenResponse)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing token response")
+	}
+	if tokenResponse.Token != "" {
+		return tokenResponse.Token, nil
+	}
+	if tokenResponse.AccessToken != "" {
+		return tokenResponse.AccessToken, nil
+	}
+	return "", errors.New("token endpoint returned no token")
+}
+
+func (r *RegistryClient) httpClient() *http.Client {
+	if r.HTTPClient != nil {
+		return r.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// clientFor returns the client to reach the host with, as configured by Registries.
+func (r *RegistryClient) clientFor(host string, insecure bool) (*http.Client, error) {
+	if r.Registries == nil {
+		return r.httpClient(), nil
+	}
+
+	key := clientKey{host: host, insecure: insecure}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client, ok := r.clients[key]; ok {
+		return client, nil
+	}
+	client, err := r.Registries.httpClient(r.httpClient(), host, insecure)
+	if err != nil {
+		return nil, errors.Wrapf(err, "configuring TLS for %s", host)
+	}
+	if r.clients == nil {
+		r.clients = make(map[clientKey]*http.Client)
+	}
+	r.clients[key] = client
+	return client, nil
+}
+
+func (r *RegistryClient) cachedToken(key tokenKey) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	token, ok := r.tokens[key]
+	return token, ok
+}
+
+func (r *RegistryClient) storeToken(key tokenKey, token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tokens == nil {
+		r.tokens = make(map[tokenKey]string)
+	}
+	r.tokens[key] = token
+}
+
+// registryHost maps the domain of a normalized reference to the host serving its API.
+func registryHost(domain string) string {
+	if domain == "docker.io" {
+		return "registry-1.docker.io"
+	}
+	return domain
+}
+
+type registryStatusError struct {
+	url        string
+	statusCode int
+}
+
+func (e *registryStatusError) Error() string {
+	return fmt.Sprintf("%s returned %d %s", e.url, e.statusCode, http.StatusText(e.statusCode))
+}
+
+// Transient tells if the request may succeed when retried later.
+func (e *registryStatusError) Transient() bool {
+	return isTransientStatus(e.statusCode)
+}
+
+func isNotFound(err error) bool {
+	var statusErr *registryStatusError
+	return errors.As(err, &statusErr) && statusErr.statusCode == http.StatusNotFound
+}
+
+// parseChallenge extracts the parameters of the first challenge of the scheme in WWW-Authenticate headers.
+func parseChallenge(headers []string, scheme string) (map[string]string, bool) {
+	for _, header := range headers {
+		s, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+		if !strings.EqualFold(s, scheme) {
+			continue
+		}
+		return parseAuthParams(rest), true
+	}
+	return nil, false
+}
+
+// parseAuthParams parses a comma-separated list of key=value pairs where values may be quoted.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value.WriteString(strings.TrimSpace(rest[:end]))
+			s = rest[end:]
+		}
+		params[key] = value.String()
+	}
+}
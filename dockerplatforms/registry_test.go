@@ -0,0 +1,253 @@
+package dockerplatforms_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+)
+
+func TestRegistryClientGetManifest(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.addManifest("library/golang", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+
+	client := registry.client()
+	manifest, mediaType, err := client.GetManifest(ctx, registry.host+"/library/golang:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(manifest), string(mustReadFixture(t, "golang-latest.json"))); diff != "" {
+		t.Errorf("GetManifest() manifest (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(mediaType, "application/vnd.docker.distribution.manifest.list.v2+json"); diff != "" {
+		t.Errorf("GetManifest() mediaType (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(registry.acceptHeaders[0], "application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json, application/vnd.docker.distribution.manifest.v1+prettyjws, application/vnd.docker.distribution.manifest.v1+json, application/vnd.docker.distribution.manifest.list.v2+json, application/vnd.oci.image.index.v1+json"); diff != "" {
+		t.Errorf("Accept header (-want +got):\n%s", diff)
+	}
+}
+
+func TestRegistryClientBearerToken(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.token = "secret-token"
+	registry.addManifest("library/golang", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+
+	client := registry.client()
+	for i := 0; i < 2; i++ {
+		_, _, err := client.GetManifest(ctx, registry.host+"/library/golang:latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if diff := cmp.Diff(registry.tokenScopes, []string{"repository:library/golang:pull"}); diff != "" {
+		t.Errorf("token requests (-want +got):\n%s", diff)
+	}
+}
+
+func TestRegistryClientAnalyzeManifestV2(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.token = "secret-token"
+	registry.addManifest("library/golang", "1.5", "application/vnd.docker.distribution.manifest.v2+json", mustReadFixture(t, "golang-1.5.json"))
+	registry.addBlob("library/golang", mustReadFixture(t, "golang-1.5-99668503de157252ba311f570f036490602095f2620c46cb407d3d2dd88aeb6e.json"))
+
+	imageRef, err := reference.ParseNormalizedNamed(registry.host + "/library/golang:1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	platforms, err := dockerplatforms.AnalyzeManifest(ctx, imageRef, registry.client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(platforms, []dockerplatforms.DockerPlatform{
+		dockerplatforms.LinuxAMD64,
+	}); diff != "" {
+		t.Errorf("AnalyzeManifest() (-want +got):\n%s", diff)
+	}
+}
+
+func TestRegistryClientNotFound(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+
+	_, _, err := registry.client().GetManifest(ctx, registry.host+"/library/golang:latest")
+	if err == nil {
+		t.Fatal("Missing error")
+	}
+	if !strings.Contains(err.Error(), "404 Not Found") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRegistryClientDigestMismatch(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.manifests["library/golang/sha256:99668503de157252ba311f570f036490602095f2620c46cb407d3d2dd88aeb6e"] = fakeManifest{
+		mediaType: "application/vnd.docker.distribution.manifest.v2+json",
+		body:      mustReadFixture(t, "golang-1.5.json"),
+	}
+
+	_, _, err := registry.client().GetManifest(ctx, registry.host+"/library/golang@sha256:99668503de157252ba311f570f036490602095f2620c46cb407d3d2dd88aeb6e")
+	if err == nil {
+		t.Fatal("Missing error")
+	}
+	if !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// fakeRegistry is a minimal OCI distribution API server for tests.
+type fakeRegistry struct {
+	t      *testing.T
+	server *httptest.Server
+	host   string
+
+	// token, when set, is required as a bearer token and issued by the /token endpoint.
+	token string
+	// username and password, when set, are required by the /token endpoint.
+	username string
+	password string
+
+	// failures are status codes answered to the next requests, in order, before serving normally.
+	failures []int
+	// retryAfter, when set, is sent as Retry-After with the failures.
+	retryAfter string
+	// delay is how long each request takes.
+	delay time.Duration
+
+	mu            sync.Mutex
+	manifests     map[string]fakeManifest
+	blobs         map[string][]byte
+	referrers     map[string][]byte
+	acceptHeaders []string
+	tokenScopes   []string
+	requests      int
+	inFlight      atomic.Int32
+	maxInFlight   atomic.Int32
+}
+
+type fakeManifest struct {
+	mediaType string
+	body      []byte
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	t.Helper()
+
+	registry := &fakeRegistry{
+		t:         t,
+		manifests: make(map[string]fakeManifest),
+		blobs:     make(map[string][]byte),
+		referrers: make(map[string][]byte),
+	}
+	registry.server = httptest.NewTLSServer(http.HandlerFunc(registry.serveHTTP))
+	t.Cleanup(registry.server.Close)
+	registry.host = strings.TrimPrefix(registry.server.URL, "https://")
+	return registry
+}
+
+func (f *fakeRegistry) client() *dockerplatforms.RegistryClient {
+	client := dockerplatforms.NewRegistryClient()
+	client.HTTPClient = f.server.Client()
+	return client
+}
+
+func (f *fakeRegistry) addManifest(repository, tag, mediaType string, body []byte) {
+	f.manifests[repository+"/"+tag] = fakeManifest{mediaType: mediaType, body: body}
+	f.manifests[repository+"/"+digest.FromBytes(body).String()] = fakeManifest{mediaType: mediaType, body: body}
+}
+
+func (f *fakeRegistry) addBlob(repository string, body []byte) {
+	f.blobs[repository+"/"+digest.FromBytes(body).String()] = body
+}
+
+func (f *fakeRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	inFlight := f.inFlight.Add(1)
+	defer f.inFlight.Add(-1)
+	for {
+		maxInFlight := f.maxInFlight.Load()
+		if inFlight <= maxInFlight || f.maxInFlight.CompareAndSwap(maxInFlight, inFlight) {
+			break
+		}
+	}
+	time.Sleep(f.delay)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests++
+	if len(f.failures) > 0 {
+		if f.retryAfter != "" {
+			w.Header().Set("Retry-After", f.retryAfter)
+		}
+		w.WriteHeader(f.failures[0])
+		f.failures = f.failures[1:]
+		return
+	}
+
+	if req.URL.Path == "/token" {
+		if username, password, _ := req.BasicAuth(); username != f.username || password != f.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.tokenScopes = append(f.tokenScopes, req.URL.Query()["scope"]...)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"token":"` + f.token + `"}`))
+		return
+	}
+
+	if f.token != "" && req.Header.Get("Authorization") != "Bearer "+f.token {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+f.server.URL+`/token",service="fake-registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path, ok := strings.CutPrefix(req.URL.Path, "/v2/")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i >= 0 {
+		f.acceptHeaders = append(f.acceptHeaders, strings.Join(req.Header.Values("Accept"), ", "))
+		m, ok := f.manifests[path[:i]+"/"+path[i+len("/manifests/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Write(m.body)
+		return
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i >= 0 {
+		blob, ok := f.blobs[path[:i]+"/"+path[i+len("/blobs/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(blob)
+		return
+	}
+	if i := strings.LastIndex(path, "/referrers/"); i >= 0 {
+		index, ok := f.referrers[path[:i]+"/"+path[i+len("/referrers/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		w.Write(index)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
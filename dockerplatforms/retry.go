@@ -0,0 +1,240 @@
+package dockerplatforms
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+// RetryPolicy tells how requests failing with a transient error are retried.
+// Waits grow exponentially from InitialBackoff up to MaxBackoff.
+// A Retry-After header from the registry is honoured; when it asks for more than MaxBackoff,
+// the request is not retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is sent at most.
+	// Zero or one disables retries.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of NewRegistryClient.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+}
+
+// backoff returns how long to wait before the attempt following the given one, counting from zero.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 0; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, p.MaxBackoff)
+}
+
+// RateLimit limits the requests sent to a registry host.
+// Zero fields mean no limit.
+type RateLimit struct {
+	// MaxConcurrent is the number of requests in flight at once.
+	MaxConcurrent int
+	// RequestsPerSecond is the sustained request rate, allowing bursts of Burst requests.
+	RequestsPerSecond float64
+	Burst             int
+}
+
+// hostLimiter enforces a RateLimit for one host.
+type hostLimiter struct {
+	slots   chan struct{}
+	limiter *rate.Limiter
+}
+
+func newHostLimiter(limit RateLimit) *hostLimiter {
+	l := &hostLimiter{}
+	if limit.MaxConcurrent > 0 {
+		l.slots = make(chan struct{}, limit.MaxConcurrent)
+	}
+	if limit.RequestsPerSecond > 0 {
+		l.limiter = rate.NewLimiter(rate.Limit(limit.RequestsPerSecond), max(limit.Burst, 1))
+	}
+	return l
+}
+
+// acquire waits until a request may be sent and returns the function releasing its slot.
+func (l *hostLimiter) acquire(ctx context.Context) (func(), error) {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+	}
+	if l.limiter != nil {
+		err := l.limiter.Wait(ctx)
+		if err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
+
+// send sends the request created by newRequest, retrying transient failures according to r.Retry
+// and waiting for the rate limit of the host.
+// A request is considered in flight until its response body is closed.
+func (r *RegistryClient) send(ctx context.Context, client *http.Client, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, errors.Wrap(err, "creating request")
+		}
+		release, err := r.hostLimiter(req.URL.Host).acquire(ctx)
+		if err != nil {
+			return nil, &transientError{err: errors.Wrap(err, "waiting for rate limit")}
+		}
+
+		resp, err := client.Do(req)
+		wait := r.Retry.backoff(attempt)
+		giveUp := attempt+1 >= r.Retry.MaxAttempts || ctx.Err() != nil
+		if err != nil && isTLSError(err) {
+			release()
+			return nil, errors.Wrap(err, "sending request")
+		} else if err != nil {
+			release()
+			err = &transientError{err: errors.Wrap(err, "sending request")}
+		} else if isTransientStatus(resp.StatusCode) {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				wait = max(wait, retryAfter)
+				giveUp = giveUp || retryAfter > r.Retry.MaxBackoff
+			}
+		} else {
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+			return resp, nil
+		}
+
+		if giveUp {
+			if resp != nil {
+				resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+			}
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxManifestSize))
+			resp.Body.Close()
+			release()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, &transientError{err: ctx.Err()}
+		}
+	}
+}
+
+func (r *RegistryClient) hostLimiter(host string) *hostLimiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if l, ok := r.limiters[host]; ok {
+		return l
+	}
+	limit, ok := r.HostRateLimits[host]
+	if !ok {
+		limit = r.RateLimit
+	}
+	l := newHostLimiter(limit)
+	if r.limiters == nil {
+		r.limiters = make(map[string]*hostLimiter)
+	}
+	r.limiters[host] = l
+	return l
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	closed  bool
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.closed {
+		b.closed = true
+		b.release()
+	}
+	return err
+}
+
+// parseRetryAfter parses a Retry-After header, given either in seconds or as an HTTP date.
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// isTransientStatus tells if a response with the status code is worth retrying.
+func isTransientStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// isTLSError tells if the request failed because of a TLS setup problem, which a retry does not fix.
+func isTLSError(err error) bool {
+	var recordHeaderErr tls.RecordHeaderError
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &recordHeaderErr) ||
+		errors.As(err, &verificationErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) ||
+		strings.Contains(err.Error(), "server gave HTTP response to HTTPS client")
+}
+
+// IsTransient tells if the error is likely to go away on its own,
+// such as rate limiting, a server error or a network failure.
+// YAMLCache does not remember them by default, except for rate limiting.
+func IsTransient(err error) bool {
+	var transient interface{ Transient() bool }
+	return errors.As(err, &transient) && transient.Transient()
+}
+
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transientError) Unwrap() error {
+	return e.err
+}
+
+func (e *transientError) Transient() bool {
+	return true
+}
@@ -0,0 +1,179 @@
+package dockerplatforms_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+)
+
+func TestRegistryClientRetry(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.addManifest("library/golang", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	registry.failures = []int{500, 502, 503}
+
+	client := registry.client()
+	client.Retry = dockerplatforms.RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	_, _, err := client.GetManifest(ctx, registry.host+"/library/golang:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(registry.requests, 4); diff != "" {
+		t.Errorf("requests (-want +got):\n%s", diff)
+	}
+}
+
+func TestRegistryClientRetryAfter(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.addManifest("library/golang", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	registry.failures = []int{429}
+	registry.retryAfter = "1"
+
+	client := registry.client()
+	client.Retry = dockerplatforms.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Second}
+	start := time.Now()
+	_, _, err := client.GetManifest(ctx, registry.host+"/library/golang:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v despite Retry-After", elapsed)
+	}
+}
+
+func TestRegistryClientRetryGiveUp(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name       string
+		failures   []int
+		retryAfter string
+		requests   int
+	}{
+		{name: "attempts exhausted", failures: []int{503, 503, 503}, requests: 2},
+		{name: "Retry-After too long", failures: []int{429}, retryAfter: "3600", requests: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			registry := newFakeRegistry(t)
+			registry.addManifest("library/golang", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+			registry.failures = tc.failures
+			registry.retryAfter = tc.retryAfter
+
+			client := registry.client()
+			client.Retry = dockerplatforms.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Second}
+			_, _, err := client.GetManifest(ctx, registry.host+"/library/golang:latest")
+			if !dockerplatforms.IsTransient(err) {
+				t.Errorf("expected a transient error, got: %v", err)
+			}
+			if diff := cmp.Diff(registry.requests, tc.requests); diff != "" {
+				t.Errorf("requests (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGetPlatformsTransientErrorNotCached(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.addManifest("library/golang", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	registry.failures = []int{503}
+	env, cache, err := setupEmptyYAML(ctx, "TestGetPlatformsTransientErrorNotCached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+
+	client := registry.client()
+	client.Retry = dockerplatforms.RetryPolicy{}
+	inspector := dockerplatforms.New(client, cache)
+	image := registry.host + "/library/golang:latest"
+
+	_, err = inspector.GetPlatforms(ctx, image)
+	if !dockerplatforms.IsTransient(err) {
+		t.Fatalf("expected a transient error, got: %v", err)
+	}
+	platforms, err := inspector.GetPlatforms(ctx, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(len(platforms), 9); diff != "" {
+		t.Errorf("GetPlatforms() count (-want +got):\n%s", diff)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.addManifest("library/golang", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	client := registry.client()
+	client.Retry = dockerplatforms.RetryPolicy{}
+
+	testcases := []struct {
+		name     string
+		image    string
+		failures []int
+		expected dockerplatforms.ErrorClass
+	}{
+		{name: "not found", image: "library/golang:missing", expected: dockerplatforms.ErrorNotFound},
+		{name: "rate limited", image: "library/golang:latest", failures: []int{429}, expected: dockerplatforms.ErrorRateLimited},
+		{name: "server error", image: "library/golang:latest", failures: []int{503}, expected: dockerplatforms.ErrorNetwork},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			registry.failures = tc.failures
+			_, _, err := client.GetManifest(ctx, registry.host+"/"+tc.image)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if diff := cmp.Diff(tc.expected, dockerplatforms.ClassifyError(err)); diff != "" {
+				t.Errorf("ClassifyError(%v) (-want +got):\n%s", err, diff)
+			}
+		})
+	}
+}
+
+func TestRegistryClientRateLimit(t *testing.T) {
+	ctx := context.Background()
+	registry := newFakeRegistry(t)
+	registry.addManifest("library/golang", "latest", "application/vnd.docker.distribution.manifest.list.v2+json", mustReadFixture(t, "golang-latest.json"))
+	registry.delay = 10 * time.Millisecond
+	image := registry.host + "/library/golang:latest"
+
+	client := registry.client()
+	client.HostRateLimits = map[string]dockerplatforms.RateLimit{
+		registry.host: {MaxConcurrent: 2},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := client.GetManifest(ctx, image)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if maxInFlight := registry.maxInFlight.Load(); maxInFlight > 2 {
+		t.Errorf("%d requests in flight at once", maxInFlight)
+	}
+
+	registry.delay = 0
+	client = registry.client()
+	client.RateLimit = dockerplatforms.RateLimit{RequestsPerSecond: 50, Burst: 1}
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		_, _, err := client.GetManifest(ctx, image)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("6 requests at 50/s took only %v", elapsed)
+	}
+}
@@ -56,6 +56,21 @@ func (mr *MockPlatformInspectorMockRecorder) GetPlatforms(ctx, image any) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPlatforms", reflect.TypeOf((*MockPlatformInspector)(nil).GetPlatforms), ctx, image)
 }
 
+// Inspect mocks base method.
+func (m *MockPlatformInspector) Inspect(ctx context.Context, image string, opts dockerplatforms.InspectOptions) (dockerplatforms.InspectResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Inspect", ctx, image, opts)
+	ret0, _ := ret[0].(dockerplatforms.InspectResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Inspect indicates an expected call of Inspect.
+func (mr *MockPlatformInspectorMockRecorder) Inspect(ctx, image, opts any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Inspect", reflect.TypeOf((*MockPlatformInspector)(nil).Inspect), ctx, image, opts)
+}
+
 // MocknamedTaggedDigested is a mock of namedTaggedDigested interface.
 type MocknamedTaggedDigested struct {
 	ctrl     *gomock.Controller
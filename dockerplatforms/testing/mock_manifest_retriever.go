@@ -11,8 +11,10 @@ package dockerplatformstesting
 
 import (
 	context "context"
+	io "io"
 	reflect "reflect"
 
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	gomock "go.uber.org/mock/gomock"
 )
 
@@ -54,3 +56,79 @@ func (mr *MockManifestRetrieverMockRecorder) GetManifest(ctx, image any) *gomock
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetManifest", reflect.TypeOf((*MockManifestRetriever)(nil).GetManifest), ctx, image)
 }
+
+// MockReferrersRetriever is a mock of ReferrersRetriever interface.
+type MockReferrersRetriever struct {
+	ctrl     *gomock.Controller
+	recorder *MockReferrersRetrieverMockRecorder
+}
+
+// MockReferrersRetrieverMockRecorder is the mock recorder for MockReferrersRetriever.
+type MockReferrersRetrieverMockRecorder struct {
+	mock *MockReferrersRetriever
+}
+
+// NewMockReferrersRetriever creates a new mock instance.
+func NewMockReferrersRetriever(ctrl *gomock.Controller) *MockReferrersRetriever {
+	mock := &MockReferrersRetriever{ctrl: ctrl}
+	mock.recorder = &MockReferrersRetrieverMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockReferrersRetriever) EXPECT() *MockReferrersRetrieverMockRecorder {
+	return m.recorder
+}
+
+// GetReferrers mocks base method.
+func (m *MockReferrersRetriever) GetReferrers(ctx context.Context, image string) ([]v1.Descriptor, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReferrers", ctx, image)
+	ret0, _ := ret[0].([]v1.Descriptor)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReferrers indicates an expected call of GetReferrers.
+func (mr *MockReferrersRetrieverMockRecorder) GetReferrers(ctx, image any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReferrers", reflect.TypeOf((*MockReferrersRetriever)(nil).GetReferrers), ctx, image)
+}
+
+// MockBlobRetriever is a mock of BlobRetriever interface.
+type MockBlobRetriever struct {
+	ctrl     *gomock.Controller
+	recorder *MockBlobRetrieverMockRecorder
+}
+
+// MockBlobRetrieverMockRecorder is the mock recorder for MockBlobRetriever.
+type MockBlobRetrieverMockRecorder struct {
+	mock *MockBlobRetriever
+}
+
+// NewMockBlobRetriever creates a new mock instance.
+func NewMockBlobRetriever(ctrl *gomock.Controller) *MockBlobRetriever {
+	mock := &MockBlobRetriever{ctrl: ctrl}
+	mock.recorder = &MockBlobRetrieverMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockBlobRetriever) EXPECT() *MockBlobRetrieverMockRecorder {
+	return m.recorder
+}
+
+// GetBlob mocks base method.
+func (m *MockBlobRetriever) GetBlob(ctx context.Context, image string) (io.ReadCloser, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetBlob", ctx, image)
+	ret0, _ := ret[0].(io.ReadCloser)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetBlob indicates an expected call of GetBlob.
+func (mr *MockBlobRetrieverMockRecorder) GetBlob(ctx, image any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBlob", reflect.TypeOf((*MockBlobRetriever)(nil).GetBlob), ctx, image)
+}
@@ -0,0 +1,51 @@
+package dockerplatforms
+
+import (
+	"context"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/pkg/errors"
+)
+
+// ParseImageArgument parses an image given on the command line.
+// Besides plain registry references, it accepts the transport prefixes known from skopeo:
+//
+//   - docker://REFERENCE
+//   - oci:PATH[:REFERENCE]
+//   - oci-archive:PATH[:REFERENCE]
+//   - docker-archive:PATH[:REFERENCE]
+//
+// For local transports, it returns the retriever to read the image with and a reference
+// to pass to AnalyzeManifest. For registry references, the retriever is nil.
+func ParseImageArgument(ctx context.Context, arg string) (reference.Named, ManifestRetriever, error) {
+	transport, rest, ok := strings.Cut(arg, ":")
+	if ok && transport == "docker" && strings.HasPrefix(rest, "//") {
+		arg = strings.TrimPrefix(rest, "//")
+		ok = false
+	}
+	path, ref, _ := strings.Cut(rest, ":")
+
+	var layout *LayoutRetriever
+	switch {
+	case ok && transport == "oci":
+		layout = NewOCILayout(path)
+	case ok && (transport == "oci-archive" || transport == "docker-archive"):
+		layout = NewArchive(path)
+	default:
+		named, err := reference.ParseNormalizedNamed(arg)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "parsing image reference")
+		}
+		return named, nil, nil
+	}
+	if path == "" {
+		return nil, nil, errors.Errorf("missing path in %s", arg)
+	}
+
+	named, err := layout.Resolve(ctx, ref)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "resolving %s", arg)
+	}
+	return named, layout, nil
+}
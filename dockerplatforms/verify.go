@@ -0,0 +1,86 @@
+package dockerplatforms
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// PlatformMismatch is an index entry whose platform disagrees with the config of its image.
+type PlatformMismatch struct {
+	// Digest is the digest of the image manifest.
+	Digest digest.Digest
+	// Declared is the platform the index tells.
+	Declared DockerPlatform
+	// Actual is the platform the config tells.
+	Actual DockerPlatform
+}
+
+func (m PlatformMismatch) String() string {
+	return fmt.Sprintf("%s: index says %s, config says %s", m.Digest, m.Declared, m.Actual)
+}
+
+// verifyInstance compares the platform an index declares for an image manifest with its config.
+// Entries that turn out not to be images are left alone.
+func (a *manifestAnalysis) verifyInstance(ctx context.Context, imageRef reference.Named, retriever ManifestRetriever, instanceDigest digest.Digest, mediaType string, declared DockerPlatform) error {
+	instanceRef, err := withDigest(imageRef, instanceDigest)
+	if err != nil {
+		return err
+	}
+	manifestText, instanceMediaType, err := retriever.GetManifest(ctx, instanceRef.String())
+	if err != nil {
+		return errors.Wrap(err, "retrieving manifest")
+	}
+	if instanceMediaType == "" {
+		instanceMediaType = mediaType
+	}
+	if instanceMediaType == "" {
+		instanceMediaType = manifest.GuessMIMEType(manifestText)
+	}
+	instanceMediaType = manifest.NormalizedMIMEType(instanceMediaType)
+	if manifest.MIMETypeIsMultiImage(instanceMediaType) {
+		return nil
+	}
+
+	actual, err := inspectImageManifest(ctx, instanceRef, retriever, manifestText, instanceMediaType)
+	if IsArtifact(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !platformsAgree(declared, actual) {
+		a.mismatches = append(a.mismatches, PlatformMismatch{
+			Digest:   instanceDigest,
+			Declared: declared,
+			Actual:   actual,
+		})
+	}
+	return nil
+}
+
+// platformsAgree tells if the platform of an index entry is consistent with the one of the config.
+// Variants and OS versions are only compared when both tell them, as configs often leave them out.
+func platformsAgree(declared, actual DockerPlatform) bool {
+	if declared.OS != actual.OS || declared.Architecture != actual.Architecture {
+		return false
+	}
+	declaredVariant, actualVariant := declared.Variant, actual.Variant
+	if declared.Architecture == "arm64" {
+		// v8 is the default variant of arm64.
+		declaredVariant = cmp.Or(declaredVariant, "v8")
+		actualVariant = cmp.Or(actualVariant, "v8")
+	}
+	if declaredVariant != "" && actualVariant != "" && declaredVariant != actualVariant {
+		return false
+	}
+	if declared.OSVersion != "" && actual.OSVersion != "" && declared.OSVersion != actual.OSVersion {
+		return false
+	}
+	return true
+}
@@ -2,6 +2,7 @@ package k8splatforms
 
 import (
 	"slices"
+	"strings"
 
 	"github.com/wantedly/container-platform-tools/dockerplatforms"
 	corev1 "k8s.io/api/core/v1"
@@ -92,9 +93,9 @@ func evaluateMatchExpression(expr corev1.NodeSelectorRequirement, platform docke
 	case corev1.NodeSelectorOpNotIn:
 		return !slices.Contains(expr.Values, value)
 	case corev1.NodeSelectorOpExists:
-		return true
+		return hasLabel(expr.Key, platform)
 	case corev1.NodeSelectorOpDoesNotExist:
-		return false
+		return !hasLabel(expr.Key, platform)
 	default:
 		// Assume it matches
 		return true
@@ -108,8 +109,61 @@ func getLabel(key string, platform dockerplatforms.DockerPlatform) (string, bool
 		return platform.Architecture, true
 	case "kubernetes.io/os", "beta.kubernetes.io/os":
 		return platform.OS, true
+	case "node.kubernetes.io/windows-build":
+		if !hasLabel(key, platform) {
+			return "", true
+		}
+		build := platform.WindowsBuild()
+		return build, build != ""
+	case AMD64LevelLabel:
+		if !hasLabel(key, platform) {
+			return "", true
+		}
+		if !knowsAMD64Level(platform) {
+			// Assume it matches
+			return "", false
+		}
+		return platform.Variant, true
 	default:
+		// The CPUID labels of Node Feature Discovery are known for the features of the x86-64 levels,
+		// which only amd64 nodes have.
+		if feature, ok := strings.CutPrefix(key, nfdCPUIDLabelPrefix); ok {
+			if _, ok := amd64FeatureLevel(feature); ok {
+				if platform.Architecture == "amd64" && !knowsAMD64Level(platform) {
+					// Assume it matches
+					return "", false
+				}
+				if !hasLabel(key, platform) {
+					return "", true
+				}
+				return "true", true
+			}
+		}
 		// Assume it matches
 		return "", false
 	}
 }
+
+// hasLabel tells if nodes of the platform have the label getLabel knows the value of.
+func hasLabel(key string, platform dockerplatforms.DockerPlatform) bool {
+	switch key {
+	case "node.kubernetes.io/windows-build":
+		return platform.OS == "windows"
+	case AMD64LevelLabel:
+		return platform.Architecture == "amd64"
+	default:
+		if feature, ok := strings.CutPrefix(key, nfdCPUIDLabelPrefix); ok {
+			level, ok := amd64FeatureLevel(feature)
+			// The levels v2 to v4 sort as text.
+			return ok && knowsAMD64Level(platform) && level <= platform.Variant
+		}
+		return true
+	}
+}
+
+// knowsAMD64Level tells if the platform is amd64 with an x86-64 level from v2.
+// linux/amd64 does not tell the level of its nodes, which may be any,
+// so that selectors on the level or its CPUID features are assumed to match them.
+func knowsAMD64Level(platform dockerplatforms.DockerPlatform) bool {
+	return platform.Architecture == "amd64" && platform.Variant != ""
+}
@@ -171,6 +171,43 @@ func TestPodPlatforms(t *testing.T) {
 			nodePlatforms: pl(t, "linux/amd64, linux/arm64, windows/amd64"),
 			expected:      pl(t, "linux/amd64"),
 		},
+		{
+			name: "label selector windows build",
+			pod: &corev1.Pod{
+				Spec: corev1.PodSpec{
+					NodeSelector: map[string]string{
+						"node.kubernetes.io/windows-build": "10.0.17763",
+					},
+				},
+			},
+			nodePlatforms: pl(t, "linux/amd64, windows(10.0.17763)/amd64, windows(10.0.20348)/amd64, windows/arm64"),
+			expected:      pl(t, "windows(10.0.17763)/amd64, windows/arm64"),
+		},
+		{
+			name: "node affinity windows build exists",
+			pod: &corev1.Pod{
+				Spec: corev1.PodSpec{
+					Affinity: &corev1.Affinity{
+						NodeAffinity: &corev1.NodeAffinity{
+							RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+								NodeSelectorTerms: []corev1.NodeSelectorTerm{
+									{
+										MatchExpressions: []corev1.NodeSelectorRequirement{
+											{
+												Key:      "node.kubernetes.io/windows-build",
+												Operator: "Exists",
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			nodePlatforms: pl(t, "linux/amd64, windows(10.0.17763)/amd64"),
+			expected:      pl(t, "windows(10.0.17763)/amd64"),
+		},
 	}
 
 	for _, tc := range testcases {
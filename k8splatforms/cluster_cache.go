@@ -0,0 +1,385 @@
+package k8splatforms
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// ClusterCacheDataKey is the data key of the ConfigMaps and Secrets of a ClusterCache,
+// holding entries in the format of the YAML cache file.
+const ClusterCacheDataKey = "image-platforms.yaml"
+
+// DefaultMaxShardSize is how many bytes of entries a ClusterCache puts in each object by default,
+// leaving room for metadata under the 1 MiB limit of Kubernetes objects.
+const DefaultMaxShardSize = 900 * 1024
+
+// writeBackBackoff is how long WriteBack waits before merging again after another run wrote the objects.
+// Many CI jobs may finish at once, so it backs off further than retry.DefaultRetry.
+var writeBackBackoff = wait.Backoff{
+	Steps:    10,
+	Duration: 20 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.5,
+	Cap:      5 * time.Second,
+}
+
+var _ dockerplatforms.ManagedCache = &ClusterCache{}
+
+// ClusterCache is a cache shared through ConfigMaps or Secrets of a namespace, so that the runs of a team
+// and of its CI jobs reuse each other's lookups. It is safe for concurrent use.
+//
+// The entries are read when the cache is created, and written by WriteBack.
+// They are stored in the object of the cache name, and spread over objects suffixed -1, -2, ...
+// when they outgrow MaxShardSize. WriteBack merges the changes into what other runs wrote in the meantime,
+// keeping the newer entry of each image, and updates the objects by resourceVersion so that no write is lost.
+type ClusterCache struct {
+	dockerplatforms.BufferedCache
+	// MaxShardSize is how many bytes of entries are put in each object.
+	MaxShardSize int
+
+	objects clusterObjects
+	name    string
+}
+
+// NewConfigMapCache creates a ClusterCache stored in ConfigMaps, with dockerplatforms.DefaultExpiryPolicy.
+func NewConfigMapCache(ctx context.Context, clientset kubernetes.Interface, namespace, name string) (*ClusterCache, error) {
+	return newClusterCache(ctx, configMapObjects{clientset.CoreV1().ConfigMaps(namespace)}, name)
+}
+
+// NewSecretCache creates a ClusterCache stored in Secrets, with dockerplatforms.DefaultExpiryPolicy.
+// Use it when the names of private images must not be readable by everyone who can read ConfigMaps.
+func NewSecretCache(ctx context.Context, clientset kubernetes.Interface, namespace, name string) (*ClusterCache, error) {
+	return newClusterCache(ctx, secretObjects{clientset.CoreV1().Secrets(namespace)}, name)
+}
+
+func newClusterCache(ctx context.Context, objects clusterObjects, name string) (*ClusterCache, error) {
+	cache := &ClusterCache{
+		MaxShardSize: DefaultMaxShardSize,
+		objects:      objects,
+		name:         name,
+	}
+	cache.ExpiryPolicy = dockerplatforms.DefaultExpiryPolicy()
+	shards, err := cache.readShards(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cache.Load(shardEntries(shards))
+	return cache, nil
+}
+
+// clusterObjects reads and writes the objects of a ClusterCache.
+type clusterObjects interface {
+	// get returns the entries data of the object, whether it exists, and the function writing new data over it.
+	// The function fails with a conflict if the object changed in the meantime.
+	get(ctx context.Context, name string) ([]byte, bool, func(ctx context.Context, data []byte) error, error)
+	// create creates the object, failing if another run created it in the meantime.
+	create(ctx context.Context, name string, data []byte) error
+}
+
+// managedByLabels are the labels of the objects a ClusterCache creates.
+var managedByLabels = map[string]string{
+	"app.kubernetes.io/managed-by": "container-platform-tools",
+}
+
+type configMapObjects struct {
+	client corev1client.ConfigMapInterface
+}
+
+func (o configMapObjects) get(ctx context.Context, name string) ([]byte, bool, func(ctx context.Context, data []byte) error, error) {
+	configMap, err := o.client.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, false, nil, nil
+	}
+	if err != nil {
+		return nil, false, nil, err
+	}
+	return []byte(configMap.Data[ClusterCacheDataKey]), true, func(ctx context.Context, data []byte) error {
+		configMap := configMap.DeepCopy()
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+		configMap.Data[ClusterCacheDataKey] = string(data)
+		_, err := o.client.Update(ctx, configMap, metav1.UpdateOptions{})
+		return err
+	}, nil
+}
+
+func (o configMapObjects) create(ctx context.Context, name string, data []byte) error {
+	_, err := o.client.Create(ctx, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: managedByLabels},
+		Data:       map[string]string{ClusterCacheDataKey: string(data)},
+	}, metav1.CreateOptions{})
+	return err
+}
+
+type secretObjects struct {
+	client corev1client.SecretInterface
+}
+
+func (o secretObjects) get(ctx context.Context, name string) ([]byte, bool, func(ctx context.Context, data []byte) error, error) {
+	secret, err := o.client.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, false, nil, nil
+	}
+	if err != nil {
+		return nil, false, nil, err
+	}
+	return secret.Data[ClusterCacheDataKey], true, func(ctx context.Context, data []byte) error {
+		secret := secret.DeepCopy()
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		secret.Data[ClusterCacheDataKey] = data
+		_, err := o.client.Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	}, nil
+}
+
+func (o secretObjects) create(ctx context.Context, name string, data []byte) error {
+	_, err := o.client.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: managedByLabels},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       map[string][]byte{ClusterCacheDataKey: data},
+	}, metav1.CreateOptions{})
+	return err
+}
+
+// clusterShard is an object of a ClusterCache, as read by WriteBack.
+type clusterShard struct {
+	name string
+	// write updates the object, or is nil for objects to create.
+	write   func(ctx context.Context, data []byte) error
+	entries map[string]dockerplatforms.CacheEntry
+	// size is the sum of the sizes of the entries.
+	size int
+	// gained and lost tell how the entries changed since the object was read.
+	gained, lost bool
+}
+
+func (s *clusterShard) add(entry dockerplatforms.CacheEntry, size int) {
+	if current, ok := s.entries[entry.Image]; ok {
+		s.size -= entrySize(current)
+	}
+	s.entries[entry.Image] = entry
+	s.size += size
+	s.gained = true
+}
+
+func (s *clusterShard) remove(image string) {
+	s.size -= entrySize(s.entries[image])
+	delete(s.entries, image)
+	s.lost = true
+}
+
+// entrySize is about how many bytes the entry takes in the data of an object.
+func entrySize(entry dockerplatforms.CacheEntry) int {
+	data, err := dockerplatforms.MarshalCacheEntries([]dockerplatforms.CacheEntry{entry})
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+func (c *ClusterCache) shardName(i int) string {
+	if i == 0 {
+		return c.name
+	}
+	return fmt.Sprintf("%s-%d", c.name, i)
+}
+
+// readShards reads the objects of the cache, up to the first one missing.
+func (c *ClusterCache) readShards(ctx context.Context) ([]*clusterShard, error) {
+	var shards []*clusterShard
+	for i := 0; ; i++ {
+		name := c.shardName(i)
+		data, ok, write, err := c.objects.get(ctx, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading cache object %s", name)
+		}
+		if !ok {
+			return shards, nil
+		}
+		shard := &clusterShard{
+			name:    name,
+			write:   write,
+			entries: make(map[string]dockerplatforms.CacheEntry),
+		}
+		entries, err := dockerplatforms.UnmarshalCacheEntries(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading cache object %s", name)
+		}
+		for _, entry := range entries {
+			shard.entries[entry.Image] = entry
+			shard.size += entrySize(entry)
+		}
+		shards = append(shards, shard)
+	}
+}
+
+// shardEntries returns the entries of the shards, keeping the newer one of each image.
+func shardEntries(shards []*clusterShard) []dockerplatforms.CacheEntry {
+	newest := make(map[string]dockerplatforms.CacheEntry)
+	for _, shard := range shards {
+		for image, entry := range shard.entries {
+			if current, ok := newest[image]; !ok || entry.FetchedAt.After(current.FetchedAt) {
+				newest[image] = entry
+			}
+		}
+	}
+	entries := make([]dockerplatforms.CacheEntry, 0, len(newest))
+	for _, entry := range newest {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// WriteBack merges the changes into the objects, along with the changes other runs made since they were read.
+// When another run writes an object in the meantime, the merge is done again.
+func (c *ClusterCache) WriteBack(ctx context.Context) error {
+	return c.WriteChanges(ctx, func(ctx context.Context, changed []dockerplatforms.CacheEntry, removed []string) ([]dockerplatforms.CacheEntry, error) {
+		var shards []*clusterShard
+		err := retry.OnError(writeBackBackoff, func(err error) bool {
+			return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+		}, func() error {
+			var err error
+			shards, err = c.readShards(ctx)
+			if err != nil {
+				return err
+			}
+			shards = c.merge(shards, changed, removed)
+			return c.writeShards(ctx, shards)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return shardEntries(shards), nil
+	})
+}
+
+// merge applies the changes to the shards, and returns them with the shards to create.
+func (c *ClusterCache) merge(shards []*clusterShard, changed []dockerplatforms.CacheEntry, removed []string) []*clusterShard {
+	// An interrupted WriteBack may leave an entry in two objects; keep the newer one.
+	location := make(map[string]*clusterShard)
+	for _, shard := range shards {
+		for image, entry := range shard.entries {
+			other, ok := location[image]
+			switch {
+			case !ok:
+				location[image] = shard
+			case entry.FetchedAt.After(other.entries[image].FetchedAt):
+				other.remove(image)
+				location[image] = shard
+			default:
+				shard.remove(image)
+			}
+		}
+	}
+
+	for _, image := range removed {
+		if shard, ok := location[image]; ok {
+			shard.remove(image)
+			delete(location, image)
+		}
+	}
+	var pending []dockerplatforms.CacheEntry
+	for _, entry := range changed {
+		image := entry.Image
+		shard, ok := location[image]
+		if !ok {
+			pending = append(pending, entry)
+			continue
+		}
+		if !entry.FetchedAt.After(shard.entries[image].FetchedAt) {
+			// Another run stored a newer entry.
+			continue
+		}
+		shard.add(entry, entrySize(entry))
+	}
+
+	maxSize := c.MaxShardSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxShardSize
+	}
+	// Move entries out of the objects grown too large, then put them with the new entries where there is room.
+	for _, shard := range shards {
+		for shard.size > maxSize && len(shard.entries) > 1 {
+			image := slices.Max(mapKeys(shard.entries))
+			pending = append(pending, shard.entries[image])
+			shard.remove(image)
+		}
+	}
+	slices.SortFunc(pending, func(a, b dockerplatforms.CacheEntry) int {
+		return strings.Compare(a.Image, b.Image)
+	})
+	for _, entry := range pending {
+		size := entrySize(entry)
+		i := slices.IndexFunc(shards, func(shard *clusterShard) bool {
+			return shard.size+size <= maxSize
+		})
+		if i < 0 {
+			i = len(shards)
+			shards = append(shards, &clusterShard{
+				name:    c.shardName(i),
+				entries: make(map[string]dockerplatforms.CacheEntry),
+			})
+		}
+		shards[i].add(entry, size)
+	}
+	return shards
+}
+
+// writeShards writes the shards that changed.
+// Those that gained entries are written first, so that an entry moved between objects is never lost.
+func (c *ClusterCache) writeShards(ctx context.Context, shards []*clusterShard) error {
+	var changed []*clusterShard
+	for _, shard := range shards {
+		if shard.gained && !shard.lost {
+			changed = append(changed, shard)
+		}
+	}
+	for _, shard := range shards {
+		if shard.lost {
+			changed = append(changed, shard)
+		}
+	}
+	for _, shard := range changed {
+		entries := make([]dockerplatforms.CacheEntry, 0, len(shard.entries))
+		for _, entry := range shard.entries {
+			entries = append(entries, entry)
+		}
+		data, err := dockerplatforms.MarshalCacheEntries(entries)
+		if err != nil {
+			return err
+		}
+		if shard.write != nil {
+			err = shard.write(ctx, data)
+		} else {
+			err = c.objects.create(ctx, shard.name, data)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "writing cache object %s", shard.name)
+		}
+	}
+	return nil
+}
+
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,273 @@
+package k8splatforms_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+	"github.com/wantedly/container-platform-tools/k8splatforms"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestClusterCacheMerge(t *testing.T) {
+	ctx := context.Background()
+	testcases := []struct {
+		name     string
+		newCache func(ctx context.Context, clientset kubernetes.Interface, namespace, name string) (*k8splatforms.ClusterCache, error)
+	}{
+		{name: "ConfigMap", newCache: k8splatforms.NewConfigMapCache},
+		{name: "Secret", newCache: k8splatforms.NewSecretCache},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+
+			// Two runs start from the same empty cache and write back one after the other.
+			first, err := tc.newCache(ctx, clientset, "ci", "image-platforms")
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := tc.newCache(ctx, clientset, "ci", "image-platforms")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = first.SetCachedPlatforms(ctx, "docker.io/library/golang:latest", dockerplatforms.MustParseDockerPlatformList("linux/amd64"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = second.SetCachedPlatforms(ctx, "docker.io/library/node:latest", dockerplatforms.MustParseDockerPlatformList("linux/arm64"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, cache := range []*k8splatforms.ClusterCache{first, second} {
+				err = cache.WriteBack(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			third, err := tc.newCache(ctx, clientset, "ci", "image-platforms")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff([]string{"docker.io/library/golang:latest", "docker.io/library/node:latest"}, cachedImages(t, third)); diff != "" {
+				t.Errorf("cached images (-want +got):\n%s", diff)
+			}
+			platforms, ok, err := third.GetCachedPlatforms(ctx, "docker.io/library/node:latest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(true, ok); diff != "" {
+				t.Errorf("GetCachedPlatforms() ok (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff("linux/arm64", dockerplatforms.DockerPlatformList(platforms).String()); diff != "" {
+				t.Errorf("GetCachedPlatforms() platforms (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClusterCacheConflict(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ci", Name: "image-platforms"},
+		Data: map[string]string{k8splatforms.ClusterCacheDataKey: `docker.io/library/golang:latest:
+    platforms: linux/amd64
+    fetchedAt: 2024-01-01T00:00:00Z
+`},
+	})
+	cache, err := k8splatforms.NewConfigMapCache(ctx, clientset, "ci", "image-platforms")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another run updates the ConfigMap just before the first update.
+	conflicted := false
+	clientset.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicted {
+			return false, nil, nil
+		}
+		conflicted = true
+		err := clientset.Tracker().Update(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ci", Name: "image-platforms"},
+			Data: map[string]string{k8splatforms.ClusterCacheDataKey: `docker.io/library/golang:latest:
+    platforms: linux/amd64
+    fetchedAt: 2024-01-01T00:00:00Z
+docker.io/library/ruby:latest:
+    platforms: linux/amd64
+    fetchedAt: 2024-01-01T00:00:00Z
+`},
+		}, "ci")
+		if err != nil {
+			return true, nil, err
+		}
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, "image-platforms", nil)
+	})
+
+	err = cache.SetCachedPlatforms(ctx, "docker.io/library/node:latest", dockerplatforms.MustParseDockerPlatformList("linux/amd64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.WriteBack(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conflicted {
+		t.Fatal("expected the write-back to run into a conflict")
+	}
+
+	reread, err := k8splatforms.NewConfigMapCache(ctx, clientset, "ci", "image-platforms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{
+		"docker.io/library/golang:latest",
+		"docker.io/library/node:latest",
+		"docker.io/library/ruby:latest",
+	}, cachedImages(t, reread)); diff != "" {
+		t.Errorf("cached images (-want +got):\n%s", diff)
+	}
+}
+
+func TestClusterCacheShards(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	cache, err := k8splatforms.NewConfigMapCache(ctx, clientset, "ci", "image-platforms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each entry takes under 100 bytes, so two fit in each ConfigMap.
+	cache.MaxShardSize = 200
+	for _, image := range []string{
+		"docker.io/library/golang:latest",
+		"docker.io/library/node:latest",
+		"docker.io/library/ruby:latest",
+		"docker.io/library/rust:latest",
+		"docker.io/library/python:latest",
+	} {
+		err = cache.SetCachedPlatforms(ctx, image, dockerplatforms.MustParseDockerPlatformList("linux/amd64"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = cache.WriteBack(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configMaps, err := clientset.CoreV1().ConfigMaps("ci").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, configMap := range configMaps.Items {
+		names = append(names, configMap.Name)
+		if size := len(configMap.Data[k8splatforms.ClusterCacheDataKey]); size > cache.MaxShardSize {
+			t.Errorf("ConfigMap %s holds %d bytes of entries", configMap.Name, size)
+		}
+	}
+	if diff := cmp.Diff([]string{"image-platforms", "image-platforms-1", "image-platforms-2"}, names); diff != "" {
+		t.Errorf("ConfigMaps (-want +got):\n%s", diff)
+	}
+
+	reread, err := k8splatforms.NewConfigMapCache(ctx, clientset, "ci", "image-platforms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{
+		"docker.io/library/golang:latest",
+		"docker.io/library/node:latest",
+		"docker.io/library/python:latest",
+		"docker.io/library/ruby:latest",
+		"docker.io/library/rust:latest",
+	}, cachedImages(t, reread)); diff != "" {
+		t.Errorf("cached images (-want +got):\n%s", diff)
+	}
+}
+
+func cachedImages(t *testing.T, cache dockerplatforms.ManagedCache) []string {
+	t.Helper()
+
+	entries, err := cache.Entries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var images []string
+	for _, entry := range entries {
+		images = append(images, entry.Image)
+	}
+	return images
+}
+
+func TestClusterCacheConcurrently(t *testing.T) {
+	ctx := context.Background()
+	testcases := []struct {
+		name     string
+		newCache func(ctx context.Context, clientset kubernetes.Interface, namespace, name string) (*k8splatforms.ClusterCache, error)
+	}{
+		{name: "ConfigMap", newCache: k8splatforms.NewConfigMapCache},
+		{name: "Secret", newCache: k8splatforms.NewSecretCache},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cache, err := tc.newCache(ctx, fake.NewSimpleClientset(), "ci", "image-platforms")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 32; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					image := fmt.Sprintf("docker.io/library/app%d:latest", i%4)
+					digestImage := fmt.Sprintf("docker.io/library/app%d@sha256:%064d", i%4, i%4)
+					err := cache.SetCachedPlatforms(ctx, digestImage, []dockerplatforms.DockerPlatform{dockerplatforms.LinuxAMD64})
+					if err != nil {
+						t.Error(err)
+					}
+					err = cache.SetCachedDigest(ctx, image, "sha256:0000000000000000000000000000000000000000000000000000000000000000")
+					if err != nil {
+						t.Error(err)
+					}
+					_, _, err = cache.GetCachedPlatforms(ctx, digestImage)
+					if err != nil {
+						t.Error(err)
+					}
+					_, _, err = cache.GetCachedDigest(ctx, image)
+					if err != nil {
+						t.Error(err)
+					}
+					cache.SetErrorCache(ctx, image+"-broken", errors.New("manifest unknown"))
+					err = cache.ClearCachedPlatforms(ctx, image)
+					if err != nil {
+						t.Error(err)
+					}
+					if i%8 == 0 {
+						err = cache.WriteBack(ctx)
+						if err != nil {
+							t.Error(err)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			err = cache.WriteBack(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
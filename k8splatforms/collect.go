@@ -2,6 +2,7 @@ package k8splatforms
 
 import (
 	"context"
+	"io"
 	"time"
 
 	"github.com/pkg/errors"
@@ -14,53 +15,102 @@ import (
 )
 
 type Collector struct {
-	RESTConfig        *rest.Config
-	After             time.Time
-	NodePlatforms     dockerplatforms.DockerPlatformList
-	PlatformInspector dockerplatforms.PlatformInspector
-	Processors        []KindProcessor
+	RESTConfig *rest.Config
+	After      time.Time
+	// NodePlatforms may hold patterns such as linux/*, standing for the matching platforms of the nodes of the cluster.
+	NodePlatforms dockerplatforms.DockerPlatformList
+	// NodePlatformsFromNodes takes the node platforms from the nodes of the cluster instead of NodePlatforms,
+	// with the x86-64 levels of amd64 nodes as NodePlatform tells them.
+	NodePlatformsFromNodes bool
+	PlatformInspector      dockerplatforms.PlatformInspector
+	// UsePullSecrets makes image lookups use the imagePullSecrets of each workload.
+	UsePullSecrets bool
+	// Warnings receives the warnings of the run, such as pull secrets the user may not read.
+	// When nil, they are discarded.
+	Warnings io.Writer
+	// Concurrency is the number of image lookups run at once.
+	Concurrency int
+	// VerifyPlatforms checks the platforms of image indexes against the configs of their images.
+	VerifyPlatforms bool
+	// CompatiblePlatforms counts the 32-bit images nodes run besides their own platforms, as EvaluateOptions.CompatiblePlatforms does.
+	CompatiblePlatforms bool
+	// Emulation tells the platforms nodes emulate, as EvaluateOptions.Emulation does.
+	Emulation  Emulation
+	Processors []KindProcessor
 }
 
+// Collect evaluates the objects of the cluster, and returns the rows with the node platforms they were evaluated for:
+// NodePlatforms with its patterns expanded, or the platforms of the nodes with NodePlatformsFromNodes.
 func (c Collector) Collect(
 	ctx context.Context,
-) ([]Row, error) {
+) ([]Row, dockerplatforms.DockerPlatformList, error) {
 	clientset, err := kubernetes.NewForConfig(c.RESTConfig)
 	if err != nil {
-		return nil, errors.Wrap(err, "creating clientset")
+		return nil, nil, errors.Wrap(err, "creating clientset")
 	}
 
 	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to list nodes")
+		return nil, nil, errors.Wrap(err, "failed to list nodes")
 	}
 
 	mClientset, err := versioned.NewForConfig(c.RESTConfig)
 	if err != nil {
-		return nil, errors.Wrap(err, "creating clientset for metrics")
+		return nil, nil, errors.Wrap(err, "creating clientset for metrics")
 	}
 	metricses, err := mClientset.MetricsV1beta1().PodMetricses("").List(ctx, metav1.ListOptions{})
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to list pod metricses")
+		return nil, nil, errors.Wrap(err, "failed to list pod metricses")
 	}
 
 	var objs []client.Object
 	for _, processor := range c.Processors {
 		processorObjs, err := processor.Retrieve(ctx, c.RESTConfig, clientset)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to retrieve objects")
+			return nil, nil, errors.Wrap(err, "failed to retrieve objects")
 		}
 		objs = append(objs, processorObjs...)
 	}
 	objs = SortObjects(objs)
 
-	return EvaluateObjects(
+	var pullSecrets *PullSecrets
+	if c.UsePullSecrets {
+		pullSecrets = NewPullSecrets(clientset)
+		pullSecrets.Warnings = c.Warnings
+	}
+
+	nodePlatforms := c.NodePlatforms
+	if c.NodePlatformsFromNodes || nodePlatforms.HasPattern() {
+		clusterPlatforms, err := NodePlatforms(nodes.Items)
+		if err != nil {
+			return nil, nil, err
+		}
+		if c.NodePlatformsFromNodes {
+			nodePlatforms = clusterPlatforms
+		} else {
+			nodePlatforms, err = nodePlatforms.Expand(clusterPlatforms)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "expanding node platforms")
+			}
+		}
+	}
+
+	rows, errs := EvaluateObjects(
 		ctx,
 		objs,
 		nodes.Items,
 		metricses.Items,
 		c.After,
-		c.NodePlatforms,
+		nodePlatforms,
 		c.PlatformInspector,
+		pullSecrets,
 		c.Processors,
+		EvaluateOptions{
+			Concurrency:         c.Concurrency,
+			VerifyPlatforms:     c.VerifyPlatforms,
+			CompatiblePlatforms: c.CompatiblePlatforms,
+			Emulation:           c.Emulation,
+		},
 	)
+	return rows, nodePlatforms, errs
 }
@@ -0,0 +1,69 @@
+package k8splatforms
+
+import (
+	"encoding/json"
+
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+)
+
+// Emulation tells the foreign platforms nodes emulate, such as linux/amd64 on linux/arm64 nodes
+// running the QEMU handlers of binfmt_misc, by node platform or pattern such as */arm64.
+// The emulated platforms may be patterns too, such as linux/* for every platform the handlers cover.
+type Emulation map[dockerplatforms.DockerPlatform]dockerplatforms.DockerPlatformList
+
+// NewMatcher creates a Matcher for the image platforms the host runs under emulation.
+// It does not match the platforms the host runs natively, unless it also emulates them.
+func (e Emulation) NewMatcher(host dockerplatforms.DockerPlatform) dockerplatforms.Matcher {
+	var emulated dockerplatforms.DockerPlatformList
+	for pattern, platforms := range e {
+		if pattern.Includes(host) {
+			emulated = append(emulated, platforms...)
+		}
+	}
+	return emulationMatcher(emulated)
+}
+
+type emulationMatcher dockerplatforms.DockerPlatformList
+
+// Match implements dockerplatforms.Matcher.
+func (m emulationMatcher) Match(platform dockerplatforms.DockerPlatform) bool {
+	for _, emulated := range m {
+		if emulated.IsPattern() {
+			if emulated.Includes(platform) {
+				return true
+			}
+		} else if dockerplatforms.NewMatcher(emulated).Match(platform) {
+			return true
+		}
+	}
+	return false
+}
+
+// RunMode tells how a workload runs on the platforms it is declared for.
+type RunMode int
+
+const (
+	// RunsNatively is for workloads whose images all run natively on every declared platform.
+	RunsNatively RunMode = iota
+	// RunsUnderEmulation is for workloads running on every declared platform, but under emulation on some.
+	RunsUnderEmulation
+	// CannotRun is for workloads with an image running on some declared platform neither natively nor under emulation.
+	CannotRun
+)
+
+func (m RunMode) String() string {
+	switch m {
+	case RunsNatively:
+		return "RunsNatively"
+	case RunsUnderEmulation:
+		return "RunsUnderEmulation"
+	case CannotRun:
+		return "CannotRun"
+	default:
+		return "Unknown"
+	}
+}
+
+func (m RunMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
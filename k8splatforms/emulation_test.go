@@ -0,0 +1,127 @@
+package k8splatforms_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+	dockerplatformstesting "github.com/wantedly/container-platform-tools/dockerplatforms/testing"
+	"github.com/wantedly/container-platform-tools/k8splatforms"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestEvaluateObjectsEmulation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	inspector := dockerplatformstesting.NewMockPlatformInspector(ctrl)
+	inspector.EXPECT().Inspect(gomock.Any(), "app:amd64", gomock.Any()).Return(
+		dockerplatforms.InspectResult{
+			Platforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64"),
+		},
+		nil,
+	).AnyTimes()
+	inspector.EXPECT().Inspect(gomock.Any(), "sidecar:multiarch", gomock.Any()).Return(
+		dockerplatforms.InspectResult{
+			Platforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm64/v8"),
+		},
+		nil,
+	).AnyTimes()
+
+	testcases := []struct {
+		name                    string
+		emulation               k8splatforms.Emulation
+		runMode                 k8splatforms.RunMode
+		emulatedPlatforms       dockerplatforms.DockerPlatformList
+		emulatedPlatformDetails map[string]dockerplatforms.DockerPlatformList
+	}{
+		{
+			name:    "no emulation",
+			runMode: k8splatforms.CannotRun,
+		},
+		{
+			name: "emulated amd64",
+			emulation: k8splatforms.Emulation{
+				dockerplatforms.LinuxARM64: dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/riscv64"),
+			},
+			runMode:           k8splatforms.RunsUnderEmulation,
+			emulatedPlatforms: dockerplatforms.MustParseDockerPlatformList("linux/arm64"),
+			emulatedPlatformDetails: map[string]dockerplatforms.DockerPlatformList{
+				"app": dockerplatforms.MustParseDockerPlatformList("linux/arm64"),
+			},
+		},
+		{
+			name: "patterns",
+			emulation: k8splatforms.Emulation{
+				dockerplatforms.MustParseDockerPlatform("*/arm64"): dockerplatforms.MustParseDockerPlatformList("linux/*"),
+			},
+			runMode:           k8splatforms.RunsUnderEmulation,
+			emulatedPlatforms: dockerplatforms.MustParseDockerPlatformList("linux/arm64"),
+			emulatedPlatformDetails: map[string]dockerplatforms.DockerPlatformList{
+				"app": dockerplatforms.MustParseDockerPlatformList("linux/arm64"),
+			},
+		},
+		{
+			name: "other emulated platforms",
+			emulation: k8splatforms.Emulation{
+				dockerplatforms.LinuxARM64: dockerplatforms.MustParseDockerPlatformList("linux/riscv64"),
+			},
+			runMode: k8splatforms.CannotRun,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			rows, err := k8splatforms.EvaluateObjects(
+				context.Background(),
+				[]client.Object{
+					&corev1.Pod{
+						TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+						ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default", CreationTimestamp: metav1.NewTime(time1)},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{
+								{Name: "app", Image: "app:amd64"},
+								{Name: "sidecar", Image: "sidecar:multiarch"},
+							},
+						},
+					},
+				},
+				nil,
+				nil,
+				time1,
+				dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm64"),
+				inspector,
+				nil,
+				[]k8splatforms.KindProcessor{&k8splatforms.PodProcessor{}},
+				k8splatforms.EvaluateOptions{Concurrency: 1, Emulation: tc.emulation},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.runMode, rows[0].RunMode); diff != "" {
+				t.Errorf("RunMode (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.runMode == k8splatforms.CannotRun, rows[0].HasViolation); diff != "" {
+				t.Errorf("HasViolation (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.emulatedPlatforms, rows[0].EmulatedPlatforms); diff != "" {
+				t.Errorf("EmulatedPlatforms (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.emulatedPlatformDetails, rows[0].EmulatedPlatformDetails); diff != "" {
+				t.Errorf("EmulatedPlatformDetails (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunModeMarshalJSON(t *testing.T) {
+	data, err := json.Marshal(k8splatforms.RunsUnderEmulation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(`"RunsUnderEmulation"`, string(data)); diff != "" {
+		t.Errorf("json.Marshal() (-want +got):\n%s", diff)
+	}
+}
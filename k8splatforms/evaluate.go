@@ -2,8 +2,12 @@ package k8splatforms
 
 import (
 	"context"
+	"slices"
+	"sync"
 	"time"
 
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/wantedly/container-platform-tools/dockerplatforms"
 	corev1 "k8s.io/api/core/v1"
@@ -22,12 +26,43 @@ type Row struct {
 	DeclaredPlatforms    dockerplatforms.DockerPlatformList
 	ImagePlatforms       dockerplatforms.DockerPlatformList
 	ImagePlatformDetails map[string]dockerplatforms.DockerPlatformList
-	HasViolation         bool
-	CPUUsage             float64
-	MemoryUsage          float64
-	Error                string
+	// ImageDigests are the manifest digests the container images resolved to, by container name.
+	ImageDigests map[string]digest.Digest
+	// PlatformMismatches are the index entries disagreeing with their configs, by container name.
+	// They are only looked for when EvaluateOptions.VerifyPlatforms is set.
+	PlatformMismatches map[string][]dockerplatforms.PlatformMismatch
+	// RunMode tells if the workload runs natively on its declared platforms, under emulation or not at all.
+	// Emulation is only taken into account when EvaluateOptions.Emulation is set.
+	RunMode RunMode
+	// EmulatedPlatforms are the declared platforms the workload only runs on under emulation.
+	EmulatedPlatforms dockerplatforms.DockerPlatformList
+	// EmulatedPlatformDetails are the declared platforms each container only runs on under emulation, by container name.
+	EmulatedPlatformDetails map[string]dockerplatforms.DockerPlatformList
+	// HasViolation tells that the workload cannot run on some of its declared platforms, as RunMode is CannotRun.
+	HasViolation bool
+	CPUUsage     float64
+	MemoryUsage  float64
+	Error        string
 }
 
+// EvaluateOptions are the options of EvaluateObjects.
+type EvaluateOptions struct {
+	// Concurrency is the number of image lookups, or of pull secret resolutions before them, run at once.
+	Concurrency int
+	// VerifyPlatforms checks the platforms of image indexes against the configs of their images,
+	// as dockerplatforms.InspectOptions.VerifyPlatforms does.
+	VerifyPlatforms bool
+	// CompatiblePlatforms counts the 32-bit platforms nodes run besides their own,
+	// such as linux/arm/v7 on linux/arm64 nodes, as dockerplatforms.NewCompatibleMatcher does.
+	CompatiblePlatforms bool
+	// Emulation counts the platforms nodes emulate,
+	// telling the workloads running under emulation apart from those not running at all.
+	Emulation Emulation
+}
+
+// EvaluateObjects evaluates the virtual pods of the objects.
+// The pull secrets of the pods are resolved first, then their distinct images are looked up once per set of pull credentials,
+// with up to opts.Concurrency lookups at once; rows are returned in the order of the objects.
 func EvaluateObjects(
 	ctx context.Context,
 	objs []client.Object,
@@ -36,9 +71,19 @@ func EvaluateObjects(
 	after time.Time,
 	nodePlatforms dockerplatforms.DockerPlatformList,
 	platformInspector dockerplatforms.PlatformInspector,
+	pullSecrets *PullSecrets,
 	processors []KindProcessor,
+	opts EvaluateOptions,
 ) ([]Row, errorutil.Aggregate) {
-	nodePlatforms = nodePlatforms.Variantless()
+	normalized := make(dockerplatforms.DockerPlatformList, len(nodePlatforms))
+	for i, nodePlatform := range nodePlatforms {
+		normalized[i] = nodePlatform.Normalize()
+	}
+	nodePlatforms = normalized.Normalized()
+	newMatcher := dockerplatforms.NewMatcher
+	if opts.CompatiblePlatforms {
+		newMatcher = dockerplatforms.NewCompatibleMatcher
+	}
 	nodesByName := make(map[string]*corev1.Node)
 	for _, node := range nodes {
 		nodesByName[node.Name] = &node
@@ -48,24 +93,81 @@ func EvaluateObjects(
 		metricsesByName[metrics.Namespace+"/"+metrics.Name] = &metrics
 	}
 
-	var rows []Row
-	var errs []error
+	type job struct {
+		obj        client.Object
+		virtualPod VirtualPod
+		// ctx and scope carry the pull credentials of the pod, resolved from pullSecrets.
+		ctx     context.Context
+		scope   string
+		pullErr error
+		// lookups are the indices of the lookups of the containers.
+		lookups []int
+	}
+	type lookupKey struct {
+		image string
+		// short keeps short names apart from their docker.io names, as unqualified-search registries may resolve them elsewhere.
+		short bool
+		scope string
+	}
+	var jobs []job
 	for _, obj := range objs {
-		var virtualPods []VirtualPod
 		for _, processor := range processors {
 			if obj.GetCreationTimestamp().After(after) || processor.IsActive(obj) {
-				virtualPods = append(virtualPods, processor.VirtualPods(obj)...)
+				for _, virtualPod := range processor.VirtualPods(obj) {
+					jobs = append(jobs, job{obj: obj, virtualPod: virtualPod, ctx: ctx})
+				}
 				break
 			}
 		}
-		for _, virtualPod := range virtualPods {
-			row, err := evaluateVirtualPod(ctx, obj, nodesByName, metricsesByName, nodePlatforms, platformInspector, virtualPod)
+	}
+
+	// The pull secrets are resolved with the concurrency of the inspections, as they take API calls.
+	if pullSecrets != nil {
+		forEachConcurrently(len(jobs), opts.Concurrency, func(i int) {
+			j := &jobs[i]
+			pullCtx, pullScope, err := pullSecrets.withPullCredentials(ctx, j.obj.GetNamespace(), j.virtualPod.Spec)
 			if err != nil {
-				for _, err := range err.Errors() {
-					errs = append(errs, errors.Wrap(err, "evaluating pod platforms"))
-				}
+				j.pullErr = errors.Wrap(err, "resolving image pull secrets")
+			} else {
+				j.ctx, j.scope = pullCtx, pullScope
+			}
+		})
+	}
+
+	var lookups []imageLookup
+	lookupIndices := make(map[lookupKey]int)
+	for i := range jobs {
+		j := &jobs[i]
+		for _, container := range j.virtualPod.Spec.Containers {
+			key := lookupKey{image: normalizeImage(container.Image), short: dockerplatforms.IsShortName(container.Image), scope: j.scope}
+			index, ok := lookupIndices[key]
+			if !ok {
+				index = len(lookups)
+				lookupIndices[key] = index
+				lookups = append(lookups, imageLookup{ctx: j.ctx, image: container.Image})
+			}
+			j.lookups = append(j.lookups, index)
+		}
+	}
+
+	inspectOptions := dockerplatforms.InspectOptions{VerifyPlatforms: opts.VerifyPlatforms}
+	forEachConcurrently(len(lookups), opts.Concurrency, func(i int) {
+		lookups[i].result, lookups[i].err = platformInspector.Inspect(lookups[i].ctx, lookups[i].image, inspectOptions)
+	})
+
+	rows := make([]Row, len(jobs))
+	var errs []error
+	for i, job := range jobs {
+		results := make([]imageLookup, len(job.lookups))
+		for k, index := range job.lookups {
+			results[k] = lookups[index]
+		}
+		var err errorutil.Aggregate
+		rows[i], err = evaluateVirtualPod(job.obj, nodesByName, metricsesByName, nodePlatforms, newMatcher, opts.Emulation, job.virtualPod, job.pullErr, results)
+		if err != nil {
+			for _, err := range err.Errors() {
+				errs = append(errs, errors.Wrap(err, "evaluating pod platforms"))
 			}
-			rows = append(rows, row)
 		}
 	}
 	if len(errs) > 0 {
@@ -74,23 +176,48 @@ func EvaluateObjects(
 	return rows, nil
 }
 
+// imageLookup is a lookup of the platforms of an image, shared by the containers using the image
+// with the same pull credentials.
+type imageLookup struct {
+	ctx    context.Context
+	image  string
+	result dockerplatforms.InspectResult
+	err    error
+}
+
+// normalizeImage returns the image reference as the lookups see it,
+// so that differently spelled references to an image are looked up once.
+func normalizeImage(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return image
+	}
+	return reference.TagNameOnly(named).String()
+}
+
+// evaluateVirtualPod makes the row of a virtual pod from the lookups of its containers, in the order of the containers.
 func evaluateVirtualPod(
-	ctx context.Context,
 	obj client.Object,
 	nodesByName map[string]*corev1.Node,
 	metricsesByName map[string]*metricsv1beta1.PodMetrics,
 	nodePlatforms dockerplatforms.DockerPlatformList,
-	platformInspector dockerplatforms.PlatformInspector,
+	newMatcher func(host dockerplatforms.DockerPlatform) dockerplatforms.Matcher,
+	emulation Emulation,
 	virtualPod VirtualPod,
+	pullErr error,
+	lookups []imageLookup,
 ) (Row, errorutil.Aggregate) {
+	var errs []error
 	var scheduledPlatform *dockerplatforms.DockerPlatform
 	var cpuUsage float64
 	var memoryUsage float64
 	if pod, ok := obj.(*corev1.Pod); ok {
 		if node, ok := nodesByName[pod.Spec.NodeName]; ok {
-			scheduledPlatform = &dockerplatforms.DockerPlatform{
-				OS:           node.ObjectMeta.Labels["kubernetes.io/os"],
-				Architecture: node.ObjectMeta.Labels["kubernetes.io/arch"],
+			platform, err := NodePlatform(*node)
+			if err != nil {
+				errs = append(errs, err)
+			} else {
+				scheduledPlatform = &platform
 			}
 		}
 		if metrics, ok := metricsesByName[pod.Namespace+"/"+pod.Name]; ok {
@@ -109,40 +236,86 @@ func evaluateVirtualPod(
 		Spec:       virtualPod.Spec,
 	}, nodePlatforms)
 	imagePlatformDetails := make(map[string]dockerplatforms.DockerPlatformList)
+	imageDigests := make(map[string]digest.Digest)
+	var platformMismatches map[string][]dockerplatforms.PlatformMismatch
 	var imagePlatforms dockerplatforms.DockerPlatformList
+	var emulatedPlatformDetails map[string]dockerplatforms.DockerPlatformList
+	// runnablePlatforms are the node platforms running all the images, natively or under emulation.
+	var runnablePlatforms dockerplatforms.DockerPlatformList
 	found := false
-	var errs []error
-	for _, container := range virtualPod.Spec.Containers {
-		platforms, err := platformInspector.GetPlatforms(ctx, container.Image)
+	if pullErr != nil {
+		errs = append(errs, pullErr)
+	}
+	for i, container := range virtualPod.Spec.Containers {
+		result, err := lookups[i].result, lookups[i].err
 		if err != nil {
 			errs = append(errs, errors.Wrap(err, "inspecting image platforms"))
 			continue
 		}
-		platforms2 := dockerplatforms.DockerPlatformList(platforms).Variantless()
+		platforms2 := onNodePlatforms(result.Platforms, nodePlatforms, newMatcher)
 		imagePlatformDetails[container.Name] = platforms2
+		emulated := slices.DeleteFunc(
+			dockerplatforms.DockerPlatformList(result.Platforms).IntersectionMatching(nodePlatforms, emulation.NewMatcher),
+			func(platform dockerplatforms.DockerPlatform) bool { return slices.Contains(platforms2, platform) },
+		)
+		if emulatedDeclared := declaredPlatforms.Intersection(emulated); len(emulatedDeclared) > 0 {
+			if emulatedPlatformDetails == nil {
+				emulatedPlatformDetails = make(map[string]dockerplatforms.DockerPlatformList)
+			}
+			emulatedPlatformDetails[container.Name] = emulatedDeclared
+		}
+		runnable := append(slices.Clone(platforms2), emulated...).Normalized()
+		if result.Digest != "" {
+			imageDigests[container.Name] = result.Digest
+		}
+		if len(result.Mismatches) > 0 {
+			if platformMismatches == nil {
+				platformMismatches = make(map[string][]dockerplatforms.PlatformMismatch)
+			}
+			platformMismatches[container.Name] = result.Mismatches
+		}
 		if found {
 			imagePlatforms = imagePlatforms.Intersection(platforms2)
+			runnablePlatforms = runnablePlatforms.Intersection(runnable)
 		} else {
 			imagePlatforms = platforms2
+			runnablePlatforms = runnable
 			found = true
 		}
 	}
 	if !found {
 		imagePlatforms = nodePlatforms
+		runnablePlatforms = nodePlatforms
+	}
+	runMode := RunsNatively
+	var emulatedPlatforms dockerplatforms.DockerPlatformList
+	if !imagePlatforms.Includes(declaredPlatforms) {
+		runMode = CannotRun
+		if runnablePlatforms.Includes(declaredPlatforms) {
+			runMode = RunsUnderEmulation
+			emulatedPlatforms = slices.DeleteFunc(slices.Clone(declaredPlatforms), func(platform dockerplatforms.DockerPlatform) bool {
+				return slices.Contains(imagePlatforms, platform)
+			})
+		}
 	}
 	row := Row{
-		Namespace:            obj.GetNamespace(),
-		APIVersion:           obj.GetObjectKind().GroupVersionKind().GroupVersion().String(),
-		Kind:                 obj.GetObjectKind().GroupVersionKind().Kind,
-		Name:                 obj.GetName(),
-		SubName:              virtualPod.SubName,
-		ScheduledPlatform:    scheduledPlatform,
-		DeclaredPlatforms:    declaredPlatforms,
-		ImagePlatforms:       imagePlatforms,
-		ImagePlatformDetails: imagePlatformDetails,
-		HasViolation:         !imagePlatforms.Includes(declaredPlatforms),
-		CPUUsage:             cpuUsage,
-		MemoryUsage:          memoryUsage,
+		Namespace:               obj.GetNamespace(),
+		APIVersion:              obj.GetObjectKind().GroupVersionKind().GroupVersion().String(),
+		Kind:                    obj.GetObjectKind().GroupVersionKind().Kind,
+		Name:                    obj.GetName(),
+		SubName:                 virtualPod.SubName,
+		ScheduledPlatform:       scheduledPlatform,
+		DeclaredPlatforms:       declaredPlatforms,
+		ImagePlatforms:          imagePlatforms,
+		ImagePlatformDetails:    imagePlatformDetails,
+		ImageDigests:            imageDigests,
+		PlatformMismatches:      platformMismatches,
+		RunMode:                 runMode,
+		EmulatedPlatforms:       emulatedPlatforms,
+		EmulatedPlatformDetails: emulatedPlatformDetails,
+		HasViolation:            runMode == CannotRun,
+		CPUUsage:                cpuUsage,
+		MemoryUsage:             memoryUsage,
 	}
 	if len(errs) > 0 {
 		row.Error = errs[0].Error()
@@ -150,3 +323,38 @@ func evaluateVirtualPod(
 	}
 	return row, nil
 }
+
+// onNodePlatforms expresses image platforms as the node platforms able to run them,
+// so that they compare equal to the platforms pods are declared for.
+// Image platforms no node can run are kept as they are, normalized and without OS features.
+func onNodePlatforms(imagePlatforms, nodePlatforms dockerplatforms.DockerPlatformList, newMatcher func(host dockerplatforms.DockerPlatform) dockerplatforms.Matcher) dockerplatforms.DockerPlatformList {
+	result := imagePlatforms.IntersectionMatching(nodePlatforms, newMatcher)
+	for _, imagePlatform := range imagePlatforms {
+		if len(dockerplatforms.DockerPlatformList{imagePlatform}.IntersectionMatching(nodePlatforms, newMatcher)) == 0 {
+			imagePlatform = imagePlatform.Normalize()
+			imagePlatform.OSFeatures = ""
+			result = append(result, imagePlatform)
+		}
+	}
+	return result.Normalized()
+}
+
+// forEachConcurrently calls fn with the indices from 0 to n-1, on at most concurrency goroutines at once.
+func forEachConcurrently(n, concurrency int, fn func(i int)) {
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for range min(max(concurrency, 1), n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				fn(i)
+			}
+		}()
+	}
+	for i := range n {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
@@ -2,10 +2,15 @@ package k8splatforms_test
 
 import (
 	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
 	"github.com/wantedly/container-platform-tools/dockerplatforms"
 	dockerplatformstesting "github.com/wantedly/container-platform-tools/dockerplatforms/testing"
 	"github.com/wantedly/container-platform-tools/k8splatforms"
@@ -19,6 +24,11 @@ import (
 
 var time1 = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
 
+const (
+	golangDigest   = digest.Digest("sha256:1111111111111111111111111111111111111111111111111111111111111111")
+	golang15Digest = digest.Digest("sha256:2222222222222222222222222222222222222222222222222222222222222222")
+)
+
 func TestEvaluateObjects(t *testing.T) {
 	ctx := context.Background()
 	ctrl := gomock.NewController(t)
@@ -33,12 +43,18 @@ func TestEvaluateObjects(t *testing.T) {
 		},
 	}
 	inspector := dockerplatformstesting.NewMockPlatformInspector(ctrl)
-	inspector.EXPECT().GetPlatforms(gomock.Any(), "golang").Return(
-		dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm/v7, linux/arm64/v8, linux/386, linux/mips64le, linux/ppc64le, linux/s390x, windows/amd64, windows/amd64"),
+	inspector.EXPECT().Inspect(gomock.Any(), "golang", gomock.Any()).Return(
+		dockerplatforms.InspectResult{
+			Digest:    golangDigest,
+			Platforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm/v7, linux/arm64/v8, linux/386, linux/mips64le, linux/ppc64le, linux/s390x, windows/amd64, windows/amd64"),
+		},
 		nil,
 	).AnyTimes()
-	inspector.EXPECT().GetPlatforms(gomock.Any(), "golang:1.5").Return(
-		dockerplatforms.MustParseDockerPlatformList("linux/amd64"),
+	inspector.EXPECT().Inspect(gomock.Any(), "golang:1.5", gomock.Any()).Return(
+		dockerplatforms.InspectResult{
+			Digest:    golang15Digest,
+			Platforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64"),
+		},
 		nil,
 	).AnyTimes()
 	processors := []k8splatforms.KindProcessor{
@@ -64,7 +80,7 @@ func TestEvaluateObjects(t *testing.T) {
 			nodes:     nil,
 			metricses: nil,
 			after:     time1,
-			expected:  nil,
+			expected:  []k8splatforms.Row{},
 		},
 		{
 			name: "pod",
@@ -174,9 +190,12 @@ func TestEvaluateObjects(t *testing.T) {
 					Kind:              "Pod",
 					Name:              "pod1",
 					DeclaredPlatforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm64"),
-					ImagePlatforms:    dockerplatforms.MustParseDockerPlatformList("linux/386, linux/amd64, linux/arm, linux/arm64, linux/mips64le, linux/ppc64le, linux/s390x, windows/amd64"),
+					ImagePlatforms:    dockerplatforms.MustParseDockerPlatformList("linux/386, linux/amd64, linux/arm/v7, linux/arm64, linux/mips64le, linux/ppc64le, linux/s390x, windows/amd64"),
 					ImagePlatformDetails: map[string]dockerplatforms.DockerPlatformList{
-						"container1": dockerplatforms.MustParseDockerPlatformList("linux/386, linux/amd64, linux/arm, linux/arm64, linux/mips64le, linux/ppc64le, linux/s390x, windows/amd64"),
+						"container1": dockerplatforms.MustParseDockerPlatformList("linux/386, linux/amd64, linux/arm/v7, linux/arm64, linux/mips64le, linux/ppc64le, linux/s390x, windows/amd64"),
+					},
+					ImageDigests: map[string]digest.Digest{
+						"container1": golangDigest,
 					},
 					HasViolation: false,
 				},
@@ -189,9 +208,14 @@ func TestEvaluateObjects(t *testing.T) {
 					DeclaredPlatforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm64"),
 					ImagePlatforms:    dockerplatforms.MustParseDockerPlatformList("linux/amd64"),
 					ImagePlatformDetails: map[string]dockerplatforms.DockerPlatformList{
-						"container1": dockerplatforms.MustParseDockerPlatformList("linux/386, linux/amd64, linux/arm, linux/arm64, linux/mips64le, linux/ppc64le, linux/s390x, windows/amd64"),
+						"container1": dockerplatforms.MustParseDockerPlatformList("linux/386, linux/amd64, linux/arm/v7, linux/arm64, linux/mips64le, linux/ppc64le, linux/s390x, windows/amd64"),
 						"container2": dockerplatforms.MustParseDockerPlatformList("linux/amd64"),
 					},
+					ImageDigests: map[string]digest.Digest{
+						"container1": golangDigest,
+						"container2": golang15Digest,
+					},
+					RunMode:      k8splatforms.CannotRun,
 					HasViolation: true,
 					CPUUsage:     0.75,
 					MemoryUsage:  470568037.0,
@@ -210,7 +234,9 @@ func TestEvaluateObjects(t *testing.T) {
 				tc.after,
 				nodePlatforms,
 				inspector,
+				nil,
 				processors,
+				k8splatforms.EvaluateOptions{Concurrency: 4},
 			)
 			if err != nil {
 				t.Fatal(err)
@@ -222,6 +248,500 @@ func TestEvaluateObjects(t *testing.T) {
 	}
 }
 
+func TestEvaluateObjectsConcurrentOrder(t *testing.T) {
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+
+	var inFlight, maxInFlight atomic.Int32
+	inspector := dockerplatformstesting.NewMockPlatformInspector(ctrl)
+	inspector.EXPECT().Inspect(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, image string, opts dockerplatforms.InspectOptions) (dockerplatforms.InspectResult, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		// Later images answer sooner, so that completion order differs from the object order.
+		i, _ := strconv.Atoi(strings.TrimPrefix(image, "app:"))
+		time.Sleep(time.Duration(20-i) * time.Millisecond)
+		return dockerplatforms.InspectResult{Platforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64")}, nil
+	}).Times(20)
+
+	var objs []client.Object
+	var want []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("pod%02d", i)
+		objs = append(objs, &corev1.Pod{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", CreationTimestamp: metav1.NewTime(time1)},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: fmt.Sprintf("app:%d", i)}},
+			},
+		})
+		want = append(want, name)
+	}
+
+	rows, err := k8splatforms.EvaluateObjects(
+		ctx,
+		objs,
+		nil,
+		nil,
+		time1,
+		dockerplatforms.MustParseDockerPlatformList("linux/amd64"),
+		inspector,
+		nil,
+		[]k8splatforms.KindProcessor{&k8splatforms.PodProcessor{}},
+		k8splatforms.EvaluateOptions{Concurrency: 8},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, row := range rows {
+		got = append(got, row.Name)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected row order (-want +got):\n%s", diff)
+	}
+	if n := maxInFlight.Load(); n < 2 || n > 8 {
+		t.Errorf("%d lookups in flight at once, want between 2 and 8", n)
+	}
+}
+
+func TestEvaluateObjectsDistinctImages(t *testing.T) {
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+
+	inspector := dockerplatformstesting.NewMockPlatformInspector(ctrl)
+	inspector.EXPECT().Inspect(gomock.Any(), "app:1", gomock.Any()).Return(dockerplatforms.InspectResult{Platforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64")}, nil).Times(1)
+	inspector.EXPECT().Inspect(gomock.Any(), "sidecar:1", gomock.Any()).Return(dockerplatforms.InspectResult{Platforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm64")}, nil).Times(1)
+
+	pod := func(name string, images ...string) client.Object {
+		pod := &corev1.Pod{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", CreationTimestamp: metav1.NewTime(time1)},
+		}
+		for i, image := range images {
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: fmt.Sprintf("container%d", i), Image: image})
+		}
+		return pod
+	}
+	rows, err := k8splatforms.EvaluateObjects(
+		ctx,
+		[]client.Object{
+			pod("pod1", "app:1", "sidecar:1"),
+			pod("pod2", "library/app:1"),
+			pod("pod3", "sidecar:1", "app:1"),
+		},
+		nil,
+		nil,
+		time1,
+		dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm64"),
+		inspector,
+		nil,
+		[]k8splatforms.KindProcessor{&k8splatforms.PodProcessor{}},
+		k8splatforms.EvaluateOptions{Concurrency: 4},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, row := range rows {
+		got = append(got, row.Name+": "+row.ImagePlatformDetails["container0"].String())
+	}
+	if diff := cmp.Diff([]string{
+		"pod1: linux/amd64",
+		"pod2: linux/amd64",
+		"pod3: linux/amd64, linux/arm64",
+	}, got); diff != "" {
+		t.Errorf("unexpected rows (-want +got):\n%s", diff)
+	}
+}
+
+func TestEvaluateObjectsShortNames(t *testing.T) {
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+
+	// Under unqualified-search registries, the short name may be another image than its docker.io name.
+	inspector := dockerplatformstesting.NewMockPlatformInspector(ctrl)
+	inspector.EXPECT().Inspect(gomock.Any(), "app:1.0", gomock.Any()).Return(dockerplatforms.InspectResult{Platforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm64")}, nil).Times(1)
+	inspector.EXPECT().Inspect(gomock.Any(), "docker.io/library/app:1.0", gomock.Any()).Return(dockerplatforms.InspectResult{Platforms: dockerplatforms.MustParseDockerPlatformList("linux/s390x")}, nil).Times(1)
+
+	pod := func(name, image string) client.Object {
+		return &corev1.Pod{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", CreationTimestamp: metav1.NewTime(time1)},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "container0", Image: image}}},
+		}
+	}
+	rows, err := k8splatforms.EvaluateObjects(
+		ctx,
+		[]client.Object{
+			pod("pod1", "docker.io/library/app:1.0"),
+			pod("pod2", "app:1.0"),
+			pod("pod3", "docker.io/library/app:1.0"),
+		},
+		nil,
+		nil,
+		time1,
+		dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm64"),
+		inspector,
+		nil,
+		[]k8splatforms.KindProcessor{&k8splatforms.PodProcessor{}},
+		k8splatforms.EvaluateOptions{Concurrency: 1},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, row := range rows {
+		got = append(got, row.Name+": "+row.ImagePlatformDetails["container0"].String())
+	}
+	if diff := cmp.Diff([]string{
+		"pod1: linux/s390x",
+		"pod2: linux/amd64, linux/arm64",
+		"pod3: linux/s390x",
+	}, got); diff != "" {
+		t.Errorf("unexpected rows (-want +got):\n%s", diff)
+	}
+}
+
+func TestEvaluateObjectsWindowsBuild(t *testing.T) {
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	inspector := dockerplatformstesting.NewMockPlatformInspector(ctrl)
+	inspector.EXPECT().Inspect(gomock.Any(), "app:ltsc2022", gomock.Any()).Return(
+		dockerplatforms.InspectResult{
+			Platforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64, windows(10.0.20348.2529)+win32k/amd64"),
+		},
+		nil,
+	).AnyTimes()
+	nodePlatforms := dockerplatforms.MustParseDockerPlatformList("linux/amd64, windows(10.0.17763)/amd64, windows(10.0.20348)/amd64")
+
+	testcases := []struct {
+		name         string
+		nodeSelector map[string]string
+		expected     bool
+	}{
+		{name: "any windows build", nodeSelector: map[string]string{"kubernetes.io/os": "windows"}, expected: true},
+		{name: "matching windows build", nodeSelector: map[string]string{"node.kubernetes.io/windows-build": "10.0.20348"}, expected: false},
+		{name: "other windows build", nodeSelector: map[string]string{"node.kubernetes.io/windows-build": "10.0.17763"}, expected: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			rows, err := k8splatforms.EvaluateObjects(
+				ctx,
+				[]client.Object{
+					&corev1.Pod{
+						TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+						ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default", CreationTimestamp: metav1.NewTime(time1)},
+						Spec: corev1.PodSpec{
+							NodeSelector: tc.nodeSelector,
+							Containers:   []corev1.Container{{Name: "app", Image: "app:ltsc2022"}},
+						},
+					},
+				},
+				nil,
+				nil,
+				time1,
+				nodePlatforms,
+				inspector,
+				nil,
+				[]k8splatforms.KindProcessor{&k8splatforms.PodProcessor{}},
+				k8splatforms.EvaluateOptions{Concurrency: 1},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.expected, rows[0].HasViolation); diff != "" {
+				t.Errorf("HasViolation (-want +got):\n%s\nimage platforms: %s\ndeclared platforms: %s", diff, rows[0].ImagePlatforms, rows[0].DeclaredPlatforms)
+			}
+		})
+	}
+}
+
+func TestEvaluateObjectsVariants(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	inspector := dockerplatformstesting.NewMockPlatformInspector(ctrl)
+	inspector.EXPECT().Inspect(gomock.Any(), "app:armv7", gomock.Any()).Return(
+		dockerplatforms.InspectResult{
+			Platforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64/v3, linux/arm/v7"),
+		},
+		nil,
+	).AnyTimes()
+	nodePlatforms := dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm64/v8")
+
+	testcases := []struct {
+		name       string
+		compatible bool
+		expected   dockerplatforms.DockerPlatformList
+	}{
+		{name: "strict", expected: dockerplatforms.MustParseDockerPlatformList("linux/amd64/v3, linux/arm/v7")},
+		{name: "compatible", compatible: true, expected: dockerplatforms.MustParseDockerPlatformList("linux/amd64/v3, linux/arm64")},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			rows, err := k8splatforms.EvaluateObjects(
+				context.Background(),
+				[]client.Object{
+					&corev1.Pod{
+						TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+						ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default", CreationTimestamp: metav1.NewTime(time1)},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{Name: "app", Image: "app:armv7"}},
+						},
+					},
+				},
+				nil,
+				nil,
+				time1,
+				nodePlatforms,
+				inspector,
+				nil,
+				[]k8splatforms.KindProcessor{&k8splatforms.PodProcessor{}},
+				k8splatforms.EvaluateOptions{Concurrency: 1, CompatiblePlatforms: tc.compatible},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.expected, rows[0].ImagePlatforms); diff != "" {
+				t.Errorf("ImagePlatforms (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(true, rows[0].HasViolation); diff != "" {
+				t.Errorf("HasViolation (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEvaluateObjectsAMD64Levels(t *testing.T) {
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	inspector := dockerplatformstesting.NewMockPlatformInspector(ctrl)
+	inspector.EXPECT().Inspect(gomock.Any(), "app:v3", gomock.Any()).Return(
+		dockerplatforms.InspectResult{
+			Platforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64/v3, linux/arm64"),
+		},
+		nil,
+	).AnyTimes()
+
+	testcases := []struct {
+		name          string
+		nodePlatforms dockerplatforms.DockerPlatformList
+		expected      bool
+	}{
+		{name: "x86-64-v1 nodes", nodePlatforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64"), expected: true},
+		{name: "mixed nodes", nodePlatforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64/v2, linux/amd64/v4"), expected: true},
+		{name: "x86-64-v3 nodes", nodePlatforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64/v3, linux/amd64/v4"), expected: false},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			rows, err := k8splatforms.EvaluateObjects(
+				ctx,
+				[]client.Object{
+					&corev1.Pod{
+						TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+						ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default", CreationTimestamp: metav1.NewTime(time1)},
+						Spec: corev1.PodSpec{
+							NodeSelector: map[string]string{"kubernetes.io/arch": "amd64"},
+							Containers:   []corev1.Container{{Name: "app", Image: "app:v3"}},
+						},
+					},
+				},
+				nil,
+				nil,
+				time1,
+				tc.nodePlatforms,
+				inspector,
+				nil,
+				[]k8splatforms.KindProcessor{&k8splatforms.PodProcessor{}},
+				k8splatforms.EvaluateOptions{Concurrency: 1},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.expected, rows[0].HasViolation); diff != "" {
+				t.Errorf("HasViolation (-want +got):\n%s\nimage platforms: %s\ndeclared platforms: %s", diff, rows[0].ImagePlatforms, rows[0].DeclaredPlatforms)
+			}
+		})
+	}
+}
+
+func TestEvaluateObjectsPinnedAMD64Level(t *testing.T) {
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	inspector := dockerplatformstesting.NewMockPlatformInspector(ctrl)
+	inspector.EXPECT().Inspect(gomock.Any(), "app:v3", gomock.Any()).Return(
+		dockerplatforms.InspectResult{
+			Platforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64/v3"),
+		},
+		nil,
+	).AnyTimes()
+	nodePlatforms := dockerplatforms.MustParseDockerPlatformList("linux/amd64/v2, linux/amd64/v3, linux/arm64")
+
+	testcases := []struct {
+		name             string
+		nodeSelector     map[string]string
+		affinity         *corev1.Affinity
+		expectedDeclared dockerplatforms.DockerPlatformList
+		expected         bool
+	}{
+		{
+			name:             "not pinned",
+			nodeSelector:     map[string]string{"kubernetes.io/arch": "amd64"},
+			expectedDeclared: dockerplatforms.MustParseDockerPlatformList("linux/amd64/v2, linux/amd64/v3"),
+			expected:         true,
+		},
+		{
+			name:             "level label",
+			nodeSelector:     map[string]string{k8splatforms.AMD64LevelLabel: "v3"},
+			expectedDeclared: dockerplatforms.MustParseDockerPlatformList("linux/amd64/v3"),
+			expected:         false,
+		},
+		{
+			name: "Node Feature Discovery label",
+			affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+						MatchExpressions: []corev1.NodeSelectorRequirement{
+							{Key: "feature.node.kubernetes.io/cpu-cpuid.AVX2", Operator: corev1.NodeSelectorOpIn, Values: []string{"true"}},
+						},
+					}},
+				},
+			}},
+			expectedDeclared: dockerplatforms.MustParseDockerPlatformList("linux/amd64/v3"),
+			expected:         false,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			rows, err := k8splatforms.EvaluateObjects(
+				ctx,
+				[]client.Object{
+					&corev1.Pod{
+						TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+						ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default", CreationTimestamp: metav1.NewTime(time1)},
+						Spec: corev1.PodSpec{
+							NodeSelector: tc.nodeSelector,
+							Affinity:     tc.affinity,
+							Containers:   []corev1.Container{{Name: "app", Image: "app:v3"}},
+						},
+					},
+				},
+				nil,
+				nil,
+				time1,
+				nodePlatforms,
+				inspector,
+				nil,
+				[]k8splatforms.KindProcessor{&k8splatforms.PodProcessor{}},
+				k8splatforms.EvaluateOptions{Concurrency: 1},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.expectedDeclared, rows[0].DeclaredPlatforms); diff != "" {
+				t.Errorf("DeclaredPlatforms (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.expected, rows[0].HasViolation); diff != "" {
+				t.Errorf("HasViolation (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEvaluateObjectsUnknownAMD64Level(t *testing.T) {
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	inspector := dockerplatformstesting.NewMockPlatformInspector(ctrl)
+	inspector.EXPECT().Inspect(gomock.Any(), "app:v3", gomock.Any()).Return(
+		dockerplatforms.InspectResult{
+			Platforms: dockerplatforms.MustParseDockerPlatformList("linux/amd64/v3"),
+		},
+		nil,
+	)
+
+	// The default node platforms do not tell the level, so the pod selecting AVX2 nodes is still evaluated on them.
+	rows, err := k8splatforms.EvaluateObjects(
+		ctx,
+		[]client.Object{
+			&corev1.Pod{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+				ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default", CreationTimestamp: metav1.NewTime(time1)},
+				Spec: corev1.PodSpec{
+					NodeSelector: map[string]string{"feature.node.kubernetes.io/cpu-cpuid.AVX2": "true"},
+					Containers:   []corev1.Container{{Name: "app", Image: "app:v3"}},
+				},
+			},
+		},
+		nil,
+		nil,
+		time1,
+		dockerplatforms.MustParseDockerPlatformList("linux/amd64"),
+		inspector,
+		nil,
+		[]k8splatforms.KindProcessor{&k8splatforms.PodProcessor{}},
+		k8splatforms.EvaluateOptions{Concurrency: 1},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(dockerplatforms.MustParseDockerPlatformList("linux/amd64"), rows[0].DeclaredPlatforms); diff != "" {
+		t.Errorf("DeclaredPlatforms (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(true, rows[0].HasViolation); diff != "" {
+		t.Errorf("HasViolation (-want +got):\n%s", diff)
+	}
+}
+
+func TestEvaluateObjectsPlatformMismatches(t *testing.T) {
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	mismatch := dockerplatforms.PlatformMismatch{
+		Digest:   golang15Digest,
+		Declared: dockerplatforms.LinuxARM64V8,
+		Actual:   dockerplatforms.LinuxAMD64,
+	}
+	inspector := dockerplatformstesting.NewMockPlatformInspector(ctrl)
+	inspector.EXPECT().Inspect(gomock.Any(), "app:mislabeled", dockerplatforms.InspectOptions{VerifyPlatforms: true}).Return(
+		dockerplatforms.InspectResult{
+			Digest:     golangDigest,
+			Platforms:  dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm64/v8"),
+			Mismatches: []dockerplatforms.PlatformMismatch{mismatch},
+		},
+		nil,
+	)
+
+	rows, err := k8splatforms.EvaluateObjects(
+		ctx,
+		[]client.Object{
+			&corev1.Pod{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+				ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default", CreationTimestamp: metav1.NewTime(time1)},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "app:mislabeled"}},
+				},
+			},
+		},
+		nil,
+		nil,
+		time1,
+		dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm64"),
+		inspector,
+		nil,
+		[]k8splatforms.KindProcessor{&k8splatforms.PodProcessor{}},
+		k8splatforms.EvaluateOptions{Concurrency: 1, VerifyPlatforms: true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string][]dockerplatforms.PlatformMismatch{"app": {mismatch}}, rows[0].PlatformMismatches); diff != "" {
+		t.Errorf("PlatformMismatches (-want +got):\n%s", diff)
+	}
+}
+
 func ptr[T any](value T) *T {
 	return &value
 }
@@ -0,0 +1,111 @@
+package k8splatforms
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// AMD64LevelLabel is the node label overriding the x86-64 microarchitecture level of amd64 nodes,
+// v1 to v4, for nodes without the CPU labels of Node Feature Discovery or whose labels are not to be trusted.
+// The levels may also be written 1 to 4, or x86-64-v1 to x86-64-v4.
+const AMD64LevelLabel = "container-platform-tools/amd64-level"
+
+// nfdCPUIDLabelPrefix prefixes the CPUID feature labels of Node Feature Discovery,
+// e.g. feature.node.kubernetes.io/cpu-cpuid.AVX2=true.
+// https://kubernetes-sigs.github.io/node-feature-discovery/v0.16/reference/features.html#cpu
+const nfdCPUIDLabelPrefix = "feature.node.kubernetes.io/cpu-cpuid."
+
+// amd64LevelFeatures are the CPUID features the x86-64 microarchitecture levels add, from v2,
+// as Node Feature Discovery names them.
+// Features Node Feature Discovery does not label by default, such as POPCNT, SSE4.2 and BMI2, are left out:
+// https://kubernetes-sigs.github.io/node-feature-discovery/v0.16/reference/worker-configuration-reference.html#corecpuattributeblacklist
+var amd64LevelFeatures = []struct {
+	variant  string
+	features []string
+}{
+	{variant: "v2", features: []string{"LAHF"}},
+	{variant: "v3", features: []string{"AVX", "AVX2", "FMA3", "MOVBE", "OSXSAVE"}},
+	{variant: "v4", features: []string{"AVX512F", "AVX512BW", "AVX512CD", "AVX512DQ", "AVX512VL"}},
+}
+
+// NodePlatform returns the platform of a node from its labels.
+// The variant of amd64 nodes is their x86-64 level, from AMD64LevelLabel or else from the CPU labels of Node Feature Discovery.
+// Nodes telling neither, or only x86-64-v1, are linux/amd64: node selectors on their level are assumed to match them,
+// while only the images of x86-64-v1 are taken to run on them.
+// It fails when AMD64LevelLabel is not a level.
+func NodePlatform(node corev1.Node) (dockerplatforms.DockerPlatform, error) {
+	platform := dockerplatforms.DockerPlatform{
+		OS:           node.Labels["kubernetes.io/os"],
+		Architecture: node.Labels["kubernetes.io/arch"],
+		OSVersion:    node.Labels["node.kubernetes.io/windows-build"],
+	}
+	if platform.Architecture == "amd64" {
+		if value, ok := node.Labels[AMD64LevelLabel]; ok {
+			level, ok := parseAMD64Level(value)
+			if !ok {
+				return dockerplatforms.DockerPlatform{}, errors.Errorf("node %s: invalid %s label %q: expecting v1 to v4", node.Name, AMD64LevelLabel, value)
+			}
+			platform.Variant = level
+		} else {
+			platform.Variant = nfdAMD64Level(node.Labels)
+		}
+	}
+	return platform.Normalize(), nil
+}
+
+// NodePlatforms returns the platforms of the nodes, as NodePlatform does, without duplicates.
+func NodePlatforms(nodes []corev1.Node) (dockerplatforms.DockerPlatformList, error) {
+	platforms := make(dockerplatforms.DockerPlatformList, len(nodes))
+	for i, node := range nodes {
+		platform, err := NodePlatform(node)
+		if err != nil {
+			return nil, err
+		}
+		platforms[i] = platform
+	}
+	return platforms.Normalized(), nil
+}
+
+// parseAMD64Level returns the variant of a value of AMD64LevelLabel, telling false if it is not a level.
+func parseAMD64Level(value string) (string, bool) {
+	level := strings.TrimPrefix(value, "x86-64-")
+	if !strings.HasPrefix(level, "v") {
+		level = "v" + level
+	}
+	switch level {
+	case "v1", "v2", "v3", "v4":
+		return level, true
+	default:
+		return "", false
+	}
+}
+
+// amd64FeatureLevel returns the x86-64 level adding a CPUID feature, as Node Feature Discovery names it,
+// telling false for features the levels do not tell apart.
+func amd64FeatureLevel(feature string) (string, bool) {
+	for _, l := range amd64LevelFeatures {
+		for _, f := range l.features {
+			if f == feature {
+				return l.variant, true
+			}
+		}
+	}
+	return "", false
+}
+
+// nfdAMD64Level returns the highest x86-64 level whose features, and those of the levels before it, are all labeled.
+func nfdAMD64Level(labels map[string]string) string {
+	level := ""
+	for _, l := range amd64LevelFeatures {
+		for _, feature := range l.features {
+			if labels[nfdCPUIDLabelPrefix+feature] != "true" {
+				return level
+			}
+		}
+		level = l.variant
+	}
+	return level
+}
@@ -0,0 +1,138 @@
+package k8splatforms_test
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/wantedly/container-platform-tools/k8splatforms"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNodePlatform(t *testing.T) {
+	v3Features := map[string]string{
+		"feature.node.kubernetes.io/cpu-cpuid.LAHF":    "true",
+		"feature.node.kubernetes.io/cpu-cpuid.AVX":     "true",
+		"feature.node.kubernetes.io/cpu-cpuid.AVX2":    "true",
+		"feature.node.kubernetes.io/cpu-cpuid.FMA3":    "true",
+		"feature.node.kubernetes.io/cpu-cpuid.MOVBE":   "true",
+		"feature.node.kubernetes.io/cpu-cpuid.OSXSAVE": "true",
+	}
+	testcases := []struct {
+		name        string
+		labels      map[string]string
+		expected    string
+		expectedErr string
+	}{
+		{
+			name:     "no feature labels",
+			labels:   map[string]string{},
+			expected: "linux/amd64",
+		},
+		{
+			name:     "x86-64-v3 features",
+			labels:   v3Features,
+			expected: "linux/amd64/v3",
+		},
+		{
+			name:     "x86-64-v3 features without v2",
+			labels:   without(v3Features, "feature.node.kubernetes.io/cpu-cpuid.LAHF"),
+			expected: "linux/amd64",
+		},
+		{
+			name:     "part of x86-64-v3 features",
+			labels:   without(v3Features, "feature.node.kubernetes.io/cpu-cpuid.AVX2"),
+			expected: "linux/amd64/v2",
+		},
+		{
+			name:     "override",
+			labels:   with(v3Features, k8splatforms.AMD64LevelLabel, "v1"),
+			expected: "linux/amd64",
+		},
+		{
+			name:     "override without feature labels",
+			labels:   map[string]string{k8splatforms.AMD64LevelLabel: "v4"},
+			expected: "linux/amd64/v4",
+		},
+		{
+			name:     "override by number",
+			labels:   map[string]string{k8splatforms.AMD64LevelLabel: "3"},
+			expected: "linux/amd64/v3",
+		},
+		{
+			name:     "override by level name",
+			labels:   map[string]string{k8splatforms.AMD64LevelLabel: "x86-64-v2"},
+			expected: "linux/amd64/v2",
+		},
+		{
+			name:        "invalid override",
+			labels:      with(v3Features, k8splatforms.AMD64LevelLabel, "avx2"),
+			expectedErr: `node node1: invalid container-platform-tools/amd64-level label "avx2": expecting v1 to v4`,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			node := corev1.Node{ObjectMeta: metav1.ObjectMeta{
+				Name:   "node1",
+				Labels: with(tc.labels, "kubernetes.io/os", "linux", "kubernetes.io/arch", "amd64"),
+			}}
+			platform, err := k8splatforms.NodePlatform(node)
+			var errText string
+			if err != nil {
+				errText = err.Error()
+			}
+			if diff := cmp.Diff(tc.expectedErr, errText); diff != "" {
+				t.Errorf("NodePlatform() error (-want +got):\n%s", diff)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(tc.expected, platform.String()); diff != "" {
+				t.Errorf("NodePlatform() (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNodePlatformsOtherArchitectures(t *testing.T) {
+	nodes := []corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{
+			"kubernetes.io/os":                          "linux",
+			"kubernetes.io/arch":                        "arm64",
+			"feature.node.kubernetes.io/cpu-cpuid.AVX2": "true",
+		}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node2", Labels: map[string]string{
+			"kubernetes.io/os":                 "windows",
+			"kubernetes.io/arch":               "amd64",
+			"node.kubernetes.io/windows-build": "10.0.20348",
+		}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node3", Labels: map[string]string{
+			"kubernetes.io/os":   "linux",
+			"kubernetes.io/arch": "arm64",
+		}}},
+	}
+	platforms, err := k8splatforms.NodePlatforms(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("linux/arm64, windows(10.0.20348)/amd64", platforms.String()); diff != "" {
+		t.Errorf("NodePlatforms() (-want +got):\n%s", diff)
+	}
+}
+
+func with(labels map[string]string, keyValues ...string) map[string]string {
+	result := make(map[string]string, len(labels)+len(keyValues)/2)
+	for key, value := range labels {
+		result[key] = value
+	}
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		result[keyValues[i]] = keyValues[i+1]
+	}
+	return result
+}
+
+func without(labels map[string]string, key string) map[string]string {
+	result := with(labels)
+	delete(result, key)
+	return result
+}
@@ -0,0 +1,216 @@
+package k8splatforms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+	"golang.org/x/sync/singleflight"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// PullSecrets resolves the imagePullSecrets of pods into registry credentials.
+// Secrets and service accounts are fetched once per run.
+//
+// Those the user is not allowed to read are ignored like missing ones,
+// so that images are still looked up with the other credentials, if any.
+type PullSecrets struct {
+	// Warnings receives a warning the first time reading a secret or service account is forbidden.
+	// When nil, the warning is discarded.
+	Warnings io.Writer
+
+	clientset kubernetes.Interface
+
+	mu              sync.Mutex
+	serviceAccounts map[string]*corev1.ServiceAccount
+	secrets         map[string]*corev1.Secret
+	fetches         singleflight.Group
+	warnForbidden   sync.Once
+}
+
+// NewPullSecrets creates a PullSecrets reading from the cluster through the clientset.
+func NewPullSecrets(clientset kubernetes.Interface) *PullSecrets {
+	return &PullSecrets{
+		clientset:       clientset,
+		serviceAccounts: make(map[string]*corev1.ServiceAccount),
+		secrets:         make(map[string]*corev1.Secret),
+	}
+}
+
+// WithPullCredentials returns a context carrying the credentials of the pod's imagePullSecrets
+// and those of its service account, as the kubelet would use them.
+// Secrets that do not exist are ignored, like the kubelet does, and so are those the user may not read.
+func (p *PullSecrets) WithPullCredentials(ctx context.Context, namespace string, spec corev1.PodSpec) (context.Context, error) {
+	ctx, _, err := p.withPullCredentials(ctx, namespace, spec)
+	return ctx, err
+}
+
+// withPullCredentials is WithPullCredentials also returning the scope of the credentials,
+// empty when the pod has none.
+func (p *PullSecrets) withPullCredentials(ctx context.Context, namespace string, spec corev1.PodSpec) (context.Context, string, error) {
+	names := make([]string, 0, len(spec.ImagePullSecrets))
+	for _, ref := range spec.ImagePullSecrets {
+		names = append(names, ref.Name)
+	}
+
+	serviceAccountName := spec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = "default"
+	}
+	serviceAccount, err := p.getServiceAccount(ctx, namespace, serviceAccountName)
+	if err != nil {
+		return ctx, "", err
+	}
+	if serviceAccount != nil {
+		for _, ref := range serviceAccount.ImagePullSecrets {
+			names = append(names, ref.Name)
+		}
+	}
+
+	var stores dockerplatforms.CredentialStores
+	var found []string
+	for _, name := range names {
+		if slices.Contains(found, name) {
+			continue
+		}
+		secret, err := p.getSecret(ctx, namespace, name)
+		if err != nil {
+			return ctx, "", err
+		}
+		if secret == nil {
+			continue
+		}
+		store, ok, err := secretCredentials(secret)
+		if err != nil {
+			return ctx, "", errors.Wrapf(err, "reading secret %s/%s", namespace, name)
+		}
+		if !ok {
+			continue
+		}
+		stores = append(stores, store)
+		found = append(found, name)
+	}
+	if len(stores) == 0 {
+		return ctx, "", nil
+	}
+
+	scope := namespace + "/" + strings.Join(found, ",")
+	return dockerplatforms.WithPullCredentials(ctx, scope, stores), scope, nil
+}
+
+func (p *PullSecrets) getServiceAccount(ctx context.Context, namespace, name string) (*corev1.ServiceAccount, error) {
+	key := namespace + "/" + name
+	p.mu.Lock()
+	serviceAccount, ok := p.serviceAccounts[key]
+	p.mu.Unlock()
+	if ok {
+		return serviceAccount, nil
+	}
+
+	value, err := p.fetch(ctx, "serviceaccount:"+key, func(ctx context.Context) (interface{}, error) {
+		serviceAccount, err := p.clientset.CoreV1().ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) || p.forbidden(err) {
+			serviceAccount, err = nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get service account %s", key)
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.serviceAccounts[key] = serviceAccount
+		return serviceAccount, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*corev1.ServiceAccount), nil
+}
+
+func (p *PullSecrets) getSecret(ctx context.Context, namespace, name string) (*corev1.Secret, error) {
+	key := namespace + "/" + name
+	p.mu.Lock()
+	secret, ok := p.secrets[key]
+	p.mu.Unlock()
+	if ok {
+		return secret, nil
+	}
+
+	value, err := p.fetch(ctx, "secret:"+key, func(ctx context.Context) (interface{}, error) {
+		secret, err := p.clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) || p.forbidden(err) {
+			secret, err = nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get secret %s", key)
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.secrets[key] = secret
+		return secret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*corev1.Secret), nil
+}
+
+// fetch runs fn once for the concurrent callers asking for the same key, without holding p.mu,
+// so that a slow request only holds up the callers waiting for the same object.
+// fn runs without the cancellation of the caller starting it, as the others share its result;
+// each caller stops waiting when its own ctx is done.
+func (p *PullSecrets) fetch(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	shared := context.WithoutCancel(ctx)
+	ch := p.fetches.DoChan(key, func() (interface{}, error) {
+		return fn(shared)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-ch:
+		return result.Val, result.Err
+	}
+}
+
+// forbidden tells if err denies reading an object, warning about it the first time.
+func (p *PullSecrets) forbidden(err error) bool {
+	if !apierrors.IsForbidden(err) {
+		return false
+	}
+	p.warnForbidden.Do(func() {
+		if p.Warnings != nil {
+			fmt.Fprintf(p.Warnings, "warning: looking images up without the pull secrets that cannot be read: %v\n", err)
+		}
+	})
+	return true
+}
+
+// secretCredentials reads the registry credentials from a docker config secret.
+// Only the auths are used; credential helpers named in a secret are never executed.
+func secretCredentials(secret *corev1.Secret) (dockerplatforms.CredentialStore, bool, error) {
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		config, err := dockerplatforms.ParseDockerConfig(secret.Data[corev1.DockerConfigJsonKey])
+		if err != nil {
+			return nil, false, err
+		}
+		return &dockerplatforms.DockerConfig{Auths: config.Auths}, true, nil
+	case corev1.SecretTypeDockercfg:
+		var auths map[string]dockerplatforms.DockerAuthEntry
+		err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths)
+		if err != nil {
+			return nil, false, errors.Wrap(err, "parsing .dockercfg")
+		}
+		return &dockerplatforms.DockerConfig{Auths: auths}, true, nil
+	default:
+		return nil, false, nil
+	}
+}
@@ -0,0 +1,215 @@
+package k8splatforms_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+	"github.com/wantedly/container-platform-tools/dockerplatforms"
+	"github.com/wantedly/container-platform-tools/k8splatforms"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const privateManifest = `{
+	"schemaVersion": 2,
+	"mediaType": "application/vnd.oci.image.index.v1+json",
+	"manifests": [
+		{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest": "sha256:0000000000000000000000000000000000000000000000000000000000000001",
+			"size": 100,
+			"platform": {"os": "linux", "architecture": "amd64"}
+		},
+		{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest": "sha256:0000000000000000000000000000000000000000000000000000000000000002",
+			"size": 100,
+			"platform": {"os": "linux", "architecture": "arm64"}
+		}
+	]
+}`
+
+func TestEvaluateObjectsPullSecrets(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if username, password, ok := req.BasicAuth(); !ok || username != "alice" || password != "s3cret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Path != "/v2/private/app/manifests/latest" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		w.Write([]byte(privateManifest))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+	image := host + "/private/app:latest"
+
+	clientset := fake.NewSimpleClientset(
+		&corev1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Namespace: "team-a", Name: "default"},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "regcred"}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "regcred"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(`{"auths": {"` + host + `": {"username": "alice", "password": "s3cret"}}}`),
+			},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-b", Name: "legacy"},
+			Type:       corev1.SecretTypeDockercfg,
+			Data: map[string][]byte{
+				corev1.DockerConfigKey: []byte(`{"` + host + `": {"username": "alice", "password": "s3cret"}}`),
+			},
+		},
+	)
+
+	registryClient := dockerplatforms.NewRegistryClient()
+	registryClient.HTTPClient = server.Client()
+	inspector := dockerplatforms.New(registryClient, dockerplatforms.NewNopCache())
+
+	pod := func(namespace, name string, pullSecrets ...string) *corev1.Pod {
+		pod := &corev1.Pod{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:         namespace,
+				Name:              name,
+				CreationTimestamp: metav1.NewTime(time1),
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: image}},
+			},
+		}
+		for _, name := range pullSecrets {
+			pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+		}
+		return pod
+	}
+	objs := []client.Object{
+		pod("team-a", "from-service-account"),
+		pod("team-b", "from-pod-spec", "legacy"),
+		pod("team-b", "without-secret"),
+		pod("team-c", "missing-secret", "nonexistent"),
+	}
+
+	rows, _ := k8splatforms.EvaluateObjects(
+		ctx,
+		objs,
+		nil,
+		nil,
+		time1,
+		dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm64"),
+		inspector,
+		k8splatforms.NewPullSecrets(clientset),
+		[]k8splatforms.KindProcessor{k8splatforms.PodProcessor{}},
+		k8splatforms.EvaluateOptions{Concurrency: 1},
+	)
+
+	var got []string
+	for _, row := range rows {
+		got = append(got, row.Name+": "+row.ImagePlatforms.String()+" "+row.Error)
+	}
+	if diff := cmp.Diff(got, []string{
+		"from-service-account: linux/amd64, linux/arm64 ",
+		"from-pod-spec: linux/amd64, linux/arm64 ",
+		"without-secret: linux/amd64, linux/arm64 inspecting image platforms: retrieving manifest: unauthorized: access to " + host + "/private/app denied (401)",
+		"missing-secret: linux/amd64, linux/arm64 inspecting image platforms: retrieving manifest: unauthorized: access to " + host + "/private/app denied (401)",
+	}); diff != "" {
+		t.Errorf("unexpected rows (-want +got):\n%s", diff)
+	}
+}
+
+func TestEvaluateObjectsForbiddenPullSecrets(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v2/public/app/manifests/latest" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		w.Write([]byte(privateManifest))
+	}))
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "https://") + "/public/app:latest"
+
+	// The user may read service accounts, but no secret.
+	clientset := fake.NewSimpleClientset(
+		&corev1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Namespace: "team-a", Name: "default"},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "regcred"}},
+		},
+	)
+	clientset.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, action.(k8stesting.GetAction).GetName(), errors.New("RBAC: access denied"))
+	})
+	var warnings bytes.Buffer
+	pullSecrets := k8splatforms.NewPullSecrets(clientset)
+	pullSecrets.Warnings = &warnings
+
+	registryClient := dockerplatforms.NewRegistryClient()
+	registryClient.HTTPClient = server.Client()
+	inspector := dockerplatforms.New(registryClient, dockerplatforms.NewNopCache())
+
+	var objs []client.Object
+	for _, name := range []string{"first", "second"} {
+		objs = append(objs, &corev1.Pod{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:         "team-a",
+				Name:              name,
+				CreationTimestamp: metav1.NewTime(time1),
+			},
+			Spec: corev1.PodSpec{
+				Containers:       []corev1.Container{{Name: "app", Image: image}},
+				ImagePullSecrets: []corev1.LocalObjectReference{{Name: name}},
+			},
+		})
+	}
+
+	rows, errs := k8splatforms.EvaluateObjects(
+		ctx,
+		objs,
+		nil,
+		nil,
+		time1,
+		dockerplatforms.MustParseDockerPlatformList("linux/amd64, linux/arm64"),
+		inspector,
+		pullSecrets,
+		[]k8splatforms.KindProcessor{k8splatforms.PodProcessor{}},
+		k8splatforms.EvaluateOptions{Concurrency: 1},
+	)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+
+	var got []string
+	for _, row := range rows {
+		got = append(got, row.Name+": "+row.ImagePlatforms.String()+" "+row.Error)
+	}
+	if diff := cmp.Diff(got, []string{
+		"first: linux/amd64, linux/arm64 ",
+		"second: linux/amd64, linux/arm64 ",
+	}); diff != "" {
+		t.Errorf("unexpected rows (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(1, strings.Count(warnings.String(), "warning: ")); diff != "" {
+		t.Errorf("warnings (-want +got):\n%s\n%s", diff, warnings.String())
+	}
+}